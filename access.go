@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultSecretHeader - the header carrying access.secret, unless access.secret_header is set
+const defaultSecretHeader = "X-S3Helper-Secret"
+
+// accessPolicy - decides which clients may fetch objects, built from the access section
+type accessPolicy struct {
+	allow        []*net.IPNet // empty allows every address that isn't denied
+	deny         []*net.IPNet
+	proxies      []*net.IPNet // peers whose X-Forwarded-For is trusted
+	secretHeader string
+	secret       string
+}
+
+// parseCIDRs - parses a list of CIDRs; a bare address stands for itself alone
+func parseCIDRs(key string, list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("access.%s: bad address %q", key, s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("access.%s: %v", key, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// newAccessPolicy - validates the access section
+func newAccessPolicy(c *accessConfig) (*accessPolicy, error) {
+	p := &accessPolicy{secretHeader: c.SecretHeader, secret: c.Secret}
+	if p.secretHeader == "" {
+		p.secretHeader = defaultSecretHeader
+	}
+
+	var err error
+	if p.allow, err = parseCIDRs("allow", c.Allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parseCIDRs("deny", c.Deny); err != nil {
+		return nil, err
+	}
+	if p.proxies, err = parseCIDRs("trusted_proxies", c.TrustedProxies); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// peerIP - the address of the connection's peer, nil for unix sockets
+func peerIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i] // drop the zone of link-local addresses
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP - the address the request originates from.  X-Forwarded-For is only
+// believed when the peer is a trusted proxy, and then walked from the right,
+// skipping the trusted proxies, so that a client can't spoof its address by sending
+// the header itself.
+func (p *accessPolicy) clientIP(r *http.Request, peer net.IP) net.IP {
+	if peer == nil || containsIP(p.proxies, peer) == nil {
+		return peer
+	}
+	var hops []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break // garbage, stick to the last address we could trust
+		}
+		client = ip
+		if containsIP(p.proxies, ip) == nil {
+			break
+		}
+	}
+	return client
+}
+
+// check - returns why r is denied, "" if it is allowed.  Clients on a unix socket
+// have no address, the permissions of the socket decide who can connect; they are
+// still subject to the shared secret.
+func (p *accessPolicy) check(r *http.Request) (client string, reason string) {
+	peer := peerIP(r.RemoteAddr)
+	if peer == nil {
+		client = "unix"
+	} else {
+		ip := p.clientIP(r, peer)
+		client = ip.String()
+		if n := containsIP(p.deny, ip); n != nil {
+			return client, fmt.Sprintf("address in deny list (%v)", n)
+		}
+		if len(p.allow) > 0 && containsIP(p.allow, ip) == nil {
+			return client, "address not in allow list"
+		}
+	}
+
+	if p.secret != "" {
+		got := r.Header.Get(p.secretHeader)
+		if got == "" {
+			return client, fmt.Sprintf("missing %s header", p.secretHeader)
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(p.secret)) != 1 {
+			return client, fmt.Sprintf("wrong %s header", p.secretHeader)
+		}
+	}
+	return client, ""
+}
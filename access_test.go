@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	p, err := newAccessPolicy(&accessConfig{
+		Allow:          []string{"127.0.0.0/8", "::1", "10.0.0.0/8", "fd00::/8"},
+		Deny:           []string{"10.6.6.0/24"},
+		TrustedProxies: []string{"10.0.0.1", "10.0.0.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		allowed    bool
+		client     string
+	}{
+		{"127.0.0.1:1234", "", true, "127.0.0.1"},
+		{"[::1]:1234", "", true, "::1"},
+		{"[fd00::5%eth0]:1234", "", true, "fd00::5"},
+		{"10.1.2.3:1234", "", true, "10.1.2.3"},
+		{"10.6.6.6:1234", "", false, "10.6.6.6"},
+		{"192.168.1.1:1234", "", false, "192.168.1.1"},
+		{"[2001:db8::1]:1234", "", false, "2001:db8::1"},
+		{"@", "", true, "unix"},
+		// a client that isn't a trusted proxy can't claim another address
+		{"192.168.1.1:1234", "127.0.0.1", false, "192.168.1.1"},
+		// a trusted proxy passes the client on, other proxies are skipped
+		{"10.0.0.1:1234", "192.168.1.1", false, "192.168.1.1"},
+		{"10.0.0.1:1234", "1.2.3.4, 127.0.0.1, 10.0.0.2", true, "127.0.0.1"},
+		{"10.0.0.1:1234", "10.6.6.6", false, "10.6.6.6"},
+		{"10.0.0.1:1234", "", true, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		client, reason := p.check(r)
+		if (reason == "") != tt.allowed || client != tt.client {
+			t.Errorf("%s xff %q: expected allowed=%v client %s, got %s %q", tt.remoteAddr, tt.xff, tt.allowed, tt.client, client, reason)
+		}
+	}
+}
+
+func TestAccessPolicy_Secret(t *testing.T) {
+	p, err := newAccessPolicy(&accessConfig{Secret: "s3kr1t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for secret, allowed := range map[string]bool{"": false, "wrong": false, "s3kr1t": true} {
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.RemoteAddr = "192.168.1.1:1234"
+		if secret != "" {
+			r.Header.Set(defaultSecretHeader, secret)
+		}
+		if _, reason := p.check(r); (reason == "") != allowed {
+			t.Errorf("secret %q: expected allowed=%v, got %q", secret, allowed, reason)
+		}
+	}
+}
+
+func TestAccessPolicy_Invalid(t *testing.T) {
+	for _, c := range []accessConfig{
+		{Allow: []string{"localhost"}},
+		{Deny: []string{"10.0.0.0/33"}},
+		{TrustedProxies: []string{"10.0.0"}},
+	} {
+		if _, err := newAccessPolicy(&c); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
+
+func TestProxyS3Media_IPv6Loopback(t *testing.T) {
+	a := newMockApp(map[string]interface{}{"svod/show/manifest.json": "{}"})
+	r := httptest.NewRequest("GET", "/show/manifest.json", nil)
+	r.RemoteAddr = "[::1]:54321"
+	w := httptest.NewRecorder()
+	a.proxyS3Media(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for ::1, got %d", w.Code)
+	}
+}
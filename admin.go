@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Set at build time, see the build target of the Makefile
+var (
+	gitSHA    = "unknown"
+	buildTime = "unknown"
+)
+
+// Fallbacks used when the readiness settings are missing from the config
+const (
+	defaultReadinessCacheTTL = 10 * time.Second
+	defaultReadinessTimeout  = 2 * time.Second
+)
+
+// newAdminRouter - the mux served on admin_listen, kept apart from the object routes
+func (a *App) newAdminRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", http.HandlerFunc(a.healthz))
+	mux.Handle("/readyz", http.HandlerFunc(a.readyz))
+	mux.Handle("/version", http.HandlerFunc(a.version))
+	mux.Handle("/metrics", a.metrics)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// healthz - the process is up and serving HTTP
+func (a *App) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// bucketStatus - the outcome of the canary HEAD for one bucket
+type bucketStatus struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"canary_key"`
+	OK      bool   `json:"ok"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// readinessReport - the body of /readyz
+type readinessReport struct {
+	Status    string         `json:"status"`
+	CheckedAt time.Time      `json:"checked_at,omitempty"`
+	Buckets   []bucketStatus `json:"buckets,omitempty"`
+}
+
+// readinessChecker - runs the canary HEADs and caches their outcome, so that probes
+// from the orchestrator don't turn into a steady stream of S3 requests
+type readinessChecker struct {
+	mu        sync.Mutex
+	rc        *runtimeConfig // the config the cached results were checked with
+	checkedAt time.Time
+	results   []bucketStatus
+	running   chan struct{} // closed when the canary HEADs in flight are done, nil if none are
+}
+
+// check - returns the canary results for rc, re-running them once they are older
+// than the configured cache TTL.  The HEADs run outside the lock: concurrent probes
+// wait for the ones in flight rather than queueing behind them for the lock.
+func (c *readinessChecker) check(rc *runtimeConfig) ([]bucketStatus, time.Time) {
+	ttl := rc.conf.Readiness.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultReadinessCacheTTL
+	}
+	for {
+		c.mu.Lock()
+		if c.rc == rc && time.Since(c.checkedAt) < ttl {
+			results, checkedAt := c.results, c.checkedAt
+			c.mu.Unlock()
+			return results, checkedAt
+		}
+		if running := c.running; running != nil {
+			c.mu.Unlock()
+			<-running
+			continue
+		}
+		done := make(chan struct{})
+		c.running = done
+		c.mu.Unlock()
+
+		results := headCanaries(rc)
+		c.mu.Lock()
+		c.rc, c.checkedAt, c.results = rc, time.Now(), results
+		checkedAt := c.checkedAt
+		c.running = nil
+		c.mu.Unlock()
+		close(done)
+		return results, checkedAt
+	}
+}
+
+// headCanaries - HEADs every canary key of rc at once.  They aren't tied to the
+// probe that started them, as their results are shared with the probes waiting.
+func headCanaries(rc *runtimeConfig) []bucketStatus {
+	timeout := rc.conf.Readiness.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	results := make([]bucketStatus, 0, len(rc.conf.Readiness.CanaryKeys))
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	for bucket, key := range rc.conf.Readiness.CanaryKeys {
+		wg.Add(1)
+		go func(bucket, key string) {
+			defer wg.Done()
+			status := headCanary(ctx, rc, bucket, key)
+			resultsMu.Lock()
+			results = append(results, status)
+			resultsMu.Unlock()
+		}(bucket, key)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Bucket < results[j].Bucket })
+	return results
+}
+
+// headCanary - HEADs key in bucket through the configured backend
+func headCanary(ctx context.Context, rc *runtimeConfig, bucket, key string) bucketStatus {
+	req := &objectRequest{
+		Method: "HEAD",
+		Bucket: bucket,
+		Region: rc.conf.S3Region,
+		Key:    "/" + strings.TrimPrefix(key, "/"),
+	}
+	// reach the bucket the way requests for it do
+	for _, rt := range rc.routes.routes {
+		if rt.bucket == bucket {
+			req.Region, req.Profile, req.Role = rt.region, rt.profile, rt.role
+			req.SSECustomer = rt.sseCustomer
+			break
+		}
+	}
+
+	status := bucketStatus{Bucket: bucket, Key: key}
+	logger := log.With().Str("bucket", bucket).Str("object", req.Key).Str("method", req.Method).Logger()
+	start := time.Now()
+	resp, err := rc.backend.Fetch(ctx, req, &logger)
+	status.Latency = time.Since(start).String()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	resp.Body.Close()
+
+	status.Status = resp.StatusCode
+	status.OK = resp.StatusCode >= 200 && resp.StatusCode <= 299
+	if !status.OK {
+		status.Error = http.StatusText(resp.StatusCode)
+	}
+	return status
+}
+
+// readyz - whether the app should receive traffic: it is not draining and every
+// bucket with a canary key can be reached
+func (a *App) readyz(w http.ResponseWriter, r *http.Request) {
+	if !a.isReady() {
+		writeJSON(w, http.StatusServiceUnavailable, &readinessReport{Status: "draining"})
+		return
+	}
+
+	report := &readinessReport{Status: "ready"}
+	status := http.StatusOK
+	report.Buckets, report.CheckedAt = a.readiness.check(a.snapshot())
+	for _, b := range report.Buckets {
+		if !b.OK {
+			report.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, report)
+}
+
+// versionInfo - the body of /version
+type versionInfo struct {
+	GitSHA    string                 `json:"git_sha"`
+	BuildTime string                 `json:"build_time"`
+	GoVersion string                 `json:"go_version"`
+	Config    map[string]interface{} `json:"config"`
+}
+
+// version - build information and the config currently in effect, secrets redacted
+func (a *App) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &versionInfo{
+		GitSHA:    gitSHA,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+		Config:    redactedConfig(a.snapshot().conf),
+	})
+}
+
+// redactedConfig - c keyed by its yaml names, with the values of fields tagged
+// secret:"true" replaced
+func redactedConfig(c *Config) map[string]interface{} {
+	return redactValue(reflect.ValueOf(*c), false).(map[string]interface{})
+}
+
+func redactValue(v reflect.Value, secret bool) interface{} {
+	switch v.Kind() {
+	case reflect.Struct:
+		out := map[string]interface{}{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			out[name] = redactValue(v.Field(i), f.Tag.Get("secret") == "true")
+		}
+		return out
+	case reflect.Map:
+		out := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			out[fmt.Sprint(k.Interface())] = redactValue(v.MapIndex(k), secret)
+		}
+		return out
+	case reflect.Slice:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = redactValue(v.Index(i), secret)
+		}
+		return out
+	}
+
+	if secret {
+		if v.IsZero() {
+			return ""
+		}
+		return "REDACTED"
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return v.Interface()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveAdmin(a *App, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.newAdminRouter().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestAdmin_Readyz(t *testing.T) {
+	a := newMockApp(map[string]interface{}{"svod/canary.txt": "ok"})
+	rc := a.snapshot()
+	rc.conf.Readiness.CanaryKeys = map[string]string{"svod": "canary.txt"}
+	defer func() { rc.conf.Readiness.CanaryKeys = nil }()
+
+	if w := serveAdmin(a, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before start up, got %d", w.Code)
+	}
+
+	atomic.StoreInt32(&a.ready, 1)
+	w := serveAdmin(a, "/readyz")
+	var report readinessReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("bad body %q: %v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusOK || len(report.Buckets) != 1 || !report.Buckets[0].OK {
+		t.Fatalf("expected a ready svod bucket, got %d %q", w.Code, w.Body.String())
+	}
+
+	// a new snapshot invalidates the cached results
+	broken := *rc
+	broken.conf = &Config{Readiness: readinessConfig{CanaryKeys: map[string]string{"avod": "missing.txt", "svod": "canary.txt"}}}
+	a.setSnapshot(&broken)
+	w = serveAdmin(a, "/readyz")
+	report = readinessReport{}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusServiceUnavailable || len(report.Buckets) != 2 || report.Buckets[0].OK || !report.Buckets[1].OK {
+		t.Fatalf("expected an unavailable avod bucket, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestAdmin_ReadyzConcurrent(t *testing.T) {
+	a := newMockApp(map[string]interface{}{"svod/canary.txt": "ok"})
+	withConfig(t, a, func(c *Config) { c.Readiness.CanaryKeys = map[string]string{"svod": "canary.txt"} })
+	rc := *a.snapshot()
+	upstream := newGatedBackend(0)
+	rc.backend = upstream
+	a.setSnapshot(&rc)
+	atomic.StoreInt32(&a.ready, 1)
+
+	// probes arriving while the canary is HEADed wait for its result
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serveAdmin(a, "/readyz").Code
+		}(i)
+	}
+	for atomic.LoadInt32(&upstream.fetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("probe %d: expected 200, got %d", i, code)
+		}
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 1 {
+		t.Fatalf("expected a single canary HEAD, got %d", n)
+	}
+}
+
+func TestAdmin_HealthzAndVersion(t *testing.T) {
+	a := newMockApp(nil)
+	a.snapshot().conf.NewRelic.License = "very-secret"
+	defer func() { a.snapshot().conf.NewRelic.License = "" }()
+
+	if w := serveAdmin(a, "/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("healthz: expected 200, got %d", w.Code)
+	}
+
+	w := serveAdmin(a, "/version")
+	var info versionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.GoVersion == "" || info.GitSHA == "" {
+		t.Fatalf("version: unexpected body %q (%v)", w.Body.String(), err)
+	}
+	nr := info.Config["newrelic"].(map[string]interface{})
+	if nr["license"] != "REDACTED" {
+		t.Fatalf("version: license not redacted: %v", nr)
+	}
+	if info.Config["s3_bucket"] != "svod" {
+		t.Fatalf("version: config missing: %v", info.Config)
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/crunchyroll/evs-s3helper/awsclient"
+	"github.com/crunchyroll/evs-s3helper/diskcache"
+	"github.com/crunchyroll/evs-s3helper/statsd"
 	newrelic "github.com/newrelic/go-agent/v3/newrelic"
 	"github.com/rs/zerolog/log"
 )
@@ -19,11 +25,56 @@ type App struct {
 	router   *http.ServeMux
 	s3Client *awsclient.S3Client
 	nrapp    *newrelic.Application
+	metrics  *appMetrics      // served on /metrics of the admin listener
+	statsd   *statsd.Client   // nil unless statsd_addr is set
+	cache    *diskcache.Cache // nil unless cache.dir is set
+
+	// shared by every parallel download, nil if parallel_download.max_memory_mb is 0
+	parallelMemory *memoryBudget
+
+	// if set, every SDK client is this one rather than one built by newSDKClient;
+	// tests set it to awsclient's mock
+	sdkClient *awsclient.S3Client
+
+	// *runtimeConfig, swapped on SIGHUP
+	current atomic.Value
+
+	// shared connection pool for upstream S3 requests
+	transport    *s3Transport
+	s3HTTPClient *http.Client
+
+	server      *http.Server
+	adminServer *http.Server // health, readiness, version and metrics endpoints
+	readiness   readinessChecker
+	ready       int32         // 1 while serving, 0 before start up and once draining
+	stop        chan struct{} // closed on shutdown to stop background jobs
 }
 
+// newRelicShutdownTimeout - how long New Relic gets to flush its data on shutdown
+const newRelicShutdownTimeout = 10 * time.Second
+
 // Initialize - start the app with a path to config yaml
 func (a *App) Initialize(pprofFlag *bool, s3Region string) {
-	s3Client, err := awsclient.NewS3Client(s3Region)
+	a.stop = make(chan struct{})
+	a.transport = newS3Transport(&conf.S3Transport)
+	a.s3HTTPClient = &http.Client{Transport: a.transport}
+
+	cache, err := openCache(&conf.Cache)
+	if err != nil {
+		fmt.Printf("App failed to initiate due to invalid cache. error: %+v\n", err)
+		os.Exit(1)
+	}
+	a.cache = cache
+	a.metrics = newAppMetrics(a.transport, a.cache)
+	a.parallelMemory = newMemoryBudget(conf.ParallelDownload.MaxMemoryMB)
+
+	endpoint, err := newS3Endpoint(&conf.S3Endpoint)
+	if err != nil {
+		fmt.Printf("App failed to initiate due to invalid S3 endpoint. error: %+v\n", err)
+		os.Exit(1)
+	}
+
+	s3Client, err := a.newSDKClient(s3Region, "", endpoint, conf.S3Retries)
 	if err != nil {
 		fmt.Printf("App failed to initiate due to invalid S3 client. error: %+v\n", err)
 		os.Exit(1) // kill the app
@@ -32,6 +83,13 @@ func (a *App) Initialize(pprofFlag *bool, s3Region string) {
 	a.s3Client = s3Client
 	a.router = http.NewServeMux()
 
+	rc, err := a.newRuntimeConfig(&conf)
+	if err != nil {
+		fmt.Printf("App failed to initiate due to invalid config. error: %+v\n", err)
+		os.Exit(1)
+	}
+	a.setSnapshot(rc)
+
 	nrapp, nrerr := newrelic.NewApplication(
 		newrelic.ConfigAppName(conf.NewRelic.Name),
 		newrelic.ConfigLicense(conf.NewRelic.License),
@@ -44,9 +102,26 @@ func (a *App) Initialize(pprofFlag *bool, s3Region string) {
 	}
 	a.nrapp = nrapp
 
+	if conf.StatsdAddr != "" {
+		if conf.StatsdSampleRate > 0 {
+			statRate = conf.StatsdSampleRate
+		}
+		var tags []string
+		if conf.StatsdEnv != "" {
+			tags = append(tags, "env:"+conf.StatsdEnv)
+		}
+		a.statsd, err = statsd.New(conf.StatsdAddr, statsd.Options{Tags: tags, SampleRate: statRate})
+		if err != nil {
+			fmt.Printf("App failed to initiate due to invalid statsd address. error: %+v\n", err)
+			os.Exit(1)
+		}
+		log.Info().Msg(fmt.Sprintf("Sending stats to %v", conf.StatsdAddr))
+	}
+
 	initRuntime()
+	go a.reportPoolStats(conf.S3Transport.StatsInterval, a.stop)
 
-	// Use /avod/ for Ads config bucket vs. / for content bucket
+	// Requests are mapped onto buckets by the routes table, see routes.go
 	a.router.Handle("/", http.HandlerFunc(a.proxyS3Media))
 
 	if *pprofFlag {
@@ -61,16 +136,71 @@ func (a *App) Initialize(pprofFlag *bool, s3Region string) {
 	return
 }
 
-// Run - run the application with loaded App struct
-func (a *App) Run(port string) {
+// Run - run the application with loaded App struct.  listen is a comma separated
+// list of addresses, see listen.  It returns once the listeners are up and the app
+// is ready; a failure to start up kills the app.
+func (a *App) Run(listen string) {
 	fmt.Printf("App start up initiated.\n")
-	errLNS := http.ListenAndServe(port, a.router)
-	defer fmt.Print("App shutting down")
+	if conf.AdminListen != "" {
+		a.adminServer = serve(conf.AdminListen, &conf.UnixSocket, a.newAdminRouter())
+		log.Info().Msg(fmt.Sprintf("Admin endpoints on %v", a.adminServer.Addr))
+	}
+	a.server = serve(listen, &conf.UnixSocket, a.router)
+	atomic.StoreInt32(&a.ready, 1)
+}
 
-	if errLNS != nil {
-		fmt.Printf("App failed to start up. Error: %+v\n", errLNS)
+// serve - starts serving handler on every address of addrs in the background
+func serve(addrs string, sock *socketConfig, handler http.Handler) *http.Server {
+	lns, errLN := listenAll(addrs, sock)
+	if errLN != nil {
+		fmt.Printf("App failed to start up. Error: %+v\n", errLN)
 		os.Exit(1)
 	}
+
+	server := &http.Server{Addr: listenerAddrs(lns), Handler: handler}
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			if errSrv := server.Serve(ln); errSrv != nil && errSrv != http.ErrServerClosed {
+				fmt.Printf("App failed to serve. Error: %+v\n", errSrv)
+				os.Exit(1)
+			}
+		}(ln)
+	}
+	return server
+}
+
+// isReady - whether the app is serving and not draining
+func (a *App) isReady() bool {
+	return atomic.LoadInt32(&a.ready) == 1
+}
+
+// Shutdown - drains the app.  It is marked as not ready first and given delay for
+// load balancers to notice, then stops accepting connections and waits up to timeout
+// for in-flight requests (i.e. segments being streamed) to finish.  Finally the
+// statsd and New Relic data still buffered is flushed.
+func (a *App) Shutdown(delay, timeout time.Duration) {
+	atomic.StoreInt32(&a.ready, 0)
+	log.Info().Msg(fmt.Sprintf("Draining connections, shutting down in %v", delay))
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := a.server.Shutdown(ctx); err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Msg(fmt.Sprintf("Connections still open after %v, closing them", timeout))
+		a.server.Close()
+	}
+	// the admin endpoints go last, so probes see the app draining until the very end
+	if a.adminServer != nil {
+		a.adminServer.Close()
+	}
+
+	close(a.stop)
+	a.transport.CloseIdleConnections()
+	a.statsd.Close()
+	a.nrapp.Shutdown(newRelicShutdownTimeout)
+	fmt.Print("App shutting down\n")
 }
 
 func (a *App) initializeRoutes() {
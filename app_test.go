@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestApp_ShutdownDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	a := &App{
+		router:    http.NewServeMux(),
+		stop:      make(chan struct{}),
+		transport: newS3Transport(&transportConfig{}),
+	}
+	a.router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("complete segment"))
+	})
+	a.Run("127.0.0.1:0")
+	if !a.isReady() {
+		t.Fatalf("app not ready after Run")
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + a.server.Addr + "/slow")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		done <- result{string(body), err}
+	}()
+
+	<-started
+	a.Shutdown(0, time.Second)
+	if a.isReady() {
+		t.Fatalf("app still ready after Shutdown")
+	}
+
+	res := <-done
+	if res.err != nil || res.body != "complete segment" {
+		t.Fatalf("in-flight request was cut short: %q %v", res.body, res.err)
+	}
+	if _, err := http.Get("http://" + a.server.Addr + "/slow"); err == nil {
+		t.Fatalf("new connections still accepted after Shutdown")
+	}
+}
@@ -2,11 +2,16 @@ package awsclient
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"path"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
@@ -17,16 +22,149 @@ type mockS3Client struct {
 	// files map[string][]byte this is for later
 }
 
+// NewMockS3Client - an S3Client backed by an in-memory set of files keyed by
+// "bucket/key", for driving tests without talking to S3.  Versions other than the
+// latest are keyed by "bucket/key?versionId=<id>".  An error in place of the
+// content makes every request for that object fail with it.
+func NewMockS3Client(files map[string]interface{}) *S3Client {
+	return &S3Client{s3Manager: &mockS3Client{files: files}}
+}
+
+// noSuchKey - the error the SDK returns for a missing object
+func noSuchKey(key string) error {
+	return awserr.NewRequestFailure(
+		awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("Key %s does not exist", key), nil),
+		http.StatusNotFound, "mock-request-id")
+}
+
+// The validators of every mock object
+const mockETag = "this-is-a-dummy-etag"
+
+var mockLastModified = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// checkConditions - fails the way S3 does if the mock object doesn't meet the
+// conditions of a request.  If-Match and If-None-Match take precedence over the dates.
+func checkConditions(ifMatch, ifNoneMatch *string, ifModifiedSince, ifUnmodifiedSince *time.Time) error {
+	failed := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, http.StatusText(status), nil), status, "mock-request-id")
+	}
+	if ifMatch != nil {
+		if !etagMatches(*ifMatch) {
+			return failed("PreconditionFailed", http.StatusPreconditionFailed)
+		}
+	} else if ifUnmodifiedSince != nil && mockLastModified.After(*ifUnmodifiedSince) {
+		return failed("PreconditionFailed", http.StatusPreconditionFailed)
+	}
+	if ifNoneMatch != nil {
+		if etagMatches(*ifNoneMatch) {
+			return failed("NotModified", http.StatusNotModified)
+		}
+	} else if ifModifiedSince != nil && !mockLastModified.After(*ifModifiedSince) {
+		return failed("NotModified", http.StatusNotModified)
+	}
+	return nil
+}
+
+// etagMatches - whether a list of entity tags such as `"a", W/"b"` or `*` matches
+// the mock objects
+func etagMatches(list string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.Trim(strings.TrimPrefix(tag, "W/"), `"`) == mockETag {
+			return true
+		}
+	}
+	return false
+}
+
+// noSuchVersion - the error S3 returns for a missing version of an object
+func noSuchVersion(key, version string) error {
+	return awserr.NewRequestFailure(
+		awserr.New("NoSuchVersion", fmt.Sprintf("Version %s of %s does not exist", version, key), nil),
+		http.StatusNotFound, "mock-request-id")
+}
+
+func (m *mockS3Client) content(bucket, key, version *string) ([]byte, bool, error) {
+	name := path.Join(*bucket, *key)
+	if version != nil {
+		name += "?versionId=" + *version
+	}
+	v, ok := m.files[name]
+	if !ok {
+		return nil, false, nil
+	}
+	switch v := v.(type) {
+	case []byte:
+		return v, true, nil
+	case error:
+		return nil, true, v
+	}
+	return []byte(fmt.Sprintf("%v", v)), true, nil
+}
+
 func (m *mockS3Client) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	key := path.Join(*in.Bucket, *in.Key)
-	if _, ok := m.files[key]; !ok {
-		return &s3.GetObjectOutput{}, errors.New("Key does not exist")
-	}
-	cLength := int64(1)
-	etag := "this-is-a-dummy-etag"
-	return &s3.GetObjectOutput{
-		Body:          ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf("%v", m.files[key])))),
-		ContentLength: &cLength,
-		ETag:          &etag,
+	return m.GetObjectWithContext(aws.BackgroundContext(), in)
+}
+
+func (m *mockS3Client) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	content, ok, err := m.content(in.Bucket, in.Key, in.VersionId)
+	if err != nil {
+		return &s3.GetObjectOutput{}, err
+	}
+	if !ok && in.VersionId != nil {
+		return &s3.GetObjectOutput{}, noSuchVersion(path.Join(*in.Bucket, *in.Key), *in.VersionId)
+	}
+	if !ok {
+		return &s3.GetObjectOutput{}, noSuchKey(path.Join(*in.Bucket, *in.Key))
+	}
+
+	if err := checkConditions(in.IfMatch, in.IfNoneMatch, in.IfModifiedSince, in.IfUnmodifiedSince); err != nil {
+		return &s3.GetObjectOutput{}, err
+	}
+	out := &s3.GetObjectOutput{
+		ETag:         aws.String(mockETag),
+		LastModified: aws.Time(mockLastModified),
+		VersionId:    in.VersionId,
+	}
+
+	var first, last int64
+	n, _ := fmt.Sscanf(aws.StringValue(in.Range), "bytes=%d-%d", &first, &last)
+	if n > 0 && first >= int64(len(content)) {
+		return &s3.GetObjectOutput{}, awserr.NewRequestFailure(
+			awserr.New("InvalidRange", "The requested range is not satisfiable", nil),
+			http.StatusRequestedRangeNotSatisfiable, "mock-request-id")
+	}
+	if n == 2 && first <= last && first < int64(len(content)) {
+		if last >= int64(len(content)) {
+			last = int64(len(content)) - 1
+		}
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", first, last, len(content)))
+		content = content[first : last+1]
+	}
+
+	out.Body = ioutil.NopCloser(bytes.NewReader(content))
+	out.ContentLength = aws.Int64(int64(len(content)))
+	return out, nil
+}
+
+func (m *mockS3Client) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	content, ok, err := m.content(in.Bucket, in.Key, in.VersionId)
+	if err != nil {
+		return &s3.HeadObjectOutput{}, err
+	}
+	if !ok {
+		// HEAD responses carry no body, so S3 can only report a generic NotFound
+		return &s3.HeadObjectOutput{}, awserr.NewRequestFailure(
+			awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "mock-request-id")
+	}
+
+	if err := checkConditions(in.IfMatch, in.IfNoneMatch, in.IfModifiedSince, in.IfUnmodifiedSince); err != nil {
+		return &s3.HeadObjectOutput{}, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(content))),
+		ETag:          aws.String(mockETag),
+		LastModified:  aws.Time(mockLastModified),
+		VersionId:     in.VersionId,
 	}, nil
 }
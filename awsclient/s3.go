@@ -21,8 +21,16 @@ type S3Client struct {
 // The objective of S3Client will allow callers to manager a persistent connection
 // for a given bucket through it's life-time.
 func NewS3Client(region string) (*S3Client, error) {
+	return NewS3ClientWithConfig(aws.Config{Region: aws.String(region)}, "")
+}
+
+// NewS3ClientWithConfig - same as NewS3Client, but lets the caller tune the aws config,
+// e.g. to share an http.Client or to set the number of retries.  profile selects a
+// shared credentials profile, "" uses the default credential chain.
+func NewS3ClientWithConfig(cfg aws.Config, profile string) (*S3Client, error) {
 	sess, err := session.NewSessionWithOptions(session.Options{
-		Config:            aws.Config{Region: aws.String(region)},
+		Config:            cfg,
+		Profile:           profile,
 		SharedConfigState: session.SharedConfigEnable,
 	})
 
@@ -37,41 +45,167 @@ func NewS3Client(region string) (*S3Client, error) {
 
 // GetObjectOutput- constructs the output result from S3 GetObject call
 type GetObjectOutput struct {
-	Body            io.ReadCloser `type:"blob"`
-	CacheControl    *string       `location:"header" locationName:"Cache-Control" type:"string"`
-	ContentEncoding *string       `location:"header" locationName:"Content-Encoding" type:"string"`
-	ContentLength   *int64        `location:"header" locationName:"Content-Length" type:"long"`
-	ContentRange    *string       `location:"header" locationName:"Content-Range" type:"string"`
-	ContentType     *string       `location:"header" locationName:"Content-Type" type:"string"`
-	ETag            *string       `location:"header" locationName:"ETag" type:"string"`
-	Expiration      *string       `location:"header" locationName:"x-amz-expiration" type:"string"`
-	LastModified    *time.Time    `location:"header" locationName:"Last-Modified" type:"timestamp"`
-	StorageClass    *string       `location:"header" locationName:"x-amz-storage-class" type:"string" enum:"StorageClass"`
-	TagCount        *int64        `location:"header" locationName:"x-amz-tagging-count" type:"integer"`
-	VersionId       *string       `location:"header" locationName:"x-amz-version-id" type:"string"`
+	AcceptRanges       *string            `location:"header" locationName:"accept-ranges" type:"string"`
+	Body               io.ReadCloser      `type:"blob"`
+	CacheControl       *string            `location:"header" locationName:"Cache-Control" type:"string"`
+	ContentDisposition *string            `location:"header" locationName:"Content-Disposition" type:"string"`
+	ContentEncoding    *string            `location:"header" locationName:"Content-Encoding" type:"string"`
+	ContentLength      *int64             `location:"header" locationName:"Content-Length" type:"long"`
+	ContentRange       *string            `location:"header" locationName:"Content-Range" type:"string"`
+	ContentType        *string            `location:"header" locationName:"Content-Type" type:"string"`
+	ETag               *string            `location:"header" locationName:"ETag" type:"string"`
+	Expiration         *string            `location:"header" locationName:"x-amz-expiration" type:"string"`
+	LastModified       *time.Time         `location:"header" locationName:"Last-Modified" type:"timestamp"`
+	Metadata           map[string]*string `location:"headers" locationName:"x-amz-meta-" type:"map"`
+	StorageClass       *string            `location:"header" locationName:"x-amz-storage-class" type:"string" enum:"StorageClass"`
+	TagCount           *int64             `location:"header" locationName:"x-amz-tagging-count" type:"integer"`
+	VersionId          *string            `location:"header" locationName:"x-amz-version-id" type:"string"`
 }
 
 // GetObject - talks to S3 to get content/byte-range from the bucket
 func (client *S3Client) GetObject(bucket, s3Path, byterange string) (*GetObjectOutput, error) {
+	return client.GetObjectWithContext(aws.BackgroundContext(), bucket, s3Path, byterange)
+}
+
+// GetObjectWithContext - same as GetObject, but the request is cancelled along with ctx
+func (client *S3Client) GetObjectWithContext(ctx aws.Context, bucket, s3Path, byterange string) (*GetObjectOutput, error) {
+	return client.GetObjectWithOptions(ctx, bucket, s3Path, &GetObjectOptions{Range: byterange})
+}
+
+// GetObjectOptions - the optional parameters of GetObjectWithOptions, zero values are left out
+type GetObjectOptions struct {
+	Range             string
+	VersionID         string // "" for the latest version
+	SSECustomerKey    string // raw 256 bit SSE-C key, the SDK encodes it and adds its MD5
+	IfMatch           string
+	IfNoneMatch       string
+	IfModifiedSince   time.Time
+	IfUnmodifiedSince time.Time
+}
+
+// GetObjectWithOptions - same as GetObjectWithContext, with conditions on the object.
+// An object that doesn't meet them comes back as an awserr.RequestFailure with the
+// status S3 answered, i.e. 304 or 412.
+func (client *S3Client) GetObjectWithOptions(ctx aws.Context, bucket, s3Path string, opts *GetObjectOptions) (*GetObjectOutput, error) {
 	getInput := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(s3Path),
-		Range:  aws.String(byterange),
+	}
+	if opts.Range != "" {
+		getInput.Range = aws.String(opts.Range)
+	}
+	if opts.VersionID != "" {
+		getInput.VersionId = aws.String(opts.VersionID)
+	}
+	if opts.SSECustomerKey != "" {
+		getInput.SSECustomerAlgorithm = aws.String("AES256")
+		getInput.SSECustomerKey = aws.String(opts.SSECustomerKey)
+	}
+	if opts.IfMatch != "" {
+		getInput.IfMatch = aws.String(opts.IfMatch)
+	}
+	if opts.IfNoneMatch != "" {
+		getInput.IfNoneMatch = aws.String(opts.IfNoneMatch)
+	}
+	if !opts.IfModifiedSince.IsZero() {
+		getInput.IfModifiedSince = aws.Time(opts.IfModifiedSince)
+	}
+	if !opts.IfUnmodifiedSince.IsZero() {
+		getInput.IfUnmodifiedSince = aws.Time(opts.IfUnmodifiedSince)
 	}
 
-	result, err := client.s3Manager.GetObject(getInput)
+	result, err := client.s3Manager.GetObjectWithContext(ctx, getInput)
 	if err != nil {
 		return &GetObjectOutput{}, err
 	}
 
 	return &GetObjectOutput{
-		Body:            result.Body,
-		CacheControl:    result.CacheControl,
-		ContentEncoding: result.ContentEncoding,
-		ContentLength:   result.ContentLength,
-		ContentRange:    result.ContentRange,
-		ContentType:     result.ContentType,
-		ETag:            result.ETag,
-		VersionId:       result.VersionId,
+		AcceptRanges:       result.AcceptRanges,
+		Body:               result.Body,
+		CacheControl:       result.CacheControl,
+		ContentDisposition: result.ContentDisposition,
+		ContentEncoding:    result.ContentEncoding,
+		ContentLength:      result.ContentLength,
+		ContentRange:       result.ContentRange,
+		ContentType:        result.ContentType,
+		ETag:               result.ETag,
+		LastModified:       result.LastModified,
+		Metadata:           result.Metadata,
+		VersionId:          result.VersionId,
+	}, nil
+}
+
+// HeadObjectOutput - constructs the output result from S3 HeadObject call
+type HeadObjectOutput struct {
+	AcceptRanges       *string            `location:"header" locationName:"accept-ranges" type:"string"`
+	CacheControl       *string            `location:"header" locationName:"Cache-Control" type:"string"`
+	ContentDisposition *string            `location:"header" locationName:"Content-Disposition" type:"string"`
+	ContentEncoding    *string            `location:"header" locationName:"Content-Encoding" type:"string"`
+	ContentLength      *int64             `location:"header" locationName:"Content-Length" type:"long"`
+	ContentType        *string            `location:"header" locationName:"Content-Type" type:"string"`
+	ETag               *string            `location:"header" locationName:"ETag" type:"string"`
+	LastModified       *time.Time         `location:"header" locationName:"Last-Modified" type:"timestamp"`
+	Metadata           map[string]*string `location:"headers" locationName:"x-amz-meta-" type:"map"`
+	VersionId          *string            `location:"header" locationName:"x-amz-version-id" type:"string"`
+}
+
+// HeadObjectWithContext - talks to S3 to get the metadata of an object without its content
+func (client *S3Client) HeadObjectWithContext(ctx aws.Context, bucket, s3Path string) (*HeadObjectOutput, error) {
+	return client.HeadObjectWithOptions(ctx, bucket, s3Path, &HeadObjectOptions{})
+}
+
+// HeadObjectOptions - the optional parameters of HeadObjectWithOptions, zero values are left out
+type HeadObjectOptions struct {
+	VersionID         string // "" for the latest version
+	SSECustomerKey    string // raw 256 bit SSE-C key, the SDK encodes it and adds its MD5
+	IfMatch           string
+	IfNoneMatch       string
+	IfModifiedSince   time.Time
+	IfUnmodifiedSince time.Time
+}
+
+// HeadObjectWithOptions - same as HeadObjectWithContext, with conditions on the object.
+// They fail the same way as those of GetObjectWithOptions.
+func (client *S3Client) HeadObjectWithOptions(ctx aws.Context, bucket, s3Path string, opts *HeadObjectOptions) (*HeadObjectOutput, error) {
+	headInput := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Path),
+	}
+	if opts.VersionID != "" {
+		headInput.VersionId = aws.String(opts.VersionID)
+	}
+	if opts.SSECustomerKey != "" {
+		headInput.SSECustomerAlgorithm = aws.String("AES256")
+		headInput.SSECustomerKey = aws.String(opts.SSECustomerKey)
+	}
+	if opts.IfMatch != "" {
+		headInput.IfMatch = aws.String(opts.IfMatch)
+	}
+	if opts.IfNoneMatch != "" {
+		headInput.IfNoneMatch = aws.String(opts.IfNoneMatch)
+	}
+	if !opts.IfModifiedSince.IsZero() {
+		headInput.IfModifiedSince = aws.Time(opts.IfModifiedSince)
+	}
+	if !opts.IfUnmodifiedSince.IsZero() {
+		headInput.IfUnmodifiedSince = aws.Time(opts.IfUnmodifiedSince)
+	}
+
+	result, err := client.s3Manager.HeadObjectWithContext(ctx, headInput)
+	if err != nil {
+		return &HeadObjectOutput{}, err
+	}
+
+	return &HeadObjectOutput{
+		AcceptRanges:       result.AcceptRanges,
+		CacheControl:       result.CacheControl,
+		ContentDisposition: result.ContentDisposition,
+		ContentEncoding:    result.ContentEncoding,
+		ContentLength:      result.ContentLength,
+		ContentType:        result.ContentType,
+		ETag:               result.ETag,
+		LastModified:       result.LastModified,
+		Metadata:           result.Metadata,
+		VersionId:          result.VersionId,
 	}, nil
 }
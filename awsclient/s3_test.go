@@ -1,9 +1,12 @@
 package awsclient
 
 import (
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -115,3 +118,26 @@ func TestS3Client_Failure(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestS3Client_Conditions(t *testing.T) {
+	client := NewMockS3Client(map[string]interface{}{"svod/mediaId-0": []byte("content")})
+	ctx := aws.BackgroundContext()
+
+	out, err := client.GetObjectWithOptions(ctx, "svod", "mediaId-0", &GetObjectOptions{IfMatch: `"this-is-a-dummy-etag"`})
+	if err != nil || aws.TimeValue(out.LastModified).IsZero() {
+		t.Fatalf("If-Match: unexpected %v %v", out, err)
+	}
+	_, err = client.GetObjectWithOptions(ctx, "svod", "mediaId-0", &GetObjectOptions{IfMatch: `"other"`})
+	if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.StatusCode() != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match: expected a 412, got %v", err)
+	}
+	_, err = client.HeadObjectWithOptions(ctx, "svod", "mediaId-0", &HeadObjectOptions{IfModifiedSince: time.Now()})
+	if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.StatusCode() != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since: expected a 304, got %v", err)
+	}
+	// If-None-Match takes precedence over If-Modified-Since
+	_, err = client.HeadObjectWithOptions(ctx, "svod", "mediaId-0", &HeadObjectOptions{IfNoneMatch: `"other"`, IfModifiedSince: time.Now()})
+	if err != nil {
+		t.Fatalf("If-None-Match: unexpected %v", err)
+	}
+}
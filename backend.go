@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/crunchyroll/evs-s3helper/awsclient"
+	"github.com/crunchyroll/evs-s3helper/sigv4"
+	"github.com/rs/zerolog"
+)
+
+// Backends selectable with s3_backend
+const (
+	backendSigned = "signed"
+	backendSDK    = "sdk"
+)
+
+// objectRequest - what proxyS3Media needs from S3
+type objectRequest struct {
+	Method  string // GET or HEAD
+	Bucket  string
+	Region  string
+	Profile string // shared credentials profile, "" for the default credentials
+	Role    string // role assumed to sign the request, "" for none (signed backend only)
+	Key     string // full object key, including the route's key prefix
+	Version string // version ID of the object, "" for the latest
+	Range   string // raw Range header, "" for the whole object
+
+	SSECustomer *sseCustomerKey // nil if the object isn't encrypted with SSE-C
+
+	// conditions of the request, S3 answers 304 or 412 if the object doesn't meet them
+	IfMatch           string
+	IfNoneMatch       string
+	IfModifiedSince   time.Time
+	IfUnmodifiedSince time.Time
+	IfRange           string // raw If-Range header, only meaningful along with Range
+}
+
+// conditional - whether req carries conditions of its own
+func (req *objectRequest) conditional() bool {
+	return req.IfMatch != "" || req.IfNoneMatch != "" || !req.IfModifiedSince.IsZero() ||
+		!req.IfUnmodifiedSince.IsZero() || req.IfRange != ""
+}
+
+// s3Backend - fetches objects from S3 on behalf of proxyS3Media.
+//
+// Fetch returns the S3 response as an *http.Response whatever the transport.
+// Errors returned by the SDK backend are the SDK's awserr types, so proxyS3Media
+// handles both backends the same way.
+type s3Backend interface {
+	Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error)
+}
+
+// newBackend - builds the backend named in the s3_backend setting for the given routes
+func (a *App) newBackend(c *Config, routes *routeTable, endpoints *endpointResolver) (s3Backend, error) {
+	switch c.S3Backend {
+	case "", backendSigned:
+		creds, err := newCredentialSet(c, routes)
+		if err != nil {
+			return nil, err
+		}
+		return &signedBackend{
+			client:      a.s3HTTPClient,
+			endpoints:   endpoints,
+			credentials: creds,
+			retry:       newRetryPolicy(c),
+			app:         a,
+		}, nil
+	case backendSDK:
+		b := &sdkBackend{
+			fallback: a.s3Client,
+			clients:  make(map[sdkClientKey]*awsclient.S3Client),
+		}
+		for _, rt := range routes.routes {
+			key := sdkClientKey{bucket: rt.bucket, region: rt.region, profile: rt.profile}
+			if _, ok := b.clients[key]; ok {
+				continue
+			}
+			client, err := a.newSDKClient(rt.region, rt.profile, endpoints.forBucket(rt.bucket), c.S3Retries)
+			if err != nil {
+				return nil, err
+			}
+			b.clients[key] = client
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown s3_backend %q, expected %q or %q", c.S3Backend, backendSigned, backendSDK)
+}
+
+// signedBackend - bypasses the AWS SDK, signs and gets the object manually via HTTP.
+// Requests go through the shared transport and are retried according to s3_retries/s3_timeout.
+type signedBackend struct {
+	client      *http.Client
+	endpoints   *endpointResolver
+	credentials *credentialSet
+	retry       retryPolicy
+	app         *App
+}
+
+func (b *signedBackend) Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	logger.Debug().Msg(fmt.Sprintf("Signed S3 URL: %s\n", b.endpoints.forBucket(req.Bucket).objectURL(req.Region, req.Bucket, req.Key)))
+
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		r2, err := b.newRequest(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		// parse the byterange request header to derive the content-length requested
+		// so we know how much data we need to xfer from s3 to the client.
+		if req.Range != "" {
+			r2.Header.Set("Range", req.Range)
+			if req.IfRange != "" {
+				r2.Header.Set("If-Range", req.IfRange)
+			}
+		}
+		// set before signing, so that they are covered by the signature
+		if req.IfMatch != "" {
+			r2.Header.Set("If-Match", req.IfMatch)
+		}
+		if req.IfNoneMatch != "" {
+			r2.Header.Set("If-None-Match", req.IfNoneMatch)
+		}
+		setTimeHeader(r2.Header, "If-Modified-Since", &req.IfModifiedSince)
+		setTimeHeader(r2.Header, "If-Unmodified-Since", &req.IfUnmodifiedSince)
+		if req.SSECustomer != nil {
+			req.SSECustomer.setHeaders(r2.Header)
+		}
+
+		signer, _, err := b.signer(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if err := signer.Sign(r2, sigv4.EmptyPayload, time.Now()); err != nil {
+			return nil, err
+		}
+		return r2, nil
+	}
+
+	return b.app.doWithRetry(ctx, b.client, b.retry, newRequest, logger)
+}
+
+// newRequest - the unsigned request for the object of req
+func (b *signedBackend) newRequest(ctx context.Context, req *objectRequest) (*http.Request, error) {
+	endpoint := b.endpoints.forBucket(req.Bucket)
+	r2, err := http.NewRequestWithContext(ctx, req.Method, endpoint.baseURL(req.Region, req.Bucket), nil)
+	if err != nil {
+		return nil, err
+	}
+	// the key is set unescaped, the signer escapes it the way S3 expects
+	r2.URL.Path += req.Key
+	if req.Version != "" {
+		r2.URL.RawQuery = url.Values{"versionId": {req.Version}}.Encode()
+	}
+	return r2, nil
+}
+
+// signer - signs requests for req with the credentials of its route, which
+// expire at the time returned, zero if they don't
+func (b *signedBackend) signer(ctx context.Context, req *objectRequest) (*sigv4.Signer, time.Time, error) {
+	creds, err := b.credentials.forRequest(req).Retrieve(ctx)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("no credentials to sign with: %w", err)
+	}
+	return &sigv4.Signer{
+		Credentials: sigv4.Credentials{
+			AccessKeyID:     creds.AccessKeyID,
+			SecretAccessKey: creds.SecretAccessKey,
+			SessionToken:    creds.SessionToken,
+		},
+		Region:  req.Region,
+		Service: "s3",
+	}, creds.Expires, nil
+}
+
+// newSDKClient - an SDK client that reaches S3 through endpoint and the shared transport
+func (a *App) newSDKClient(region, profile string, endpoint *s3Endpoint, maxRetries int) (*awsclient.S3Client, error) {
+	if a.sdkClient != nil {
+		return a.sdkClient, nil
+	}
+	return awsclient.NewS3ClientWithConfig(aws.Config{
+		Region:           aws.String(region),
+		Endpoint:         aws.String(endpoint.serviceURL(region)),
+		S3ForcePathStyle: aws.Bool(!endpoint.virtual),
+		HTTPClient:       a.s3HTTPClient,
+		MaxRetries:       aws.Int(maxRetries),
+	}, profile)
+}
+
+// sdkClientKey - what makes one route need a different SDK client from another
+type sdkClientKey struct {
+	bucket  string
+	region  string
+	profile string
+}
+
+// sdkBackend - goes through awsclient.S3Client, i.e. the SDK's GetObject/HeadObject.
+// Retries are left to the SDK, which is configured with s3_retries.  Every distinct
+// bucket/region/profile of the routes gets its own client.
+type sdkBackend struct {
+	fallback *awsclient.S3Client
+	clients  map[sdkClientKey]*awsclient.S3Client
+}
+
+func (b *sdkBackend) clientFor(req *objectRequest) *awsclient.S3Client {
+	if client, ok := b.clients[sdkClientKey{bucket: req.Bucket, region: req.Region, profile: req.Profile}]; ok {
+		return client
+	}
+	return b.fallback
+}
+
+func (b *sdkBackend) Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	key := strings.TrimPrefix(req.Key, "/")
+	client := b.clientFor(req)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+	}
+
+	if req.Method == "HEAD" {
+		out, err := client.HeadObjectWithOptions(ctx, req.Bucket, key, &awsclient.HeadObjectOptions{
+			VersionID:         req.Version,
+			SSECustomerKey:    sseKey(req),
+			IfMatch:           req.IfMatch,
+			IfNoneMatch:       req.IfNoneMatch,
+			IfModifiedSince:   req.IfModifiedSince,
+			IfUnmodifiedSince: req.IfUnmodifiedSince,
+		})
+		if failedCondition(err) {
+			return conditionResponse(errorStatus(err)), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.ContentLength = aws.Int64Value(out.ContentLength)
+		setHeader(resp.Header, "Accept-Ranges", out.AcceptRanges)
+		setHeader(resp.Header, "Cache-Control", out.CacheControl)
+		setHeader(resp.Header, "Content-Disposition", out.ContentDisposition)
+		setHeader(resp.Header, "Content-Encoding", out.ContentEncoding)
+		setHeader(resp.Header, "Content-Type", out.ContentType)
+		setHeader(resp.Header, "ETag", out.ETag)
+		setHeader(resp.Header, "x-amz-version-id", out.VersionId)
+		setTimeHeader(resp.Header, "Last-Modified", out.LastModified)
+		setMetadata(resp.Header, out.Metadata)
+	} else {
+		out, err := getWithIfRange(ctx, client, req, key)
+		if failedCondition(err) {
+			return conditionResponse(errorStatus(err)), nil
+		}
+		if err != nil {
+			return nil, withObjectSize(ctx, client, req, key, err)
+		}
+		if out.ContentRange != nil {
+			resp.StatusCode = http.StatusPartialContent
+		}
+		if out.Body != nil {
+			resp.Body = out.Body
+		}
+		resp.ContentLength = aws.Int64Value(out.ContentLength)
+		setHeader(resp.Header, "Accept-Ranges", out.AcceptRanges)
+		setHeader(resp.Header, "Cache-Control", out.CacheControl)
+		setHeader(resp.Header, "Content-Disposition", out.ContentDisposition)
+		setHeader(resp.Header, "Content-Encoding", out.ContentEncoding)
+		setHeader(resp.Header, "Content-Range", out.ContentRange)
+		setHeader(resp.Header, "Content-Type", out.ContentType)
+		setHeader(resp.Header, "ETag", out.ETag)
+		setHeader(resp.Header, "x-amz-version-id", out.VersionId)
+		setTimeHeader(resp.Header, "Last-Modified", out.LastModified)
+		setMetadata(resp.Header, out.Metadata)
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	return resp, nil
+}
+
+// withObjectSize - err, along with the size of the object if S3 refused the range
+// asked for.  Clients get the size in the Content-Range of the 416, which takes a
+// HEAD here since the SDK leaves it out of the error.
+func withObjectSize(ctx context.Context, client *awsclient.S3Client, req *objectRequest, key string, err error) error {
+	var reqErr awserr.RequestFailure
+	if !errors.As(err, &reqErr) || reqErr.Code() != errCodeInvalidRange {
+		return err
+	}
+	out, headErr := client.HeadObjectWithOptions(ctx, req.Bucket, key, &awsclient.HeadObjectOptions{
+		VersionID:      req.Version,
+		SSECustomerKey: sseKey(req),
+	})
+	if headErr != nil || out.ContentLength == nil {
+		return err
+	}
+	return &invalidRangeError{RequestFailure: reqErr, objectSize: *out.ContentLength}
+}
+
+// errorStatus - the status S3 answered with when the SDK reports it as err, 0 if none
+func errorStatus(err error) int {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode()
+	}
+	return 0
+}
+
+// getWithIfRange - gets the object for req.  The SDK has no If-Range, so it is
+// emulated: the range is asked for on the condition that the object still matches
+// If-Range, and if it doesn't the whole object is fetched instead.
+func getWithIfRange(ctx context.Context, client *awsclient.S3Client, req *objectRequest, key string) (*awsclient.GetObjectOutput, error) {
+	opts := awsclient.GetObjectOptions{
+		Range:             req.Range,
+		VersionID:         req.Version,
+		SSECustomerKey:    sseKey(req),
+		IfMatch:           req.IfMatch,
+		IfNoneMatch:       req.IfNoneMatch,
+		IfModifiedSince:   req.IfModifiedSince,
+		IfUnmodifiedSince: req.IfUnmodifiedSince,
+	}
+	if req.Range == "" || req.IfRange == "" {
+		return client.GetObjectWithOptions(ctx, req.Bucket, key, &opts)
+	}
+
+	ranged := opts
+	if t, err := http.ParseTime(req.IfRange); err == nil {
+		if ranged.IfUnmodifiedSince.IsZero() {
+			ranged.IfUnmodifiedSince = t
+		}
+	} else if ranged.IfMatch == "" {
+		ranged.IfMatch = req.IfRange
+	}
+	out, err := client.GetObjectWithOptions(ctx, req.Bucket, key, &ranged)
+	if errorStatus(err) != http.StatusPreconditionFailed {
+		return out, err
+	}
+	// the object changed, or the request's own conditions failed, which the
+	// unranged request reports again
+	opts.Range = ""
+	return client.GetObjectWithOptions(ctx, req.Bucket, key, &opts)
+}
+
+// sseKey - the raw SSE-C key of req for the SDK, "" if there is none
+func sseKey(req *objectRequest) string {
+	if req.SSECustomer == nil {
+		return ""
+	}
+	return req.SSECustomer.key
+}
+
+// failedCondition - whether err is S3 answering 304 or 412 to a conditional request,
+// which the SDK reports as an error
+func failedCondition(err error) bool {
+	status := errorStatus(err)
+	return status == http.StatusNotModified || status == http.StatusPreconditionFailed
+}
+
+// conditionResponse - a bodiless response with status, as S3 sends for failed conditions
+func conditionResponse(status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+	}
+}
+
+func setHeader(h http.Header, name string, v *string) {
+	if v != nil && *v != "" {
+		h.Set(name, *v)
+	}
+}
+
+// setMetadata - sets the user metadata of an object as the x-amz-meta-* headers S3 sends it in
+func setMetadata(h http.Header, metadata map[string]*string) {
+	for name, v := range metadata {
+		setHeader(h, "x-amz-meta-"+name, v)
+	}
+}
+
+func setTimeHeader(h http.Header, name string, v *time.Time) {
+	if v != nil && !v.IsZero() {
+		h.Set(name, v.UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// rangeSpec - one range of a Range header, before the object size is known.  first
+// is -1 for a suffix range ("-n"), last is -1 for an open range ("n-").
+type rangeSpec struct {
+	first, last int64
+}
+
+// byteRange - a range resolved against the object size, both ends included
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) length() int64 { return r.end - r.start + 1 }
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// header - the Range header asking S3 for r of an object of size bytes, "" for the
+// whole object, which keeps it a plain GET that can be cached as such
+func (r byteRange) header(size int64) string {
+	if r.length() == size {
+		return ""
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.start, r.end)
+}
+
+// multiRange - whether header asks for more than one range, which S3 doesn't serve
+func multiRange(header string) bool {
+	return strings.HasPrefix(header, "bytes=") && strings.Contains(header, ",")
+}
+
+// handles - whether a request for method with the Range header is for several
+// ranges that s3helper serves itself
+func (c *multiRangeConfig) handles(method, header string) bool {
+	return method == "GET" && c.MaxRanges > 0 && multiRange(header) && strings.Count(header, ",") < c.MaxRanges
+}
+
+// parseRanges - the ranges of a Range header such as "bytes=0-99,200-,-50"
+func parseRanges(header string) ([]rangeSpec, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, fmt.Errorf("unsupported range unit in %q", header)
+	}
+	var specs []rangeSpec
+	for _, part := range strings.Split(header[len("bytes="):], ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue // empty list elements are allowed
+		}
+		dash := strings.IndexByte(part, '-')
+		if dash < 0 {
+			return nil, fmt.Errorf("bad range %q", part)
+		}
+		first, last := strings.TrimSpace(part[:dash]), strings.TrimSpace(part[dash+1:])
+		spec := rangeSpec{first: -1, last: -1}
+		var err error
+		switch {
+		case first == "" && last == "":
+			return nil, fmt.Errorf("bad range %q", part)
+		case first == "":
+			if spec.last, err = strconv.ParseInt(last, 10, 64); err != nil || spec.last < 0 {
+				return nil, fmt.Errorf("bad range %q", part)
+			}
+		default:
+			if spec.first, err = strconv.ParseInt(first, 10, 64); err != nil || spec.first < 0 {
+				return nil, fmt.Errorf("bad range %q", part)
+			}
+			if last != "" {
+				if spec.last, err = strconv.ParseInt(last, 10, 64); err != nil || spec.last < spec.first {
+					return nil, fmt.Errorf("bad range %q", part)
+				}
+			}
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no range in %q", header)
+	}
+	return specs, nil
+}
+
+// resolveRanges - the satisfiable ranges of specs for an object of size bytes, in
+// order and with overlapping or adjacent ranges merged.  None are left if none is
+// satisfiable.
+func resolveRanges(specs []rangeSpec, size int64) []byteRange {
+	var ranges []byteRange
+	for _, spec := range specs {
+		var r byteRange
+		switch {
+		case spec.first < 0: // the last spec.last bytes
+			if spec.last == 0 || size == 0 {
+				continue
+			}
+			r = byteRange{start: size - spec.last, end: size - 1}
+			if r.start < 0 {
+				r.start = 0
+			}
+		case spec.first >= size:
+			continue
+		default:
+			r = byteRange{start: spec.first, end: spec.last}
+			if spec.last < 0 || spec.last >= size {
+				r.end = size - 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.start <= merged[n-1].end+1 {
+			if r.end > merged[n-1].end {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// newBoundary - a random multipart boundary
+func newBoundary() string {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// partHeader - the header of the part of a multipart/byteranges body holding r
+func partHeader(contentType string, r byteRange, size int64) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{"Content-Range": {r.contentRange(size)}}
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	return h
+}
+
+// countingWriter - counts the bytes written to it
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// multipartSize - the size of the multipart/byteranges body holding ranges, as
+// serveRanges writes it
+func multipartSize(boundary, contentType string, ranges []byteRange, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(partHeader(contentType, r, size))
+		w += countingWriter(r.length())
+	}
+	mw.Close()
+	return int64(w)
+}
+
+// partResult - the S3 response for one range
+type partResult struct {
+	resp *http.Response
+	err  error
+}
+
+// fetchRanges - fetches ranges of req from backend, at most parallel at a time.  The
+// result for range i arrives on the i-th channel; the next range is only fetched once
+// the caller called done for an earlier one, so that no more than parallel responses
+// are open at a time.
+func fetchRanges(ctx context.Context, backend s3Backend, req objectRequest, ranges []byteRange, size int64,
+	parallel int, logger *zerolog.Logger) (results []chan partResult, done func()) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	results = make([]chan partResult, len(ranges))
+	for i := range results {
+		results[i] = make(chan partResult, 1)
+	}
+	go func() {
+		for i, r := range ranges {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] <- partResult{err: ctx.Err()}
+				continue
+			}
+			part := req
+			part.Range = r.header(size)
+			go func(i int) {
+				resp, err := backend.Fetch(ctx, &part, logger)
+				results[i] <- partResult{resp: resp, err: err}
+			}(i)
+		}
+	}()
+	return results, func() { <-sem }
+}
+
+var (
+	errPartMismatch  = errors.New("S3 answered a range with an unexpected response")
+	errObjectChanged = errors.New("the object changed while its ranges were fetched")
+)
+
+// checkPart - makes sure res holds exactly r of an object of size bytes, closing its
+// body if it doesn't
+func checkPart(res partResult, r byteRange, size int64) error {
+	if res.err != nil {
+		return res.err
+	}
+	if res.resp.StatusCode == http.StatusPreconditionFailed {
+		res.resp.Body.Close()
+		return errObjectChanged
+	}
+	want := http.StatusPartialContent
+	if r.header(size) == "" {
+		want = http.StatusOK
+	}
+	if res.resp.StatusCode != want || res.resp.ContentLength != r.length() {
+		res.resp.Body.Close()
+		return fmt.Errorf("%w: %d with %d bytes for %d-%d", errPartMismatch,
+			res.resp.StatusCode, res.resp.ContentLength, r.start, r.end)
+	}
+	return nil
+}
+
+// serveRanges - answers a request for several ranges of the object described by
+// head, the response to a HEAD of req, along with the headers in header.  The ranges
+// are fetched from S3 one by one, in parallel, and sent as a multipart/byteranges
+// body, or as a plain 206 if they merged into one.  It returns the number of body bytes written, whether the response
+// header was, and an error if the response failed or was cut short.
+func (a *App) serveRanges(w http.ResponseWriter, r *http.Request, rc *runtimeConfig, req objectRequest,
+	head *http.Response, header http.Header, logger *zerolog.Logger) (written int64, started bool, err error) {
+	size := head.ContentLength
+	specs, err := parseRanges(r.Header.Get("Range"))
+	if err != nil || !ifRangeMatches(r.Header.Get("If-Range"), head) {
+		// an invalid Range is ignored, as is one whose If-Range doesn't hold
+		specs = []rangeSpec{{first: 0, last: -1}}
+	}
+	ranges := resolveRanges(specs, size)
+	if len(ranges) == 0 {
+		if size == 0 && specs[0] == (rangeSpec{first: 0, last: -1}) {
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+			return 0, true, nil
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return 0, true, nil
+	}
+	req = partsRequest(req, head)
+	if len(ranges) == 1 && rc.conf.ParallelDownload.covers(ranges[0].length()) {
+		return a.serveParallel(w, r.Context(), rc, req, head, header, ranges[0], size, nil, logger)
+	}
+	if len(ranges) == 1 {
+		// a single GET can't mix versions, and stays cacheable without conditions
+		req.IfMatch = ""
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	results, done := fetchRanges(ctx, rc.objectBackend(), req, ranges, size, rc.conf.MultiRange.Parallel, logger)
+	next := 0 // the first range whose result wasn't taken
+	defer func() {
+		// close whatever is fetched but won't be sent; every range gets a result
+		cancel()
+		go func(pending []chan partResult) {
+			for _, ch := range pending {
+				if res := <-ch; res.resp != nil {
+					res.resp.Body.Close()
+				}
+			}
+		}(results[next:])
+	}()
+
+	// S3 answering the first range decides the status
+	first := <-results[0]
+	if err := checkPart(first, ranges[0], size); err != nil {
+		next = 1
+		return 0, false, err
+	}
+	results[0] <- first
+
+	if len(ranges) == 1 {
+		writeRangeHeader(w, head, header, ranges[0], size)
+		res := <-results[0]
+		next = 1
+		defer res.resp.Body.Close()
+		done()
+		written, err = io.Copy(w, res.resp.Body)
+		return written, true, err
+	}
+
+	a.countMetric("s3-helper:multirange", req.Bucket)
+	copyObjectHeaders(w, header)
+	contentType := head.Header.Get("Content-Type")
+	boundary := newBoundary()
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header().Set("Content-Length", strconv.FormatInt(multipartSize(boundary, contentType, ranges, size), 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	cw := new(countingWriter)
+	mw := multipart.NewWriter(io.MultiWriter(w, cw))
+	mw.SetBoundary(boundary)
+	for i, rng := range ranges {
+		res := <-results[i]
+		next = i + 1
+		if err := checkPart(res, rng, size); err != nil {
+			return int64(*cw), true, err
+		}
+		part, err := mw.CreatePart(partHeader(contentType, rng, size))
+		if err == nil {
+			_, err = io.Copy(part, res.resp.Body)
+		}
+		res.resp.Body.Close()
+		done()
+		if err != nil {
+			return int64(*cw), true, err
+		}
+	}
+	err = mw.Close()
+	return int64(*cw), true, err
+}
+
+// partsRequest - req, changed to get ranges of the object described by head.  The
+// parts must be of that object, whatever happens to it meanwhile.
+func partsRequest(req objectRequest, head *http.Response) objectRequest {
+	req.Method = "GET"
+	req.Range = ""
+	req.IfMatch = head.Header.Get("ETag")
+	req.IfNoneMatch, req.IfRange = "", ""
+	req.IfModifiedSince, req.IfUnmodifiedSince = time.Time{}, time.Time{}
+	return req
+}
+
+// copyObjectHeaders - sets the headers of header on w, those the headers section
+// lets through from the HEAD and adds to them
+func copyObjectHeaders(w http.ResponseWriter, header http.Header) {
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+}
+
+// writeRangeHeader - writes the header of a response holding rng of the object
+// described by head, a 200 if rng is the whole object and a 206 otherwise
+func writeRangeHeader(w http.ResponseWriter, head *http.Response, header http.Header, rng byteRange, size int64) {
+	copyObjectHeaders(w, header)
+	if contentType := head.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(rng.length(), 10))
+	if rng.length() == size {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Range", rng.contentRange(size))
+	w.WriteHeader(http.StatusPartialContent)
+}
+
+// ifRangeMatches - whether the If-Range condition ifRange holds for the object
+// described by head; an empty one always holds
+func ifRangeMatches(ifRange string, head *http.Response) bool {
+	if ifRange == "" {
+		return true
+	}
+	if t, err := http.ParseTime(ifRange); err == nil {
+		modified, err := http.ParseTime(head.Header.Get("Last-Modified"))
+		return err == nil && modified.Equal(t)
+	}
+	// a strong comparison, weak tags never match
+	etag := head.Header.Get("ETag")
+	return !strings.HasPrefix(ifRange, "W/") && etag != "" && strings.Trim(ifRange, `"`) == strings.Trim(etag, `"`)
+}
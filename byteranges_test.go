@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseAndResolveRanges(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   []byteRange
+	}{
+		{"bytes=0-9,20-29", []byteRange{{0, 9}, {20, 29}}},
+		{"bytes=20-29, 0-9", []byteRange{{0, 9}, {20, 29}}},
+		{"bytes=0-9,5-14", []byteRange{{0, 14}}},
+		{"bytes=0-9,10-19", []byteRange{{0, 19}}},
+		{"bytes=90-,-5", []byteRange{{90, 99}}},
+		{"bytes=-200,0-0", []byteRange{{0, 99}}},
+		{"bytes=0-0,50-1000", []byteRange{{0, 0}, {50, 99}}},
+		{"bytes=100-,200-300", nil},
+		{"bytes=-0,5-5", []byteRange{{5, 5}}},
+	} {
+		specs, err := parseRanges(tc.header)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.header, err)
+		}
+		if got := resolveRanges(specs, 100); !(len(got) == 0 && len(tc.want) == 0) && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.header, tc.want, got)
+		}
+	}
+
+	for _, header := range []string{"items=0-9", "bytes=", "bytes=-", "bytes=9-0", "bytes=a-9", "bytes=0-9,x"} {
+		if _, err := parseRanges(header); err == nil {
+			t.Errorf("%s: expected an error", header)
+		}
+	}
+}
+
+// newMultiRangeMockApp - a mock app serving up to maxRanges ranges per request
+func newMultiRangeMockApp(t *testing.T, files map[string]interface{}, maxRanges int) (*App, *countingBackend) {
+	a := newMockApp(files)
+	withConfig(t, a, func(c *Config) { c.MultiRange = multiRangeConfig{MaxRanges: maxRanges, Parallel: 2} })
+	rc := *a.snapshot()
+	upstream := &countingBackend{s3Backend: rc.backend}
+	rc.backend, rc.objects = upstream, upstream
+	a.setSnapshot(&rc)
+	return a, upstream
+}
+
+func TestProxyS3Media_MultiRange(t *testing.T) {
+	content := "0123456789abcdefghij"
+	a, upstream := newMultiRangeMockApp(t, map[string]interface{}{"svod/show/seg.mp4": []byte(content)}, 4)
+
+	w := serveMock(a, "GET", "/show/seg.mp4", http.Header{"Range": {"bytes=10-12,0-3,-2"}})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d %q", w.Code, w.Body.String())
+	}
+	if n, _ := strconv.Atoi(w.Header().Get("Content-Length")); n != w.Body.Len() {
+		t.Fatalf("Content-Length %s, but %d bytes sent", w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("unexpected Content-Type %q", w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range []struct{ contentRange, body string }{
+		{"bytes 0-3/20", "0123"},
+		{"bytes 10-12/20", "abc"},
+		{"bytes 18-19/20", "ij"},
+	} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if part.Header.Get("Content-Range") != want.contentRange || string(body) != want.body {
+			t.Fatalf("expected %s %q, got %s %q", want.contentRange, want.body, part.Header.Get("Content-Range"), body)
+		}
+	}
+	if _, err := mr.NextPart(); err == nil {
+		t.Fatalf("unexpected extra part")
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 4 {
+		t.Fatalf("expected a HEAD and 3 ranges from S3, got %d requests", n)
+	}
+
+	// overlapping ranges merge into a single part
+	w = serveMock(a, "GET", "/show/seg.mp4", http.Header{"Range": {"bytes=0-3,2-5"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "012345" || w.Header().Get("Content-Range") != "bytes 0-5/20" {
+		t.Fatalf("overlap: unexpected %d %q %q", w.Code, w.Body.String(), w.Header().Get("Content-Range"))
+	}
+
+	w = serveMock(a, "GET", "/show/seg.mp4", http.Header{"Range": {"bytes=30-40,50-"}})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "bytes */20" {
+		t.Fatalf("unsatisfiable: unexpected %d %q", w.Code, w.Header().Get("Content-Range"))
+	}
+
+	// the object changed since the client got its first part
+	w = serveMock(a, "GET", "/show/seg.mp4", http.Header{"Range": {"bytes=0-1,5-6"}, "If-Range": {`"old"`}})
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("If-Range: unexpected %d %q", w.Code, w.Body.String())
+	}
+
+	if w := serveMock(a, "GET", "/show/missing.mp4", http.Header{"Range": {"bytes=0-1,5-6"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("missing: expected 404, got %d", w.Code)
+	}
+}
+
+func TestProxyS3Media_MultiRangeDisabled(t *testing.T) {
+	a, upstream := newMultiRangeMockApp(t, map[string]interface{}{"svod/show/seg.mp4": []byte("0123456789")}, 1)
+
+	// more ranges than max_ranges are left to S3
+	serveMock(a, "GET", "/show/seg.mp4", http.Header{"Range": {"bytes=0-1,5-6"}})
+	if n := atomic.LoadInt32(&upstream.fetches); n != 1 {
+		t.Fatalf("expected the request to be passed through, got %d requests", n)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crunchyroll/evs-s3helper/diskcache"
+	"github.com/rs/zerolog"
+)
+
+// Values of the X-Cache header
+const (
+	cacheHit  = "HIT"
+	cacheMiss = "MISS"
+)
+
+// Headers of an S3 response that are kept with a cached body
+var cachedHeaders = []string{
+	"Accept-Ranges",
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+	"x-amz-version-id",
+}
+
+// Prefix of the user metadata headers, kept with a cached body too
+const metadataPrefix = "X-Amz-Meta-"
+
+// openCache - the disk cache configured in c, nil if it is disabled
+func openCache(c *cacheConfig) (*diskcache.Cache, error) {
+	if c.Dir == "" {
+		return nil, nil
+	}
+	if c.MaxSizeMB <= 0 {
+		return nil, fmt.Errorf("cache.max_size_mb must be positive")
+	}
+	return diskcache.Open(c.Dir, c.MaxSizeMB<<20)
+}
+
+// cachingBackend - serves GETs of hot objects (manifests, init segments) from the
+// disk cache and fetches the rest through next.  Entries are keyed by bucket, key,
+// range and version.  Fresh entries are served as they are, stale ones are
+// revalidated with a conditional request, and misses are written to the cache
+// while they stream to the client.
+type cachingBackend struct {
+	next          s3Backend
+	cache         *diskcache.Cache
+	ttl           time.Duration
+	maxObjectSize int64
+	app           *App
+}
+
+func cacheKey(req *objectRequest) string {
+	if req.Version != "" {
+		return req.Bucket + "\x00" + req.Key + "\x00" + req.Range + "\x00" + req.Version
+	}
+	return req.Bucket + "\x00" + req.Key + "\x00" + req.Range
+}
+
+func (b *cachingBackend) Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	if req.SSECustomer != nil {
+		// SSE-C objects don't get written to disk decrypted
+		return b.next.Fetch(ctx, req, logger)
+	}
+	if req.conditional() {
+		// the client's own conditions are left to S3, a cached copy can't be
+		// checked against If-Range or answer with a 304 or 412
+		b.app.cacheResult(req.Bucket, cacheMiss)
+		return b.forward(ctx, req, logger)
+	}
+	key := cacheKey(req)
+	meta, body, ok := b.cache.Get(key)
+	if ok && time.Since(meta.Stored) < b.ttl {
+		b.app.cacheResult(req.Bucket, cacheHit)
+		return cachedResponse(req, &meta, body), nil
+	}
+	if req.Method != "GET" {
+		// HEADs of objects not cached are not worth caching themselves
+		if ok {
+			body.Close()
+		}
+		b.app.cacheResult(req.Bucket, cacheMiss)
+		return b.forward(ctx, req, logger)
+	}
+
+	upstream := *req
+	if ok {
+		upstream.IfNoneMatch = meta.Header.Get("ETag")
+		upstream.IfModifiedSince, _ = http.ParseTime(meta.Header.Get("Last-Modified"))
+		if upstream.IfNoneMatch == "" && upstream.IfModifiedSince.IsZero() {
+			// nothing to revalidate with
+			body.Close()
+			ok = false
+		}
+	}
+
+	resp, err := b.next.Fetch(ctx, &upstream, logger)
+	if ok && (err != nil || resp.StatusCode != http.StatusNotModified) {
+		body.Close()
+	}
+	if err != nil {
+		if objectGone(errorStatus(err)) {
+			b.cache.Remove(key)
+		}
+		return nil, err
+	}
+
+	switch {
+	case ok && resp.StatusCode == http.StatusNotModified:
+		resp.Body.Close()
+		if err := b.cache.Refresh(key, time.Now()); err != nil {
+			logger.Warn().Str("error", err.Error()).Msg("cache: failed to refresh entry")
+		}
+		b.app.cacheResult(req.Bucket, cacheHit)
+		return cachedResponse(req, &meta, body), nil
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent:
+		b.app.cacheResult(req.Bucket, cacheMiss)
+		b.store(key, resp, logger)
+	default:
+		if objectGone(resp.StatusCode) {
+			b.cache.Remove(key)
+		}
+		b.app.cacheResult(req.Bucket, cacheMiss)
+	}
+	resp.Header.Set("X-Cache", cacheMiss)
+	return resp, nil
+}
+
+// objectGone - whether S3 answering status means a cached copy must not be served any more
+func objectGone(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusForbidden || status == http.StatusGone
+}
+
+// forward - fetches req through next, uncached
+func (b *cachingBackend) forward(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	resp, err := b.next.Fetch(ctx, req, logger)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("X-Cache", cacheMiss)
+	return resp, nil
+}
+
+// store - makes the body of resp be written to the cache as it is read, if it is
+// cacheable
+func (b *cachingBackend) store(key string, resp *http.Response, logger *zerolog.Logger) {
+	if resp.ContentLength < 0 || resp.ContentLength > b.maxObjectSize {
+		return
+	}
+	if strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return
+	}
+
+	meta := diskcache.Meta{
+		Key:    key,
+		Status: resp.StatusCode,
+		Header: make(http.Header),
+		Size:   resp.ContentLength,
+		Stored: time.Now(),
+	}
+	for _, name := range cachedHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			meta.Header.Set(name, v)
+		}
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, metadataPrefix) && len(values) > 0 {
+			meta.Header.Set(name, values[0])
+		}
+	}
+	w, err := b.cache.NewWriter(meta)
+	if err != nil {
+		logger.Warn().Str("error", err.Error()).Msg("cache: failed to create entry")
+		return
+	}
+	resp.Body = &teeToCache{body: resp.Body, w: w, logger: logger}
+}
+
+// cachedResponse - a response for req served from a cache entry
+func cachedResponse(req *objectRequest, meta *diskcache.Meta, body io.ReadCloser) *http.Response {
+	resp := &http.Response{
+		StatusCode:    meta.Status,
+		Status:        fmt.Sprintf("%d %s", meta.Status, http.StatusText(meta.Status)),
+		Header:        meta.Header.Clone(),
+		ContentLength: meta.Size,
+		Body:          body,
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", meta.Size))
+	resp.Header.Set("X-Cache", cacheHit)
+	if req.Method == "HEAD" {
+		body.Close()
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+// teeToCache - writes the body to a cache entry while it streams to the client.  The
+// entry is committed once the whole body went through, and dropped if the client
+// goes away or S3 fails before that.
+type teeToCache struct {
+	body   io.ReadCloser
+	w      *diskcache.Writer
+	logger *zerolog.Logger
+	done   bool
+}
+
+func (t *teeToCache) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	if n > 0 && !t.done {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			t.logger.Warn().Str("error", werr.Error()).Msg("cache: failed to write entry")
+			t.w.Abort()
+			t.done = true
+		}
+	}
+	if err == io.EOF && !t.done {
+		if cerr := t.w.Commit(); cerr != nil {
+			t.logger.Warn().Str("error", cerr.Error()).Msg("cache: failed to commit entry")
+		}
+		t.done = true
+	}
+	return n, err
+}
+
+func (t *teeToCache) Close() error {
+	if !t.done {
+		t.w.Abort()
+		t.done = true
+	}
+	return t.body.Close()
+}
+
+// cacheResult - counts a cache hit or miss for bucket
+func (a *App) cacheResult(bucket, result string) {
+	a.countMetric("s3-helper:cache"+strings.ToLower(result), bucket)
+	a.metrics.cacheResult(bucket, result)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crunchyroll/evs-s3helper/diskcache"
+	"github.com/rs/zerolog"
+)
+
+// countingBackend - counts the requests that reach S3
+type countingBackend struct {
+	s3Backend
+	fetches     int32
+	conditional int32
+}
+
+func (b *countingBackend) Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	atomic.AddInt32(&b.fetches, 1)
+	if req.IfNoneMatch != "" {
+		atomic.AddInt32(&b.conditional, 1)
+	}
+	return b.s3Backend.Fetch(ctx, req, logger)
+}
+
+// newCachingMockApp - a mock app with the disk cache in front of its backend
+func newCachingMockApp(t *testing.T, files map[string]interface{}, ttl time.Duration) (*App, *countingBackend) {
+	a := newMockApp(files)
+	cache, err := diskcache.Open(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.cache = cache
+	a.metrics = newAppMetrics(nil, cache)
+
+	rc := *a.snapshot()
+	upstream := &countingBackend{s3Backend: rc.backend}
+	rc.backend = upstream
+	rc.objects = &cachingBackend{next: upstream, cache: cache, ttl: ttl, maxObjectSize: 1 << 10, app: a}
+	a.setSnapshot(&rc)
+	return a, upstream
+}
+
+func TestCache_HitAndMiss(t *testing.T) {
+	a, upstream := newCachingMockApp(t, map[string]interface{}{
+		"svod/show/manifest.json": []byte(`{"segments":10}`),
+	}, time.Minute)
+
+	for i, want := range []string{"MISS", "HIT", "HIT"} {
+		w := serveMock(a, "GET", "/show/manifest.json", nil)
+		if w.Code != http.StatusOK || w.Body.String() != `{"segments":10}` || w.Header().Get("X-Cache") != want {
+			t.Fatalf("GET %d: expected %s, got %d %q %q", i, want, w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+		}
+	}
+	if w := serveMock(a, "HEAD", "/show/manifest.json", nil); w.Header().Get("X-Cache") != "HIT" || w.Body.Len() != 0 {
+		t.Fatalf("HEAD: expected a bodiless hit, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+
+	// ranges are cached apart from the whole object
+	w := serveMock(a, "GET", "/show/manifest.json", http.Header{"Range": {"bytes=1-10"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != `"segments"` || w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("range: unexpected %d %q %q", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	w = serveMock(a, "GET", "/show/manifest.json", http.Header{"Range": {"bytes=1-10"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != `"segments"` || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("range: unexpected %d %q %q", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+
+	if n := atomic.LoadInt32(&upstream.fetches); n != 2 {
+		t.Fatalf("expected 2 requests to reach S3, got %d", n)
+	}
+	if body := serveAdmin(a, "/metrics").Body.String(); !strings.Contains(body, "\ns3helper_cache_hit_ratio 0.6666666666666666\n") {
+		t.Fatalf("unexpected hit ratio in:\n%s", body)
+	}
+}
+
+func TestCache_Revalidation(t *testing.T) {
+	files := map[string]interface{}{"svod/show/manifest.json": []byte(`{"segments":10}`)}
+	a, upstream := newCachingMockApp(t, files, time.Nanosecond)
+
+	serveMock(a, "GET", "/show/manifest.json", nil)
+	w := serveMock(a, "GET", "/show/manifest.json", nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"segments":10}` || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("revalidated: unexpected %d %q %q", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if n := atomic.LoadInt32(&upstream.conditional); n != 1 {
+		t.Fatalf("expected a conditional request, got %d", n)
+	}
+
+	// once the object is gone so is the entry
+	delete(files, "svod/show/manifest.json")
+	if w := serveMock(a, "GET", "/show/manifest.json", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if entries, _ := a.cache.Stats(); entries != 0 {
+		t.Fatalf("expected the entry to be dropped, %d left", entries)
+	}
+}
+
+func TestCache_ClientConditions(t *testing.T) {
+	a, upstream := newCachingMockApp(t, map[string]interface{}{
+		"svod/show/manifest.json": []byte(`{"segments":10}`),
+	}, time.Minute)
+
+	etag := serveMock(a, "GET", "/show/manifest.json", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if w := serveMock(a, "GET", "/show/manifest.json", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Fatalf("If-None-Match: expected 304, got %d %q", w.Code, w.Header().Get("X-Cache"))
+	}
+	if w := serveMock(a, "GET", "/show/manifest.json", http.Header{"If-Match": {`"other"`}}); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match: expected 412, got %d", w.Code)
+	}
+
+	// a cached range isn't served once its validator no longer matches
+	serveMock(a, "GET", "/show/manifest.json", http.Header{"Range": {"bytes=1-10"}})
+	w := serveMock(a, "GET", "/show/manifest.json", http.Header{"Range": {"bytes=1-10"}, "If-Range": {`"other"`}})
+	if w.Code != http.StatusOK || w.Body.String() != `{"segments":10}` {
+		t.Fatalf("If-Range: expected the whole object, got %d %q", w.Code, w.Body.String())
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 5 {
+		t.Fatalf("expected 5 requests to reach S3, got %d", n)
+	}
+}
+
+func TestCache_TooLarge(t *testing.T) {
+	big := make([]byte, 2<<10)
+	a, upstream := newCachingMockApp(t, map[string]interface{}{"svod/big.ts": big}, time.Minute)
+	serveMock(a, "GET", "/big.ts", nil)
+	if w := serveMock(a, "GET", "/big.ts", nil); w.Header().Get("X-Cache") != "MISS" || w.Body.Len() != len(big) {
+		t.Fatalf("expected an uncached object, got %q", w.Header().Get("X-Cache"))
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 2 {
+		t.Fatalf("expected 2 requests to reach S3, got %d", n)
+	}
+}
+
+func TestCacheKey_Version(t *testing.T) {
+	latest := objectRequest{Bucket: "svod", Key: "/show/manifest.json"}
+	pinned := latest
+	pinned.Version = "v1"
+	if cacheKey(&latest) == cacheKey(&pinned) {
+		t.Fatalf("versions share a cache key")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// coalescingBackend - merges concurrent identical requests into a single flight to
+// S3, whose response fans out to every waiting client.  When a new episode launches
+// hundreds of clients ask for the same segment at once; without this each of them
+// would reach S3 and trigger SlowDowns.
+//
+// The upstream request runs detached from the client that started it, so it goes on
+// for the others if that client disconnects, and is only cancelled once every
+// client has gone.  The part of the body not yet read by every client is buffered,
+// up to maxBuffer bytes; beyond that S3 is read no faster than the slowest client.
+type coalescingBackend struct {
+	next      s3Backend
+	maxBuffer int
+	app       *App
+
+	mu      sync.Mutex
+	flights map[objectRequest]*flight
+}
+
+func newCoalescingBackend(next s3Backend, maxBuffer int, a *App) *coalescingBackend {
+	return &coalescingBackend{
+		next:      next,
+		maxBuffer: maxBuffer,
+		app:       a,
+		flights:   make(map[objectRequest]*flight),
+	}
+}
+
+// flight - one upstream request and the clients sharing it
+type flight struct {
+	b      *coalescingBackend
+	req    objectRequest
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	ready chan struct{} // closed once resp or err is set
+	resp  *http.Response
+	err   error
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      []byte // the body from offset base on
+	base     int64
+	eof      bool
+	readErr  error
+	readers  map[*flightReader]bool
+	joinable bool // false once the start of the body was dropped or the flight ended
+}
+
+func (b *coalescingBackend) Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	f, r, leader := b.join(req)
+	if leader {
+		go f.run(logger)
+	} else {
+		b.app.requestCoalesced(req.Bucket)
+		logger.Debug().Msg("Coalesced with a request in flight")
+	}
+
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		r.Close()
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		r.Close()
+		return nil, f.err
+	}
+
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Body = r
+	return &resp, nil
+}
+
+// join - subscribes to the flight for req, starting one if there is none to join.
+// It reports whether the caller has to run the new flight.
+func (b *coalescingBackend) join(req *objectRequest) (*flight, *flightReader, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if f, ok := b.flights[*req]; ok {
+		if r := f.subscribe(); r != nil {
+			return f, r, false
+		}
+	}
+
+	f := &flight{
+		b:        b,
+		req:      *req,
+		ready:    make(chan struct{}),
+		readers:  make(map[*flightReader]bool),
+		joinable: true,
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.cond = sync.NewCond(&f.mu)
+	b.flights[*req] = f
+	return f, f.subscribe(), true
+}
+
+// forget - stops new requests from joining f
+func (b *coalescingBackend) forget(f *flight) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.flights[f.req] == f {
+		delete(b.flights, f.req)
+	}
+}
+
+func (f *flight) subscribe() *flightReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.joinable {
+		return nil
+	}
+	r := &flightReader{f: f}
+	f.readers[r] = true
+	return r
+}
+
+// run - fetches the object and feeds its body to the readers
+func (f *flight) run(logger *zerolog.Logger) {
+	defer f.cancel()
+	defer f.b.forget(f)
+
+	resp, err := f.b.next.Fetch(f.ctx, &f.req, logger)
+	f.resp, f.err = resp, err
+	close(f.ready)
+	if err != nil {
+		f.end(nil)
+		return
+	}
+	defer resp.Body.Close()
+
+	chunk := make([]byte, 32*1024)
+	for {
+		if !f.waitForRoom() {
+			return // everyone left
+		}
+		n, err := resp.Body.Read(chunk)
+
+		f.mu.Lock()
+		f.buf = append(f.buf, chunk[:n]...)
+		f.cond.Broadcast()
+		f.mu.Unlock()
+
+		if err == io.EOF {
+			f.end(nil)
+			return
+		}
+		if err != nil {
+			f.end(err)
+			return
+		}
+	}
+}
+
+// waitForRoom - blocks until the buffer has room for another chunk, dropping what
+// every reader is done with.  It returns false if no reader is left.
+func (f *flight) waitForRoom() bool {
+	f.mu.Lock()
+	dropped := false
+	for len(f.readers) > 0 {
+		min := f.base + int64(len(f.buf))
+		for r := range f.readers {
+			if r.off < min {
+				min = r.off
+			}
+		}
+		if drop := int(min - f.base); drop > 0 {
+			f.buf = append(f.buf[:0:0], f.buf[drop:]...)
+			f.base = min
+			if f.joinable {
+				// late comers would miss the start of the body
+				f.joinable = false
+				dropped = true
+			}
+		}
+		if len(f.buf) < f.b.maxBuffer {
+			break
+		}
+		f.cond.Wait()
+	}
+	left := len(f.readers) > 0
+	f.mu.Unlock()
+
+	if dropped {
+		f.b.forget(f)
+	}
+	return left
+}
+
+// end - marks the body as complete, or failed with err
+func (f *flight) end(err error) {
+	f.mu.Lock()
+	f.eof, f.readErr, f.joinable = true, err, false
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// flightReader - one client's view of the body of a flight
+type flightReader struct {
+	f      *flight
+	off    int64
+	closed bool
+}
+
+var errReadAfterClose = errors.New("read after close")
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		if r.closed {
+			return 0, errReadAfterClose
+		}
+		if avail := f.base + int64(len(f.buf)) - r.off; avail > 0 {
+			n := copy(p, f.buf[r.off-f.base:])
+			r.off += int64(n)
+			f.cond.Broadcast() // the producer may be waiting for room
+			return n, nil
+		}
+		if f.eof {
+			if f.readErr != nil {
+				return 0, f.readErr
+			}
+			return 0, io.EOF
+		}
+		f.cond.Wait()
+	}
+}
+
+// Close - leaves the flight, which is cancelled if nobody is left
+func (r *flightReader) Close() error {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	delete(f.readers, r)
+	if len(f.readers) == 0 && !f.eof {
+		f.joinable = false
+		f.cancel()
+	}
+	f.cond.Broadcast()
+	return nil
+}
+
+// requestCoalesced - counts a request that joined a flight under way
+func (a *App) requestCoalesced(bucket string) {
+	a.countMetric("s3-helper:coalesced", bucket)
+	a.metrics.requestCoalesced(bucket)
+}
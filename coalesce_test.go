@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// gatedBackend - an upstream whose responses wait for release, with a body of
+// size bytes streamed through a pipe
+type gatedBackend struct {
+	size    int
+	release chan struct{}
+	fetches int32
+
+	mu   sync.Mutex
+	ctxs []context.Context // of the requests released
+}
+
+func newGatedBackend(size int) *gatedBackend {
+	return &gatedBackend{size: size, release: make(chan struct{})}
+}
+
+func (b *gatedBackend) Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	atomic.AddInt32(&b.fetches, 1)
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	pr, pw := io.Pipe()
+	b.mu.Lock()
+	b.ctxs = append(b.ctxs, ctx)
+	b.mu.Unlock()
+	go func() {
+		pw.Write(bytes.Repeat([]byte("x"), b.size))
+		pw.Close()
+	}()
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Etag": []string{`"abc"`}},
+		ContentLength: int64(b.size),
+		Body:          pr,
+	}, nil
+}
+
+func fetchAll(t *testing.T, b s3Backend, ctx context.Context, req *objectRequest) (string, error) {
+	t.Helper()
+	resp, err := b.Fetch(ctx, req, &log.Logger)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("ETag") != `"abc"` {
+		t.Errorf("headers were not shared: %v", resp.Header)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// waitReaders - waits until n clients are subscribed to the flight for req
+func waitReaders(t *testing.T, b *coalescingBackend, req *objectRequest, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		b.mu.Lock()
+		f := b.flights[*req]
+		b.mu.Unlock()
+		if f != nil {
+			f.mu.Lock()
+			got := len(f.readers)
+			f.mu.Unlock()
+			if got >= n {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients on the flight", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesce_SharesOneUpstreamRequest(t *testing.T) {
+	upstream := newGatedBackend(200 * 1024)
+	b := newCoalescingBackend(upstream, 64*1024, newMockApp(nil))
+	req := &objectRequest{Method: "GET", Bucket: "svod", Key: "/show/seg1.ts"}
+
+	const clients = 10
+	var wg sync.WaitGroup
+	bodies := make([]string, clients)
+	errs := make([]error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i], errs[i] = fetchAll(t, b, context.Background(), req)
+		}(i)
+	}
+	waitReaders(t, b, req, clients)
+	close(upstream.release)
+	wg.Wait()
+
+	for i := range bodies {
+		if errs[i] != nil || len(bodies[i]) != upstream.size {
+			t.Fatalf("client %d: got %d bytes, %v", i, len(bodies[i]), errs[i])
+		}
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 1 {
+		t.Fatalf("expected one upstream request, got %d", n)
+	}
+
+	// the flight is over, the next request goes upstream again
+	if _, err := fetchAll(t, b, context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 2 {
+		t.Fatalf("expected a second upstream request, got %d", n)
+	}
+}
+
+func TestCoalesce_DistinctRequests(t *testing.T) {
+	upstream := newGatedBackend(10)
+	close(upstream.release)
+	b := newCoalescingBackend(upstream, 1024, newMockApp(nil))
+
+	for _, req := range []*objectRequest{
+		{Method: "GET", Bucket: "svod", Key: "/a.ts"},
+		{Method: "GET", Bucket: "svod", Key: "/a.ts", Range: "bytes=0-4"},
+		{Method: "HEAD", Bucket: "svod", Key: "/a.ts"},
+		{Method: "GET", Bucket: "avod", Key: "/a.ts"},
+	} {
+		if _, err := fetchAll(t, b, context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 4 {
+		t.Fatalf("expected 4 upstream requests, got %d", n)
+	}
+}
+
+func TestCoalesce_LeaderDisconnects(t *testing.T) {
+	upstream := newGatedBackend(100 * 1024)
+	b := newCoalescingBackend(upstream, 1024*1024, newMockApp(nil))
+	req := &objectRequest{Method: "GET", Bucket: "svod", Key: "/show/seg1.ts"}
+
+	leaderCtx, leaderGone := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := fetchAll(t, b, leaderCtx, req)
+		leaderErr <- err
+	}()
+	waitReaders(t, b, req, 1)
+
+	followerBody := make(chan string, 1)
+	go func() {
+		body, err := fetchAll(t, b, context.Background(), req)
+		if err != nil {
+			t.Error(err)
+		}
+		followerBody <- body
+	}()
+	waitReaders(t, b, req, 2)
+
+	leaderGone()
+	if err := <-leaderErr; err != context.Canceled {
+		t.Fatalf("expected the leader to be canceled, got %v", err)
+	}
+	close(upstream.release)
+	if body := <-followerBody; len(body) != upstream.size {
+		t.Fatalf("follower got %d bytes, expected %d", len(body), upstream.size)
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 1 {
+		t.Fatalf("expected one upstream request, got %d", n)
+	}
+}
+
+func TestCoalesce_EveryoneDisconnects(t *testing.T) {
+	upstream := newGatedBackend(1024 * 1024)
+	close(upstream.release)
+	b := newCoalescingBackend(upstream, 64*1024, newMockApp(nil))
+	req := &objectRequest{Method: "GET", Bucket: "svod", Key: "/show/seg1.ts"}
+
+	resp, err := b.Fetch(context.Background(), req, &log.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 10))
+	resp.Body.Close()
+
+	upstream.mu.Lock()
+	ctx := upstream.ctxs[0]
+	upstream.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not canceled")
+	}
+}
+
+func TestCoalesce_BoundedBuffer(t *testing.T) {
+	const maxBuffer = 64 * 1024
+	upstream := newGatedBackend(1024 * 1024)
+	b := newCoalescingBackend(upstream, maxBuffer, newMockApp(nil))
+	req := &objectRequest{Method: "GET", Bucket: "svod", Key: "/show/seg1.ts"}
+
+	var slow, fast *http.Response
+	var wg sync.WaitGroup
+	for _, resp := range []**http.Response{&slow, &fast} {
+		wg.Add(1)
+		go func(resp **http.Response) {
+			defer wg.Done()
+			var err error
+			if *resp, err = b.Fetch(context.Background(), req, &log.Logger); err != nil {
+				t.Error(err)
+			}
+		}(resp)
+	}
+	waitReaders(t, b, req, 2)
+	close(upstream.release)
+	wg.Wait()
+	if slow == nil || fast == nil {
+		t.FailNow()
+	}
+	defer slow.Body.Close()
+
+	// the fast client can't get further ahead of the slow one than the buffer
+	got := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, fast.Body)
+		got <- n
+	}()
+	select {
+	case n := <-got:
+		t.Fatalf("the fast client read %d bytes while the slow one read none", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	f := slow.Body.(*flightReader).f
+	f.mu.Lock()
+	buffered := len(f.buf)
+	f.mu.Unlock()
+	if buffered > maxBuffer+32*1024 {
+		t.Fatalf("%d bytes buffered, expected at most about %d", buffered, maxBuffer)
+	}
+
+	n, err := io.Copy(ioutil.Discard, slow.Body)
+	if err != nil || n != int64(upstream.size) {
+		t.Fatalf("slow client got %d bytes, %v", n, err)
+	}
+	if n := <-got; n != int64(upstream.size) {
+		t.Fatalf("fast client got %d bytes", n)
+	}
+}
+
+func TestCoalesce_SharedError(t *testing.T) {
+	a := newMockApp(map[string]interface{}{})
+	rc := *a.snapshot()
+	rc.objects = newCoalescingBackend(rc.backend, 1024, a)
+	a.setSnapshot(&rc)
+
+	w := serveMock(a, "GET", "/show/missing.ts", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected a 404, got %d %q", w.Code, w.Body.String())
+	}
+}
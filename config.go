@@ -1,8 +1,10 @@
 package main
 
+import "time"
+
 type nrConfig struct {
 	Name    string `yaml:"name"`
-	License string `yaml:"license"`
+	License string `yaml:"license" secret:"true"`
 }
 
 type logConfig struct {
@@ -10,24 +12,297 @@ type logConfig struct {
 	Level string `yaml:"level"`
 }
 
+// transportConfig - tuning for the shared connection pool used to talk to S3
+type transportConfig struct {
+	KeepAlive             time.Duration `yaml:"keep_alive" optional:"true"`
+	DisableKeepAlives     bool          `yaml:"disable_keep_alives" optional:"true"`
+	MaxIdleConns          int           `yaml:"max_idle_conns" optional:"true"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host" optional:"true"`
+	MaxConnsPerHost       int           `yaml:"max_conns_per_host" optional:"true"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout" optional:"true"`
+	DialTimeout           time.Duration `yaml:"dial_timeout" optional:"true"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout" optional:"true"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout" optional:"true"`
+	StatsInterval         time.Duration `yaml:"stats_interval" optional:"true"`
+}
+
+// endpointConfig - how the S3 endpoint for a bucket is addressed
+type endpointConfig struct {
+	Scheme          string `yaml:"scheme" optional:"true"`           // http or https
+	AddressingStyle string `yaml:"addressing_style" optional:"true"` // path or virtual
+	DualStack       bool   `yaml:"dual_stack" optional:"true"`
+	FIPS            bool   `yaml:"fips" optional:"true"`
+	URL             string `yaml:"url" optional:"true"` // custom endpoint, e.g. MinIO or localstack
+}
+
+// routeConfig - maps a URL path prefix (and optionally a Host header) onto a bucket
+type routeConfig struct {
+	Prefix    string `yaml:"prefix"`
+	Host      string `yaml:"host" optional:"true"`
+	Bucket    string `yaml:"bucket"`
+	Region    string `yaml:"region" optional:"true"`     // defaults to s3_region
+	KeyPrefix string `yaml:"key_prefix" optional:"true"` // defaults to s3_prefix
+	Profile   string `yaml:"profile" optional:"true"`    // shared credentials profile
+
+	RoleARN    string `yaml:"role_arn" optional:"true"` // assumed with STS, signed backend only
+	ExternalID string `yaml:"external_id" optional:"true"`
+
+	Headers map[string]string `yaml:"headers" optional:"true"` // added to responses, over headers.set
+
+	Redirect bool `yaml:"redirect" optional:"true"` // answer with a 302 to a presigned URL, signed backend only
+
+	SSECustomerKey sseCustomerKeyConfig `yaml:"sse_customer_key" optional:"true"` // objects are encrypted with SSE-C
+}
+
+// sseCustomerKeyConfig - where the base64 encoded 256 bit SSE-C key of a route is read from
+type sseCustomerKeyConfig struct {
+	File string `yaml:"file" optional:"true"`
+	Env  string `yaml:"env" optional:"true"` // name of the environment variable
+}
+
+// shutdownConfig - how connections are drained on SIGTERM
+type shutdownConfig struct {
+	Delay   time.Duration `yaml:"delay" optional:"true"`   // time between going unready and closing the listener
+	Timeout time.Duration `yaml:"timeout" optional:"true"` // time in-flight requests get to finish
+}
+
+// accessConfig - which clients may fetch objects
+type accessConfig struct {
+	Allow          []string `yaml:"allow" optional:"true"`           // CIDRs or addresses, empty allows all
+	Deny           []string `yaml:"deny" optional:"true"`            // CIDRs or addresses, checked before allow
+	TrustedProxies []string `yaml:"trusted_proxies" optional:"true"` // peers whose X-Forwarded-For is believed
+	SecretHeader   string   `yaml:"secret_header" optional:"true"`
+	Secret         string   `yaml:"secret" optional:"true" secret:"true"` // required in secret_header if set
+}
+
+// cacheConfig - the disk cache in front of S3
+type cacheConfig struct {
+	Dir             string        `yaml:"dir" optional:"true"` // "" disables the cache
+	MaxSizeMB       int64         `yaml:"max_size_mb" optional:"true"`
+	MaxObjectSizeMB int64         `yaml:"max_object_size_mb" optional:"true"` // larger objects aren't cached
+	TTL             time.Duration `yaml:"ttl" optional:"true"`                // entries older than this are revalidated
+}
+
+// coalesceConfig - merging of concurrent identical requests to S3
+type coalesceConfig struct {
+	Enabled  bool `yaml:"enabled" optional:"true"`
+	BufferKB int  `yaml:"buffer_kb" optional:"true"` // body buffered for the slowest client before S3 is throttled
+}
+
+// multiRangeConfig - serving of requests for several ranges at once
+type multiRangeConfig struct {
+	MaxRanges int `yaml:"max_ranges" optional:"true"` // requests for more are passed to S3 as they are, 0 disables
+	Parallel  int `yaml:"parallel" optional:"true"`   // ranges fetched from S3 at the same time
+}
+
+// parallelDownloadConfig - fetching of large objects over several S3 connections
+type parallelDownloadConfig struct {
+	MinSizeMB   int64 `yaml:"min_size_mb" optional:"true"` // smaller bodies are fetched as usual, 0 disables
+	PartSizeMB  int64 `yaml:"part_size_mb" optional:"true"`
+	Concurrency int   `yaml:"concurrency" optional:"true"` // parts fetched or buffered at a time
+	PartRetries int   `yaml:"part_retries" optional:"true"`
+	MaxMemoryMB int64 `yaml:"max_memory_mb" optional:"true"` // buffered by all downloads together, 0 for no limit
+}
+
+// credentialsConfig - where the signed backend gets the AWS credentials it signs with
+type credentialsConfig struct {
+	Source           string        `yaml:"source" optional:"true"`            // chain, env, profile, web_identity, ecs or instance
+	Profile          string        `yaml:"profile" optional:"true"`           // for source profile
+	File             string        `yaml:"file" optional:"true"`              // shared credentials file, "" for ~/.aws/credentials
+	MetadataEndpoint string        `yaml:"metadata_endpoint" optional:"true"` // EC2 instance metadata service
+	STSEndpoint      string        `yaml:"sts_endpoint" optional:"true"`      // "" for the regional endpoint
+	RefreshBefore    time.Duration `yaml:"refresh_before" optional:"true"`    // how long before they expire credentials are refreshed
+}
+
+// cacheControlConfig - the Cache-Control sent for request paths matching Path
+type cacheControlConfig struct {
+	Path  string `yaml:"path"` // glob, matched against the last path element if it has no /
+	Value string `yaml:"value"`
+}
+
+// headersConfig - the response headers sent to clients
+type headersConfig struct {
+	Forward      []string             `yaml:"forward" optional:"true"`       // S3 headers passed on, a trailing * matches a prefix
+	Rename       map[string]string    `yaml:"rename" optional:"true"`        // S3 header -> name sent to the client
+	Set          map[string]string    `yaml:"set" optional:"true"`           // added to every response
+	CacheControl []cacheControlConfig `yaml:"cache_control" optional:"true"` // first match wins
+}
+
+// corsConfig - cross origin access for browser based players
+type corsConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins" optional:"true"` // e.g. https://*.example.com or *, empty disables
+	AllowedMethods   []string      `yaml:"allowed_methods" optional:"true"`
+	AllowedHeaders   []string      `yaml:"allowed_headers" optional:"true"` // request headers preflights may ask for, * for any
+	ExposedHeaders   []string      `yaml:"exposed_headers" optional:"true"`
+	AllowCredentials bool          `yaml:"allow_credentials" optional:"true"`
+	MaxAge           time.Duration `yaml:"max_age" optional:"true"`      // how long browsers may cache a preflight
+	CrossDomain      bool          `yaml:"cross_domain" optional:"true"` // serve crossdomain.xml and clientaccesspolicy.xml
+}
+
+// presignConfig - presigned S3 URLs clients get instead of having objects proxied
+type presignConfig struct {
+	Expires   time.Duration `yaml:"expires" optional:"true"`
+	QueryFlag string        `yaml:"query_flag" optional:"true"` // query parameter asking for a redirect, "" disables
+	Endpoint  bool          `yaml:"endpoint" optional:"true"`   // serve presigned URLs as JSON at /presign/{bucket}/{key}
+}
+
+// versioningConfig - serving of object versions other than the latest
+type versioningConfig struct {
+	AllowQuery bool                         `yaml:"allow_query" optional:"true"` // pass ?versionId= on to S3
+	Pins       map[string]map[string]string `yaml:"pins" optional:"true"`        // bucket -> key -> version served instead of the latest
+}
+
+// socketConfig - permissions of the unix sockets listened on
+type socketConfig struct {
+	Mode  string `yaml:"mode" optional:"true"`  // octal, e.g. "0660"
+	Owner string `yaml:"owner" optional:"true"` // user name or uid
+	Group string `yaml:"group" optional:"true"` // group name or gid
+}
+
+// readinessConfig - the canary objects /readyz checks
+type readinessConfig struct {
+	CanaryKeys map[string]string `yaml:"canary_keys" optional:"true"` // bucket -> key to HEAD
+	CacheTTL   time.Duration     `yaml:"cache_ttl" optional:"true"`
+	Timeout    time.Duration     `yaml:"timeout" optional:"true"`
+}
+
 // Config holds the global config
 type Config struct {
-	Listen string `yaml:"listen"`
+	Listen      string `yaml:"listen"`
+	AdminListen string `yaml:"admin_listen" optional:"true"`
+
+	UnixSocket socketConfig `yaml:"unix_socket" optional:"true"`
 
-	S3AdBucket string `yaml:"s3_ad_bucket"`
-	S3Bucket   string `yaml:"s3_bucket"`
+	S3AdBucket string `yaml:"s3_ad_bucket" optional:"true"`
+	S3Bucket   string `yaml:"s3_bucket" optional:"true"`
 	S3Path     string `yaml:"s3_prefix" optional:"true"`
 	S3Region   string `yaml:"s3_region"`
+	S3Backend  string `yaml:"s3_backend" optional:"true"`
+
+	S3Endpoint endpointConfig            `yaml:"s3_endpoint" optional:"true"`
+	S3Buckets  map[string]endpointConfig `yaml:"s3_buckets" optional:"true"`
+
+	S3Retries         int           `yaml:"s3_retries" optional:"true"`
+	S3Timeout         time.Duration `yaml:"s3_timeout" optional:"true"`
+	S3RetryBackoff    time.Duration `yaml:"s3_retry_backoff" optional:"true"`
+	S3RetryMaxBackoff time.Duration `yaml:"s3_retry_max_backoff" optional:"true"`
+
+	S3Transport transportConfig   `yaml:"s3_transport" optional:"true"`
+	Credentials credentialsConfig `yaml:"credentials" optional:"true"`
+	Cache       cacheConfig       `yaml:"cache" optional:"true"`
+	Coalesce    coalesceConfig    `yaml:"coalesce" optional:"true"`
+
+	MultiRange       multiRangeConfig       `yaml:"multi_range" optional:"true"`
+	ParallelDownload parallelDownloadConfig `yaml:"parallel_download" optional:"true"`
+
+	Headers headersConfig `yaml:"headers" optional:"true"`
+	CORS    corsConfig    `yaml:"cors" optional:"true"`
+	Presign presignConfig `yaml:"presign" optional:"true"`
+
+	Versioning versioningConfig `yaml:"versioning" optional:"true"`
+
+	// Routes replace s3_bucket/s3_ad_bucket when set
+	Routes []routeConfig `yaml:"routes" optional:"true"`
+
+	Access    accessConfig    `yaml:"access" optional:"true"`
+	Shutdown  shutdownConfig  `yaml:"shutdown" optional:"true"`
+	Readiness readinessConfig `yaml:"readiness" optional:"true"`
 
 	Concurrency int       `yaml:"concurrency" optional:"true"`
 	Logging     logConfig `yaml:"logging"`
 
+	StatsdAddr       string  `yaml:"statsd_addr" optional:"true"`
+	StatsdEnv        string  `yaml:"statsd_env" optional:"true"`
+	StatsdSampleRate float32 `yaml:"statsd_sample_rate" optional:"true"`
+
 	NewRelic nrConfig `yaml:"newrelic"`
 }
 
 const defaultConfValues = `
     listen: "127.0.0.1:8080"
+    admin_listen: ""
+    unix_socket:
+        mode: "0660"
     concurrency: 0
+    statsd_addr: ""
+    statsd_env: ""
+    statsd_sample_rate: 1
+    access:
+        allow: ["127.0.0.0/8", "::1"]
+    shutdown:
+        delay: 0s
+        timeout: 30s
+    readiness:
+        cache_ttl: 10s
+        timeout: 2s
+    s3_backend: signed
+    s3_endpoint:
+        scheme: https
+        addressing_style: path
+    s3_retries: 3
+    s3_timeout: 3s
+    s3_retry_backoff: 50ms
+    s3_retry_max_backoff: 2s
+    credentials:
+        source: chain
+        profile: default
+        file: ""
+        metadata_endpoint: "http://169.254.169.254"
+        sts_endpoint: ""
+        refresh_before: 5m
+    s3_transport:
+        keep_alive: 30s
+        disable_keep_alives: false
+        max_idle_conns: 512
+        max_idle_conns_per_host: 128
+        max_conns_per_host: 0
+        idle_conn_timeout: 90s
+        dial_timeout: 5s
+        tls_handshake_timeout: 5s
+        response_header_timeout: 0s
+        stats_interval: 10s
+    cache:
+        dir: ""
+        max_size_mb: 1024
+        max_object_size_mb: 16
+        ttl: 60s
+    coalesce:
+        enabled: false
+        buffer_kb: 1024
+    multi_range:
+        max_ranges: 16
+        parallel: 4
+    parallel_download:
+        min_size_mb: 0
+        part_size_mb: 8
+        concurrency: 4
+        part_retries: 2
+        max_memory_mb: 256
+    headers:
+        forward:
+            - Accept-Ranges
+            - Cache-Control
+            - Content-Disposition
+            - Content-Encoding
+            - Date
+            - ETag
+            - Last-Modified
+            - X-Amz-Version-Id
+            - X-Cache
+    cors:
+        allowed_origins: []
+        allowed_methods: [GET, HEAD]
+        allowed_headers: [Range, If-Match, If-None-Match, If-Modified-Since, If-Range]
+        exposed_headers: [Content-Length, Content-Range]
+        allow_credentials: false
+        max_age: 10m
+        cross_domain: false
+    presign:
+        expires: 15m
+        query_flag: ""
+        endpoint: false
+    versioning:
+        allow_query: true
     logging:
         ident: s3-helper
         level: "info"
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy - the compiled cors section, nil when it allows no origin
+type corsPolicy struct {
+	origins     []string // lower case patterns, * matches anything but a /
+	anyOrigin   bool
+	methods     []string
+	headers     []string // request headers preflights may ask for, canonical
+	anyHeader   bool
+	expose      string
+	maxAge      string // seconds, "" to leave it to the browser
+	credentials bool
+	crossDomain bool
+}
+
+// newCORSPolicy - validates and compiles the cors section, nil if it's disabled
+func newCORSPolicy(c *corsConfig) (*corsPolicy, error) {
+	if len(c.AllowedOrigins) == 0 {
+		if c.CrossDomain {
+			return nil, fmt.Errorf("cors.cross_domain needs allowed_origins")
+		}
+		return nil, nil
+	}
+
+	p := &corsPolicy{
+		expose:      strings.Join(c.ExposedHeaders, ", "),
+		credentials: c.AllowCredentials,
+		crossDomain: c.CrossDomain,
+	}
+	for _, origin := range c.AllowedOrigins {
+		origin = strings.ToLower(origin)
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		if _, err := path.Match(origin, ""); err != nil || !strings.Contains(origin, "://") {
+			return nil, fmt.Errorf("cors.allowed_origins: bad origin %q, expected e.g. https://*.example.com", origin)
+		}
+		p.origins = append(p.origins, origin)
+	}
+	for _, method := range c.AllowedMethods {
+		p.methods = append(p.methods, strings.ToUpper(method))
+	}
+	for _, name := range c.AllowedHeaders {
+		if name == "*" {
+			p.anyHeader = true
+			continue
+		}
+		p.headers = append(p.headers, http.CanonicalHeaderKey(name))
+	}
+	if c.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(c.MaxAge.Seconds()))
+	}
+	return p, nil
+}
+
+// allows - whether requests from origin may read responses
+func (p *corsPolicy) allows(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.origins {
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin - sets the headers letting the origin of r read the response, if it
+// may.  Only origins allowed by name are echoed when credentials are allowed.
+func (p *corsPolicy) allowOrigin(h http.Header, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	h.Add("Vary", "Origin")
+	if !p.allows(origin) {
+		return false
+	}
+	if p.anyOrigin && !p.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// setHeaders - sets the CORS headers of the response to a GET or HEAD
+func (p *corsPolicy) setHeaders(h http.Header, r *http.Request) {
+	if p.allowOrigin(h, r) && p.expose != "" {
+		h.Set("Access-Control-Expose-Headers", p.expose)
+	}
+}
+
+// preflight - answers an OPTIONS request.  A preflight from an allowed origin for
+// an allowed method and headers gets a 204 with the CORS headers, one that isn't
+// allowed a 403, and a plain OPTIONS a 204 listing the methods served.
+func (p *corsPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if r.Header.Get("Origin") == "" || method == "" {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	requested := splitList(r.Header.Get("Access-Control-Request-Headers"))
+	if !p.allowOrigin(h, r) || !contains(p.methods, method) || !p.allowsHeaders(requested) {
+		h.Del("Access-Control-Allow-Origin")
+		h.Del("Access-Control-Allow-Credentials")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+	if len(requested) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if p.maxAge != "" {
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowsHeaders - whether a preflight may ask for all of the request headers names
+func (p *corsPolicy) allowsHeaders(names []string) bool {
+	if p.anyHeader {
+		return true
+	}
+	for _, name := range names {
+		if !contains(p.headers, http.CanonicalHeaderKey(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList - the elements of a comma separated header value
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Paths of the policy files Flash and Silverlight players fetch before any media
+const (
+	crossDomainPath   = "/crossdomain.xml"
+	clientAccessPath  = "/clientaccesspolicy.xml"
+	crossDomainHeader = `<!DOCTYPE cross-domain-policy SYSTEM "http://www.adobe.com/xml/dtds/cross-domain-policy.dtd">` + "\n"
+)
+
+type flashPolicy struct {
+	XMLName     xml.Name `xml:"cross-domain-policy"`
+	SiteControl struct {
+		Permitted string `xml:"permitted-cross-domain-policies,attr"`
+	} `xml:"site-control"`
+	AllowAccess []flashDomain `xml:"allow-access-from"`
+	AllowHeader []flashDomain `xml:"allow-http-request-headers-from"`
+}
+
+type flashDomain struct {
+	Domain  string `xml:"domain,attr"`
+	Headers string `xml:"headers,attr,omitempty"`
+	Secure  string `xml:"secure,attr,omitempty"`
+}
+
+type silverlightPolicy struct {
+	XMLName xml.Name `xml:"access-policy"`
+	Allow   struct {
+		Headers string              `xml:"http-request-headers,attr,omitempty"`
+		Domains []silverlightDomain `xml:"domain"`
+	} `xml:"cross-domain-access>policy>allow-from"`
+	Grant struct {
+		Path     string `xml:"path,attr"`
+		Subpaths string `xml:"include-subpaths,attr"`
+	} `xml:"cross-domain-access>policy>grant-to>resource"`
+}
+
+type silverlightDomain struct {
+	URI string `xml:"uri,attr"`
+}
+
+// policyFile - the crossdomain.xml or clientaccesspolicy.xml for the allowed
+// origins, nil if urlPath is neither or they are disabled
+func (p *corsPolicy) policyFile(urlPath string) []byte {
+	if !p.crossDomain {
+		return nil
+	}
+	headers := strings.Join(p.headers, ",")
+	if p.anyHeader {
+		headers = "*"
+	}
+
+	var doc interface{}
+	prolog := xml.Header
+	switch urlPath {
+	case crossDomainPath:
+		fp := &flashPolicy{}
+		fp.SiteControl.Permitted = "master-only"
+		seen := map[flashDomain]bool{}
+		for _, origin := range p.flashOrigins() {
+			if !seen[origin] {
+				seen[origin] = true
+				fp.AllowAccess = append(fp.AllowAccess, origin)
+				if headers != "" {
+					fp.AllowHeader = append(fp.AllowHeader, flashDomain{Domain: origin.Domain, Headers: headers, Secure: origin.Secure})
+				}
+			}
+		}
+		doc, prolog = fp, xml.Header+crossDomainHeader
+	case clientAccessPath:
+		sp := &silverlightPolicy{}
+		sp.Allow.Headers = headers
+		if p.anyOrigin {
+			sp.Allow.Domains = []silverlightDomain{{URI: "*"}}
+		}
+		for _, origin := range p.origins {
+			sp.Allow.Domains = append(sp.Allow.Domains, silverlightDomain{URI: origin})
+		}
+		sp.Grant.Path, sp.Grant.Subpaths = "/", "true"
+		doc = sp
+	default:
+		return nil
+	}
+	body, _ := xml.MarshalIndent(doc, "", "  ")
+	return append([]byte(prolog), append(body, '\n')...)
+}
+
+// flashOrigins - the allowed origins as Flash domains, which have no scheme or
+// port.  Plain http origins need secure="false" to be let into https pages.
+func (p *corsPolicy) flashOrigins() []flashDomain {
+	if p.anyOrigin {
+		return []flashDomain{{Domain: "*", Secure: "false"}}
+	}
+	var domains []flashDomain
+	for _, origin := range p.origins {
+		parts := strings.SplitN(origin, "://", 2)
+		host := parts[1]
+		if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+			host = host[:i]
+		}
+		d := flashDomain{Domain: host}
+		if parts[0] == "http" {
+			d.Secure = "false"
+		}
+		domains = append(domains, d)
+	}
+	return domains
+}
+
+// servePolicyFile - answers a request for crossdomain.xml or clientaccesspolicy.xml
+// out of the cors section.  It returns false if r isn't for one of them.
+func (p *corsPolicy) servePolicyFile(w http.ResponseWriter, r *http.Request) bool {
+	body := p.policyFile(r.URL.Path)
+	if body == nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCORS = corsConfig{
+	AllowedOrigins: []string{"https://*.example.com", "http://player.test:8080"},
+	AllowedMethods: []string{"GET", "HEAD"},
+	AllowedHeaders: []string{"Range", "If-None-Match"},
+	ExposedHeaders: []string{"Content-Length", "Content-Range"},
+	MaxAge:         10 * time.Minute,
+	CrossDomain:    true,
+}
+
+func TestProxyS3Media_CORS(t *testing.T) {
+	a := newMockApp(map[string]interface{}{"svod/show/seg.ts": []byte("0123456789")})
+	withConfig(t, a, func(c *Config) { c.CORS = testCORS })
+
+	w := serveMock(a, "GET", "/show/seg.ts", http.Header{"Origin": {"https://www.example.com"}, "Range": {"bytes=0-3"}})
+	if w.Code != http.StatusPartialContent || w.Header().Get("Access-Control-Allow-Origin") != "https://www.example.com" {
+		t.Fatalf("GET: unexpected %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Access-Control-Expose-Headers") != "Content-Length, Content-Range" || w.Header().Get("Vary") != "Origin" {
+		t.Fatalf("GET: unexpected %v", w.Header())
+	}
+
+	// other origins are served, but their pages don't get to read the response
+	w = serveMock(a, "GET", "/show/seg.ts", http.Header{"Origin": {"https://evil.test"}})
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("GET evil: unexpected %d %v", w.Code, w.Header())
+	}
+
+	w = serveMock(a, "OPTIONS", "/show/seg.ts", http.Header{
+		"Origin":                         {"http://player.test:8080"},
+		"Access-Control-Request-Method":  {"GET"},
+		"Access-Control-Request-Headers": {"range, if-none-match"},
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight: unexpected %d", w.Code)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "http://player.test:8080",
+		"Access-Control-Allow-Methods": "GET, HEAD",
+		"Access-Control-Allow-Headers": "range, if-none-match",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("preflight: expected %s %q, got %q", name, want, got)
+		}
+	}
+
+	for _, h := range []http.Header{
+		{"Origin": {"https://evil.test"}, "Access-Control-Request-Method": {"GET"}},
+		{"Origin": {"https://www.example.com"}, "Access-Control-Request-Method": {"DELETE"}},
+		{"Origin": {"https://www.example.com"}, "Access-Control-Request-Method": {"GET"}, "Access-Control-Request-Headers": {"X-Secret"}},
+	} {
+		w = serveMock(a, "OPTIONS", "/show/seg.ts", h)
+		if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("preflight %v: expected a 403, got %d %v", h, w.Code, w.Header())
+		}
+	}
+
+	if w := serveMock(a, "OPTIONS", "/show/seg.ts", nil); w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("OPTIONS: unexpected %d %v", w.Code, w.Header())
+	}
+
+	// without a cors section OPTIONS is refused as before
+	if w := serveMock(newMockApp(nil), "OPTIONS", "/show/seg.ts", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("OPTIONS without cors: expected 405, got %d", w.Code)
+	}
+}
+
+func TestProxyS3Media_PolicyFiles(t *testing.T) {
+	a := newMockApp(map[string]interface{}{"svod/show/seg.ts": []byte("0123456789")})
+	withConfig(t, a, func(c *Config) { c.CORS = testCORS })
+
+	w := serveMock(a, "GET", "/crossdomain.xml", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<!DOCTYPE cross-domain-policy") {
+		t.Fatalf("crossdomain.xml: unexpected %d %q", w.Code, w.Body.String())
+	}
+	var flash flashPolicy
+	if err := xml.Unmarshal(w.Body.Bytes(), &flash); err != nil {
+		t.Fatal(err)
+	}
+	want := []flashDomain{{Domain: "*.example.com"}, {Domain: "player.test", Secure: "false"}}
+	if len(flash.AllowAccess) != 2 || flash.AllowAccess[0] != want[0] || flash.AllowAccess[1] != want[1] {
+		t.Fatalf("crossdomain.xml: unexpected domains %+v", flash.AllowAccess)
+	}
+	if len(flash.AllowHeader) != 2 || flash.AllowHeader[0].Headers != "Range,If-None-Match" {
+		t.Fatalf("crossdomain.xml: unexpected headers %+v", flash.AllowHeader)
+	}
+
+	w = serveMock(a, "GET", "/clientaccesspolicy.xml", nil)
+	var silverlight silverlightPolicy
+	if err := xml.Unmarshal(w.Body.Bytes(), &silverlight); err != nil {
+		t.Fatal(err)
+	}
+	if domains := silverlight.Allow.Domains; len(domains) != 2 || domains[0].URI != "https://*.example.com" || silverlight.Grant.Path != "/" {
+		t.Fatalf("clientaccesspolicy.xml: unexpected %q", w.Body.String())
+	}
+
+	w = serveMock(a, "HEAD", "/crossdomain.xml", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") == "0" {
+		t.Fatalf("HEAD: unexpected %d %v", w.Code, w.Header())
+	}
+
+	// without cross_domain they are looked up in the bucket like any object
+	withConfig(t, a, func(c *Config) { c.CORS.CrossDomain = false })
+	if w := serveMock(a, "GET", "/crossdomain.xml", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the bucket's 404, got %d", w.Code)
+	}
+}
+
+func TestNewCORSPolicy(t *testing.T) {
+	if p, err := newCORSPolicy(&corsConfig{}); p != nil || err != nil {
+		t.Fatalf("expected no policy, got %v %v", p, err)
+	}
+	for _, c := range []corsConfig{
+		{CrossDomain: true},
+		{AllowedOrigins: []string{"example.com"}},
+		{AllowedOrigins: []string{"https://[example.com"}},
+	} {
+		if _, err := newCORSPolicy(&c); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+
+	p, err := newCORSPolicy(&corsConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Origin", "https://a.test")
+	h := make(http.Header)
+	p.setHeaders(h, r)
+	if h.Get("Access-Control-Allow-Origin") != "https://a.test" || h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("credentials need the origin echoed, got %v", h)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crunchyroll/evs-s3helper/credentials"
+)
+
+// Values of credentials.source
+const (
+	credentialsChain       = "chain"
+	credentialsEnv         = "env"
+	credentialsProfile     = "profile"
+	credentialsWebIdentity = "web_identity"
+	credentialsECS         = "ecs"
+	credentialsInstance    = "instance"
+)
+
+// credentialKey - what the credentials of a request depend on
+type credentialKey struct {
+	profile string // shared credentials profile of the route, "" for credentials.source
+	role    string // role assumed on top, "" for none
+}
+
+// credentialSet - the credentials the signed backend signs with, one cache per
+// profile and role of the routes
+type credentialSet struct {
+	caches map[credentialKey]*credentials.Cache
+}
+
+// sourceProvider - the provider named in credentials.source
+func sourceProvider(c *credentialsConfig, sts credentials.STS) (credentials.Provider, error) {
+	file := credentials.SharedFile{Filename: c.File, Profile: c.Profile}
+	instance := credentials.EC2Role{Endpoint: c.MetadataEndpoint}
+	webIdentity := credentials.WebIdentity{STS: sts}
+	switch c.Source {
+	case "", credentialsChain:
+		return credentials.Chain{credentials.Env{}, file, webIdentity, credentials.ECS{}, instance}, nil
+	case credentialsEnv:
+		return credentials.Env{}, nil
+	case credentialsProfile:
+		return file, nil
+	case credentialsWebIdentity:
+		return webIdentity, nil
+	case credentialsECS:
+		return credentials.ECS{}, nil
+	case credentialsInstance:
+		return instance, nil
+	}
+	return nil, fmt.Errorf("unknown credentials.source %q", c.Source)
+}
+
+// newCredentialSet - the credentials of the routes: credentials.source, a shared
+// credentials profile for routes with a profile, and an assumed role for routes
+// with a role_arn.  Credentials are only fetched once a request needs them.
+func newCredentialSet(c *Config, routes *routeTable) (*credentialSet, error) {
+	cc := &c.Credentials
+	sts := credentials.STS{Endpoint: cc.STSEndpoint, Region: c.S3Region}
+	source, err := sourceProvider(cc, sts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &credentialSet{caches: map[credentialKey]*credentials.Cache{
+		{}: credentials.NewCache(source, cc.RefreshBefore),
+	}}
+	for _, rt := range routes.routes {
+		base := credentialKey{profile: rt.profile}
+		if _, ok := s.caches[base]; !ok {
+			file := credentials.SharedFile{Filename: cc.File, Profile: rt.profile}
+			s.caches[base] = credentials.NewCache(file, cc.RefreshBefore)
+		}
+		key := credentialKey{profile: rt.profile, role: rt.role}
+		if _, ok := s.caches[key]; ok || rt.role == "" {
+			continue
+		}
+		s.caches[key] = credentials.NewCache(credentials.AssumeRole{
+			Source:     s.caches[base],
+			RoleARN:    rt.role,
+			ExternalID: rt.externalID,
+			STS:        credentials.STS{Endpoint: cc.STSEndpoint, Region: rt.region},
+		}, cc.RefreshBefore)
+	}
+	return s, nil
+}
+
+// forRequest - the credentials req is signed with
+func (s *credentialSet) forRequest(req *objectRequest) *credentials.Cache {
+	if c, ok := s.caches[credentialKey{profile: req.Profile, role: req.Role}]; ok {
+		return c
+	}
+	return s.caches[credentialKey{}]
+}
@@ -0,0 +1,242 @@
+// Package credentials finds the AWS credentials requests to S3 are signed with.
+// Providers get them from the environment, shared credentials files, web identity
+// tokens, the ECS and EC2 metadata endpoints or STS, and a Cache keeps them until
+// shortly before they expire.  Every endpoint can be pointed elsewhere, so the
+// providers can be tested against local fake servers.
+package credentials
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials - an AWS access key, along with the session token and expiry of
+// temporary credentials
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time // zero for credentials that don't expire
+	Source          string    // the provider they came from, for logs
+}
+
+// expiresWithin - whether c expires within d of now
+func (c *Credentials) expiresWithin(now time.Time, d time.Duration) bool {
+	return !c.Expires.IsZero() && !now.Add(d).Before(c.Expires)
+}
+
+// Provider - a source of credentials
+type Provider interface {
+	Retrieve(ctx context.Context) (Credentials, error)
+}
+
+// ErrNoCredentials - the provider has nothing to offer here, e.g. the environment
+// variables it reads are unset, so a Chain moves on to the next one
+var ErrNoCredentials = errors.New("no credentials")
+
+// defaultClient - for the metadata endpoints and STS, which answer within seconds
+// when they are there at all
+var defaultClient = &http.Client{Timeout: 5 * time.Second}
+
+func clientOrDefault(c *http.Client) *http.Client {
+	if c == nil {
+		return defaultClient
+	}
+	return c
+}
+
+// Static - credentials known up front
+type Static Credentials
+
+func (s Static) Retrieve(ctx context.Context) (Credentials, error) {
+	c := Credentials(s)
+	if c.Source == "" {
+		c.Source = "static"
+	}
+	return c, nil
+}
+
+// Env - credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, as read by Getenv, os.Getenv if it is nil
+type Env struct {
+	Getenv func(string) string
+}
+
+func (e Env) Retrieve(ctx context.Context) (Credentials, error) {
+	getenv := e.Getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	c := Credentials{
+		AccessKeyID:     firstNonEmpty(getenv("AWS_ACCESS_KEY_ID"), getenv("AWS_ACCESS_KEY")),
+		SecretAccessKey: firstNonEmpty(getenv("AWS_SECRET_ACCESS_KEY"), getenv("AWS_SECRET_KEY")),
+		SessionToken:    getenv("AWS_SESSION_TOKEN"),
+		Source:          "env",
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return Credentials{}, fmt.Errorf("env: %w", ErrNoCredentials)
+	}
+	return c, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// SharedFile - credentials of a profile in a shared credentials file, by default
+// the default profile of $AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.  The
+// file is read again every time, so rotated keys are picked up.
+type SharedFile struct {
+	Filename string
+	Profile  string
+}
+
+// DefaultSharedFile - where the AWS tools keep shared credentials
+func DefaultSharedFile() string {
+	if f := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); f != "" {
+		return f
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", "credentials")
+}
+
+func (s SharedFile) Retrieve(ctx context.Context) (Credentials, error) {
+	filename, profile := s.Filename, s.Profile
+	if filename == "" {
+		filename = DefaultSharedFile()
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return Credentials{}, fmt.Errorf("shared file %s: %w", filename, ErrNoCredentials)
+	}
+	if err != nil {
+		return Credentials{}, fmt.Errorf("shared file: %w", err)
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	var section string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == profile:
+			if i := strings.Index(line, "="); i > 0 {
+				values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, fmt.Errorf("shared file %s: %w", filename, err)
+	}
+
+	c := Credentials{
+		AccessKeyID:     values["aws_access_key_id"],
+		SecretAccessKey: values["aws_secret_access_key"],
+		SessionToken:    values["aws_session_token"],
+		Source:          "shared file " + profile,
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return Credentials{}, fmt.Errorf("shared file %s has no keys for profile %q: %w", filename, profile, ErrNoCredentials)
+	}
+	return c, nil
+}
+
+// Chain - the credentials of the first provider that has some.  Providers
+// reporting ErrNoCredentials are skipped, any other error ends the search, so a
+// broken source isn't papered over by a less privileged one.
+type Chain []Provider
+
+func (ch Chain) Retrieve(ctx context.Context) (Credentials, error) {
+	var skipped []string
+	for _, p := range ch {
+		c, err := p.Retrieve(ctx)
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			return Credentials{}, err
+		}
+		skipped = append(skipped, err.Error())
+	}
+	return Credentials{}, fmt.Errorf("no provider had credentials (%s): %w", strings.Join(skipped, "; "), ErrNoCredentials)
+}
+
+// DefaultRefreshWindow - how long before they expire credentials are refreshed
+const DefaultRefreshWindow = 5 * time.Minute
+
+// refreshRetry - how long a Cache that failed to refresh credentials it still has
+// waits before trying again, so a provider that is down doesn't hold up requests
+const refreshRetry = 10 * time.Second
+
+// Cache - keeps the credentials of a provider until Window before they expire.
+// Should a refresh fail meanwhile, the old credentials are used for as long as
+// they are valid, and the refresh is retried every few seconds.  A Cache is safe
+// for concurrent use; concurrent callers needing a refresh share a single one.
+type Cache struct {
+	Provider Provider
+	Window   time.Duration // DefaultRefreshWindow if 0
+
+	now func() time.Time // time.Now, but for tests
+
+	mu       sync.Mutex
+	creds    *Credentials
+	failedAt time.Time // of the last failed refresh
+}
+
+// NewCache - a cache of the credentials of p
+func NewCache(p Provider, window time.Duration) *Cache {
+	return &Cache{Provider: p, Window: window}
+}
+
+func (c *Cache) Retrieve(ctx context.Context) (Credentials, error) {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	window := c.Window
+	if window <= 0 {
+		window = DefaultRefreshWindow
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds != nil {
+		valid := !c.creds.expiresWithin(now(), 0)
+		if !c.creds.expiresWithin(now(), window) || (valid && now().Sub(c.failedAt) < refreshRetry) {
+			return *c.creds, nil
+		}
+	}
+	fresh, err := c.Provider.Retrieve(ctx)
+	if err != nil {
+		c.failedAt = now()
+		if c.creds != nil && !c.creds.expiresWithin(now(), 0) {
+			return *c.creds, nil
+		}
+		return Credentials{}, err
+	}
+	c.creds, c.failedAt = &fresh, time.Time{}
+	return fresh, nil
+}
@@ -0,0 +1,171 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func envOf(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestEnv(t *testing.T) {
+	c, err := Env{Getenv: envOf(map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "token",
+	})}.Retrieve(context.Background())
+	if err != nil || c.AccessKeyID != "AKID" || c.SecretAccessKey != "secret" || c.SessionToken != "token" {
+		t.Fatalf("unexpected %+v, %v", c, err)
+	}
+
+	if _, err := (Env{Getenv: envOf(map[string]string{"AWS_ACCESS_KEY_ID": "AKID"})}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials without a secret, got %v", err)
+	}
+}
+
+func TestSharedFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "credentials")
+	ioutil.WriteFile(file, []byte(`
+# comment
+[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = defaultsecret
+
+[media]
+aws_access_key_id=AKIDMEDIA
+aws_secret_access_key=mediasecret
+aws_session_token=mediatoken
+`), 0600)
+
+	c, err := SharedFile{Filename: file}.Retrieve(context.Background())
+	if err != nil || c.AccessKeyID != "AKIDDEFAULT" || c.SecretAccessKey != "defaultsecret" {
+		t.Fatalf("default: unexpected %+v, %v", c, err)
+	}
+	c, err = SharedFile{Filename: file, Profile: "media"}.Retrieve(context.Background())
+	if err != nil || c.AccessKeyID != "AKIDMEDIA" || c.SessionToken != "mediatoken" {
+		t.Fatalf("media: unexpected %+v, %v", c, err)
+	}
+	if _, err := (SharedFile{Filename: file, Profile: "other"}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("other: expected ErrNoCredentials, got %v", err)
+	}
+	if _, err := (SharedFile{Filename: file + ".missing"}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("missing file: expected ErrNoCredentials, got %v", err)
+	}
+}
+
+// countingProvider - hands out credentials valid for ttl, numbered by the call
+type countingProvider struct {
+	calls int32
+	ttl   time.Duration
+	now   func() time.Time
+	err   error
+}
+
+func (p *countingProvider) Retrieve(ctx context.Context) (Credentials, error) {
+	n := atomic.AddInt32(&p.calls, 1)
+	if p.err != nil {
+		return Credentials{}, p.err
+	}
+	c := Credentials{AccessKeyID: "AKID" + string(rune('0'+n)), SecretAccessKey: "secret"}
+	if p.ttl > 0 {
+		c.Expires = p.now().Add(p.ttl)
+	}
+	return c, nil
+}
+
+func TestChain(t *testing.T) {
+	chain := Chain{
+		Env{Getenv: envOf(nil)},
+		Static{AccessKeyID: "AKIDSTATIC", SecretAccessKey: "secret"},
+		Env{Getenv: envOf(map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "secret"})},
+	}
+	if c, err := chain.Retrieve(context.Background()); err != nil || c.AccessKeyID != "AKIDSTATIC" {
+		t.Fatalf("unexpected %+v, %v", c, err)
+	}
+
+	// a provider that fails for real isn't skipped
+	broken := errors.New("connection refused")
+	if _, err := (Chain{&countingProvider{err: broken}, chain[1]}).Retrieve(context.Background()); err != broken {
+		t.Fatalf("expected the broken provider's error, got %v", err)
+	}
+	if _, err := (Chain{chain[0]}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestCache_RefreshesBeforeExpiry(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	p := &countingProvider{ttl: time.Hour, now: clock}
+	c := NewCache(p, 5*time.Minute)
+	c.now = clock
+
+	get := func() Credentials {
+		t.Helper()
+		creds, err := c.Retrieve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return creds
+	}
+	if first := get(); first.AccessKeyID != "AKID1" || get().AccessKeyID != "AKID1" {
+		t.Fatalf("expected the credentials to be cached, got %+v", first)
+	}
+
+	now = now.Add(54 * time.Minute)
+	if get().AccessKeyID != "AKID1" {
+		t.Fatalf("refreshed too early")
+	}
+	now = now.Add(2 * time.Minute)
+	if get().AccessKeyID != "AKID2" {
+		t.Fatalf("expected a refresh within the window")
+	}
+
+	// a failed refresh falls back on credentials that are still valid, without
+	// hammering the provider
+	now = now.Add(57 * time.Minute)
+	p.err = errors.New("sts is down")
+	if get().AccessKeyID != "AKID2" || get().AccessKeyID != "AKID2" {
+		t.Fatalf("expected the old credentials")
+	}
+	if n := atomic.LoadInt32(&p.calls); n != 3 {
+		t.Fatalf("expected one failed refresh, got %d calls", n-2)
+	}
+	now = now.Add(5 * time.Minute)
+	if _, err := c.Retrieve(context.Background()); err == nil {
+		t.Fatalf("expected an error once the credentials expired")
+	}
+}
+
+func TestCache_ConcurrentCallersShareARefresh(t *testing.T) {
+	p := &countingProvider{ttl: time.Hour, now: time.Now}
+	c := NewCache(p, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Retrieve(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&p.calls); n != 1 {
+		t.Fatalf("expected one call to the provider, got %d", n)
+	}
+
+	// credentials that don't expire are kept for good
+	static := NewCache(Static{AccessKeyID: "AKID", SecretAccessKey: "secret"}, 0)
+	if creds, err := static.Retrieve(context.Background()); err != nil || creds.Source != "static" {
+		t.Fatalf("unexpected %+v, %v", creds, err)
+	}
+}
@@ -0,0 +1,365 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crunchyroll/evs-s3helper/sigv4"
+)
+
+// Default endpoints of the metadata services
+const (
+	DefaultEC2Endpoint = "http://169.254.169.254"
+	DefaultECSEndpoint = "http://169.254.170.2"
+)
+
+// maxResponse - more than any credentials document or STS answer takes
+const maxResponse = 1 << 20
+
+// metadataCredentials - the credentials document served by the EC2 and ECS
+// metadata endpoints
+type metadataCredentials struct {
+	Code            string // EC2 only, Success if all is well
+	Message         string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (m *metadataCredentials) credentials(source string) (Credentials, error) {
+	if m.Code != "" && m.Code != "Success" {
+		return Credentials{}, fmt.Errorf("%s: %s %s", source, m.Code, m.Message)
+	}
+	if m.AccessKeyID == "" || m.SecretAccessKey == "" {
+		return Credentials{}, fmt.Errorf("%s: the credentials document has no keys", source)
+	}
+	return Credentials{
+		AccessKeyID:     m.AccessKeyID,
+		SecretAccessKey: m.SecretAccessKey,
+		SessionToken:    m.Token,
+		Expires:         m.Expiration,
+		Source:          source,
+	}, nil
+}
+
+// fetch - the body of a 200 answer to method target with header, an error for
+// anything else
+func fetch(ctx context.Context, client *http.Client, method, target string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	return body, nil
+}
+
+type statusError struct {
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d: %.200s", e.status, e.body)
+}
+
+// EC2Role - the credentials of the first role of the EC2 instance profile, from
+// the instance metadata service.  IMDSv2 is used, with a fallback to IMDSv1 where
+// tokens aren't available.
+type EC2Role struct {
+	Endpoint string // DefaultEC2Endpoint if ""
+	Client   *http.Client
+}
+
+func (e EC2Role) Retrieve(ctx context.Context) (Credentials, error) {
+	endpoint := strings.TrimSuffix(firstNonEmpty(e.Endpoint, DefaultEC2Endpoint), "/")
+	client := clientOrDefault(e.Client)
+
+	header := http.Header{}
+	token, err := fetch(ctx, client, "PUT", endpoint+"/latest/api/token",
+		http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}})
+	switch err.(type) {
+	case nil:
+		header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+	case *statusError:
+		// IMDSv1 only, carry on without a token
+	default:
+		// nothing listening, this isn't an EC2 instance
+		return Credentials{}, fmt.Errorf("instance metadata: %v: %w", err, ErrNoCredentials)
+	}
+
+	base := endpoint + "/latest/meta-data/iam/security-credentials/"
+	roles, err := fetch(ctx, client, "GET", base, header)
+	if se, ok := err.(*statusError); ok && se.status == http.StatusNotFound {
+		return Credentials{}, fmt.Errorf("instance metadata: no instance profile: %w", ErrNoCredentials)
+	}
+	if err != nil {
+		return Credentials{}, fmt.Errorf("instance metadata: %v", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return Credentials{}, fmt.Errorf("instance metadata: no instance profile: %w", ErrNoCredentials)
+	}
+
+	body, err := fetch(ctx, client, "GET", base+url.PathEscape(role), header)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("instance metadata: role %s: %v", role, err)
+	}
+	var doc metadataCredentials
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return Credentials{}, fmt.Errorf("instance metadata: role %s: %v", role, err)
+	}
+	return doc.credentials("instance role " + role)
+}
+
+// ECS - the credentials of the task role, from the endpoint the ECS agent (or
+// EKS Pod Identity) advertises in AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI
+type ECS struct {
+	URL       string // full URL of the credentials, from the environment if ""
+	AuthToken string // sent as Authorization, from the environment if ""
+	Getenv    func(string) string
+	Client    *http.Client
+}
+
+func (e ECS) Retrieve(ctx context.Context) (Credentials, error) {
+	getenv := e.Getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	target := e.URL
+	if target == "" {
+		if uri := getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+			target = DefaultECSEndpoint + uri
+		} else {
+			target = getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		}
+	}
+	if target == "" {
+		return Credentials{}, fmt.Errorf("ecs: %w", ErrNoCredentials)
+	}
+
+	header := http.Header{}
+	token := e.AuthToken
+	if token == "" {
+		token = getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		if file := getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return Credentials{}, fmt.Errorf("ecs: %v", err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+	}
+	if token != "" {
+		header.Set("Authorization", token)
+	}
+
+	body, err := fetch(ctx, clientOrDefault(e.Client), "GET", target, header)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("ecs: %v", err)
+	}
+	var doc metadataCredentials
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return Credentials{}, fmt.Errorf("ecs: %v", err)
+	}
+	return doc.credentials("ecs")
+}
+
+// STS - where the STS API is reached
+type STS struct {
+	Endpoint string // https://sts.<Region>.amazonaws.com if ""
+	Region   string // us-east-1 if ""
+	Client   *http.Client
+}
+
+func (s *STS) region() string {
+	return firstNonEmpty(s.Region, "us-east-1")
+}
+
+func (s *STS) endpoint() string {
+	if s.Endpoint != "" {
+		return s.Endpoint
+	}
+	return "https://sts." + s.region() + ".amazonaws.com"
+}
+
+// stsResult - the part of an AssumeRole or AssumeRoleWithWebIdentity answer
+// that matters here
+type stsResult struct {
+	AssumeRole  *stsCredentials `xml:"AssumeRoleResult>Credentials"`
+	WebIdentity *stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+type stsCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+type stsError struct {
+	Error struct {
+		Code    string
+		Message string
+	}
+	RequestID string `xml:"RequestId"`
+}
+
+// call - makes the STS request in params, signed with creds unless it is nil
+func (s *STS) call(ctx context.Context, params url.Values, creds *Credentials, source string) (Credentials, error) {
+	params.Set("Version", "2011-06-15")
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if creds != nil {
+		signer := sigv4.Signer{
+			Credentials: sigv4.Credentials{
+				AccessKeyID:     creds.AccessKeyID,
+				SecretAccessKey: creds.SecretAccessKey,
+				SessionToken:    creds.SessionToken,
+			},
+			Region:  s.region(),
+			Service: "sts",
+		}
+		if err := signer.Sign(req, "", time.Now()); err != nil {
+			return Credentials{}, err
+		}
+	}
+
+	resp, err := clientOrDefault(s.Client).Do(req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("%s: %v", source, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return Credentials{}, fmt.Errorf("%s: %v", source, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e stsError
+		if xml.Unmarshal(body, &e) == nil && e.Error.Code != "" {
+			return Credentials{}, fmt.Errorf("%s: %s: %s (request id %s)", source, e.Error.Code, e.Error.Message, e.RequestID)
+		}
+		return Credentials{}, fmt.Errorf("%s: status %d", source, resp.StatusCode)
+	}
+
+	var result stsResult
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return Credentials{}, fmt.Errorf("%s: %v", source, err)
+	}
+	c := result.AssumeRole
+	if c == nil {
+		c = result.WebIdentity
+	}
+	if c == nil || c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return Credentials{}, fmt.Errorf("%s: the answer has no credentials", source)
+	}
+	return Credentials{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		Expires:         c.Expiration,
+		Source:          source,
+	}, nil
+}
+
+// defaultSessionName - names the sessions of assumed roles after the host
+func defaultSessionName() string {
+	host, _ := os.Hostname()
+	return "s3helper-" + firstNonEmpty(host, strconv.Itoa(os.Getpid()))
+}
+
+// WebIdentity - credentials for a role assumed with an OIDC token, as used by EKS
+// IAM roles for service accounts.  The token file and role come from
+// AWS_WEB_IDENTITY_TOKEN_FILE, AWS_ROLE_ARN and AWS_ROLE_SESSION_NAME unless
+// they are set.  The file is read again every time, since the token rotates.
+type WebIdentity struct {
+	TokenFile   string
+	RoleARN     string
+	SessionName string
+	Getenv      func(string) string
+	STS         STS
+}
+
+func (w WebIdentity) Retrieve(ctx context.Context) (Credentials, error) {
+	getenv := w.Getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	tokenFile := firstNonEmpty(w.TokenFile, getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	role := firstNonEmpty(w.RoleARN, getenv("AWS_ROLE_ARN"))
+	if tokenFile == "" || role == "" {
+		return Credentials{}, fmt.Errorf("web identity: %w", ErrNoCredentials)
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("web identity: %v", err)
+	}
+
+	params := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {firstNonEmpty(w.SessionName, getenv("AWS_ROLE_SESSION_NAME"), defaultSessionName())},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	return w.STS.call(ctx, params, nil, "web identity "+role)
+}
+
+// AssumeRole - credentials for a role assumed with the credentials of Source,
+// e.g. to reach a bucket of another account
+type AssumeRole struct {
+	Source      Provider
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+	Duration    time.Duration // 1h if 0
+	STS         STS
+}
+
+func (a AssumeRole) Retrieve(ctx context.Context) (Credentials, error) {
+	source, err := a.Source.Retrieve(ctx)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("assume role %s: %w", a.RoleARN, err)
+	}
+	duration := a.Duration
+	if duration <= 0 {
+		duration = time.Hour
+	}
+	params := url.Values{
+		"Action":          {"AssumeRole"},
+		"RoleArn":         {a.RoleARN},
+		"RoleSessionName": {firstNonEmpty(a.SessionName, defaultSessionName())},
+		"DurationSeconds": {strconv.Itoa(int(duration.Seconds()))},
+	}
+	if a.ExternalID != "" {
+		params.Set("ExternalId", a.ExternalID)
+	}
+	return a.STS.call(ctx, params, &source, "assume role "+a.RoleARN)
+}
@@ -0,0 +1,198 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const expiration = "2031-01-01T00:00:00Z"
+
+// fakeIMDS - an instance metadata service with a single role, requiring IMDSv2
+// tokens unless v1 is set
+func fakeIMDS(t *testing.T, v1 bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if v1 || r.Method != "PUT" || r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "imds-token")
+			return
+		}
+		if !v1 && r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "media-role\nother-role\n")
+		case "/latest/meta-data/iam/security-credentials/media-role":
+			fmt.Fprintf(w, `{"Code":"Success","Type":"AWS-HMAC","AccessKeyId":"ASIAEC2","SecretAccessKey":"ec2secret","Token":"ec2token","Expiration":%q}`, expiration)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestEC2Role(t *testing.T) {
+	for _, v1 := range []bool{false, true} {
+		c, err := EC2Role{Endpoint: fakeIMDS(t, v1).URL}.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("v1 %v: %v", v1, err)
+		}
+		if c.AccessKeyID != "ASIAEC2" || c.SessionToken != "ec2token" || c.Expires.Format(time.RFC3339) != expiration || c.Source != "instance role media-role" {
+			t.Fatalf("v1 %v: unexpected %+v", v1, c)
+		}
+	}
+
+	// nothing listening: not an EC2 instance, a chain moves on
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	if _, err := (EC2Role{Endpoint: srv.URL}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestECS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/credentials/task" || r.Header.Get("Authorization") != "ecs-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"RoleArn":"arn:aws:iam::123456789012:role/task","AccessKeyId":"ASIAECS","SecretAccessKey":"ecssecret","Token":"ecstoken","Expiration":%q}`, expiration)
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(tokenFile, []byte("ecs-token\n"), 0600)
+	c, err := ECS{Getenv: envOf(map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     srv.URL + "/v2/credentials/task",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE": tokenFile,
+	})}.Retrieve(context.Background())
+	if err != nil || c.AccessKeyID != "ASIAECS" || c.SessionToken != "ecstoken" {
+		t.Fatalf("unexpected %+v, %v", c, err)
+	}
+
+	if _, err := (ECS{URL: srv.URL + "/v2/credentials/task", Getenv: envOf(nil)}).Retrieve(context.Background()); err == nil || errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected the 403 to be reported, got %v", err)
+	}
+	if _, err := (ECS{Getenv: envOf(nil)}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials outside ECS, got %v", err)
+	}
+}
+
+// fakeSTS - answers AssumeRole and AssumeRoleWithWebIdentity, recording the
+// requests made
+func fakeSTS(t *testing.T, requests chan<- *http.Request) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests <- r
+		action := r.PostForm.Get("Action")
+		if r.PostForm.Get("RoleArn") == "arn:aws:iam::123456789012:role/denied" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not allowed</Message></Error><RequestId>req-1</RequestId></ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>ASIA%[1]s</AccessKeyId>
+      <SecretAccessKey>stssecret</SecretAccessKey>
+      <SessionToken>ststoken</SessionToken>
+      <Expiration>%[2]s</Expiration>
+    </Credentials>
+  </%[1]sResult>
+</%[1]sResponse>`, action, expiration)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWebIdentity(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	srv := fakeSTS(t, requests)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(tokenFile, []byte("oidc-token\n"), 0600)
+
+	c, err := WebIdentity{
+		Getenv: envOf(map[string]string{
+			"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile,
+			"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/irsa",
+			"AWS_ROLE_SESSION_NAME":       "pod-1",
+		}),
+		STS: STS{Endpoint: srv.URL},
+	}.Retrieve(context.Background())
+	if err != nil || c.AccessKeyID != "ASIAAssumeRoleWithWebIdentity" || c.SessionToken != "ststoken" {
+		t.Fatalf("unexpected %+v, %v", c, err)
+	}
+	r := <-requests
+	for name, want := range map[string]string{
+		"RoleArn":          "arn:aws:iam::123456789012:role/irsa",
+		"RoleSessionName":  "pod-1",
+		"WebIdentityToken": "oidc-token",
+		"Version":          "2011-06-15",
+	} {
+		if got := r.PostForm.Get(name); got != want {
+			t.Errorf("expected %s %q, got %q", name, want, got)
+		}
+	}
+	if r.Header.Get("Authorization") != "" {
+		t.Errorf("AssumeRoleWithWebIdentity is not signed")
+	}
+
+	if _, err := (WebIdentity{Getenv: envOf(nil)}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials without a token file, got %v", err)
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	srv := fakeSTS(t, requests)
+
+	p := AssumeRole{
+		Source:     Static{AccessKeyID: "AKIDSOURCE", SecretAccessKey: "secret"},
+		RoleARN:    "arn:aws:iam::123456789012:role/media",
+		ExternalID: "partner-42",
+		Duration:   15 * time.Minute,
+		STS:        STS{Endpoint: srv.URL, Region: "eu-west-1"},
+	}
+	c, err := p.Retrieve(context.Background())
+	if err != nil || c.AccessKeyID != "ASIAAssumeRole" || c.Expires.Format(time.RFC3339) != expiration {
+		t.Fatalf("unexpected %+v, %v", c, err)
+	}
+	r := <-requests
+	for name, want := range map[string]string{
+		"RoleArn":         "arn:aws:iam::123456789012:role/media",
+		"ExternalId":      "partner-42",
+		"DurationSeconds": "900",
+	} {
+		if got := r.PostForm.Get(name); got != want {
+			t.Errorf("expected %s %q, got %q", name, want, got)
+		}
+	}
+	if !strings.HasPrefix(r.PostForm.Get("RoleSessionName"), "s3helper-") {
+		t.Errorf("unexpected session name %q", r.PostForm.Get("RoleSessionName"))
+	}
+
+	p.RoleARN = "arn:aws:iam::123456789012:role/denied"
+	if _, err := p.Retrieve(context.Background()); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("expected STS's error, got %v", err)
+	}
+	<-requests
+
+	// the source not having credentials is reported as such
+	p.Source = Env{Getenv: envOf(nil)}
+	if _, err := p.Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredentialSet(t *testing.T) {
+	// an STS handing out keys named after the role assumed
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>
+<AccessKeyId>ASIA-%s</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>
+<SessionToken>token</SessionToken><Expiration>2031-01-01T00:00:00Z</Expiration>
+</Credentials></AssumeRoleResult></AssumeRoleResponse>`, path.Base(r.PostForm.Get("RoleArn")))
+	}))
+	defer sts.Close()
+
+	file := filepath.Join(t.TempDir(), "credentials")
+	ioutil.WriteFile(file, []byte("[default]\naws_access_key_id = AKIDDEFAULT\naws_secret_access_key = s\n"+
+		"[partner]\naws_access_key_id = AKIDPARTNER\naws_secret_access_key = s\n"), 0600)
+
+	c := &Config{
+		S3Region: "us-west-2",
+		Routes: []routeConfig{
+			{Prefix: "/", Bucket: "content"},
+			{Prefix: "/partner/", Bucket: "partner", Profile: "partner"},
+			{Prefix: "/media/", Bucket: "media", RoleARN: "arn:aws:iam::1:role/media"},
+			{Prefix: "/media2/", Bucket: "media2", RoleARN: "arn:aws:iam::1:role/media"},
+		},
+		Credentials: credentialsConfig{Source: credentialsProfile, File: file, STSEndpoint: sts.URL},
+	}
+	routes, err := newRouteTable(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := newCredentialSet(c, routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(set.caches); n != 3 {
+		t.Errorf("expected one cache per profile and role, got %d", n)
+	}
+
+	for p, want := range map[string]string{
+		"/x.ts":         "AKIDDEFAULT",
+		"/partner/x.ts": "AKIDPARTNER",
+		"/media/x.ts":   "ASIA-media",
+		"/media2/x.ts":  "ASIA-media",
+	} {
+		rt := routes.match("", p)
+		creds, err := set.forRequest(&objectRequest{Profile: rt.profile, Role: rt.role}).Retrieve(context.Background())
+		if err != nil || creds.AccessKeyID != want {
+			t.Errorf("%s: expected %s, got %+v, %v", p, want, creds, err)
+		}
+	}
+
+	c.Credentials.Source = "keychain"
+	if _, err := newCredentialSet(c, routes); err == nil {
+		t.Fatalf("expected an unknown source to be rejected")
+	}
+}
@@ -0,0 +1,300 @@
+// Package diskcache is an on-disk LRU cache of HTTP response bodies and their
+// metadata.  Each entry is a body file plus a JSON metadata file, named after the
+// SHA-256 of its key, so the cache survives restarts.  Entries are written to a
+// temporary file while they stream in and only become visible once complete.
+package diskcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metaSuffix = ".json"
+	tmpSuffix  = ".tmp"
+)
+
+// Meta - what is stored along with a body
+type Meta struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Size   int64       `json:"size"`   // of the body
+	Stored time.Time   `json:"stored"` // when the entry was last known to be current
+}
+
+// Cache - an LRU cache of at most maxSize bytes of bodies stored in dir
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	lru   *list.List // of *Meta, most recently used first
+	items map[string]*list.Element
+	size  int64
+}
+
+// Open - opens the cache in dir, creating dir if needed.  Complete entries left by
+// a previous run are kept, up to maxSize; anything else is removed.
+func Open(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var metas []*Meta
+	bodies := map[string]os.FileInfo{}
+	for _, fi := range files {
+		name := fi.Name()
+		switch {
+		case strings.HasSuffix(name, tmpSuffix):
+			os.Remove(filepath.Join(dir, name)) // an entry that never completed
+		case strings.HasSuffix(name, metaSuffix):
+			if m := readMeta(filepath.Join(dir, name)); m != nil {
+				metas = append(metas, m)
+			} else {
+				os.Remove(filepath.Join(dir, name))
+			}
+		default:
+			bodies[name] = fi
+		}
+	}
+
+	// oldest first, so that the most recent end up at the front
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Stored.Before(metas[j].Stored) })
+	for _, m := range metas {
+		name := fileName(m.Key)
+		if body, ok := bodies[name]; !ok || body.Size() != m.Size {
+			os.Remove(filepath.Join(dir, name+metaSuffix))
+			continue
+		}
+		delete(bodies, name)
+		c.items[m.Key] = c.lru.PushFront(m)
+		c.size += m.Size
+	}
+	for name := range bodies {
+		os.Remove(filepath.Join(dir, name)) // a body without metadata
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func readMeta(path string) *Meta {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var m Meta
+	if json.Unmarshal(b, &m) != nil || m.Key == "" {
+		return nil
+	}
+	return &m
+}
+
+// fileName - the name of the files of key, free of anything a key may contain
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, fileName(key))
+}
+
+// Get - the entry for key and its body, which the caller must close.  ok is false
+// if there is no such entry.
+func (c *Cache) Get(key string) (meta Meta, body *os.File, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return Meta{}, nil, false
+	}
+	// opened under the lock, so eviction can't remove the file first; once open it
+	// stays readable even if the entry is evicted meanwhile
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		c.remove(el)
+		return Meta{}, nil, false
+	}
+	c.lru.MoveToFront(el)
+	return *el.Value.(*Meta), f, true
+}
+
+// Refresh - marks the entry for key as current as of stored, e.g. after S3
+// confirmed it hasn't changed
+func (c *Cache) Refresh(key string, stored time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return fmt.Errorf("no entry for %q", key)
+	}
+	m := *el.Value.(*Meta)
+	m.Stored = stored
+	if err := c.writeMeta(&m); err != nil {
+		return err
+	}
+	el.Value = &m
+	c.lru.MoveToFront(el)
+	return nil
+}
+
+// Remove - drops the entry for key, if any
+func (c *Cache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Stats - the number of entries and the size of their bodies
+func (c *Cache) Stats() (entries int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items), c.size
+}
+
+func (c *Cache) remove(el *list.Element) {
+	m := el.Value.(*Meta)
+	c.lru.Remove(el)
+	delete(c.items, m.Key)
+	c.size -= m.Size
+	os.Remove(c.path(m.Key) + metaSuffix)
+	os.Remove(c.path(m.Key))
+}
+
+// evict - drops the least recently used entries until the cache fits maxSize
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+func (c *Cache) writeMeta(m *Meta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.dir, "meta-*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(m.Key)+metaSuffix)
+}
+
+// Writer - an entry being written.  It becomes visible on Commit, or is dropped on
+// Abort; one of them must be called.
+type Writer struct {
+	c    *Cache
+	meta Meta
+	f    *os.File
+	n    int64
+	err  error
+}
+
+// NewWriter - starts an entry described by meta, whose Size must be the exact size
+// of the body about to be written
+func (c *Cache) NewWriter(meta Meta) (*Writer, error) {
+	if meta.Size > c.maxSize {
+		return nil, fmt.Errorf("%d bytes don't fit in a cache of %d bytes", meta.Size, c.maxSize)
+	}
+	f, err := ioutil.TempFile(c.dir, "body-*"+tmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{c: c, meta: meta, f: f}, nil
+}
+
+// Write - appends to the body.  Errors are remembered and fail Commit.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.f.Write(p)
+	w.n += int64(n)
+	if err == nil && w.n > w.meta.Size {
+		err = fmt.Errorf("body exceeds the expected %d bytes", w.meta.Size)
+	}
+	w.err = err
+	return n, err
+}
+
+// Commit - adds the entry to the cache, replacing any previous one for the same key
+func (w *Writer) Commit() error {
+	if w.err == nil && w.n != w.meta.Size {
+		w.err = fmt.Errorf("body has %d bytes, expected %d", w.n, w.meta.Size)
+	}
+	if err := w.f.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		os.Remove(w.f.Name())
+		return w.err
+	}
+
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[w.meta.Key]; ok {
+		c.remove(el)
+	}
+	if err := os.Rename(w.f.Name(), c.path(w.meta.Key)); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err := c.writeMeta(&w.meta); err != nil {
+		os.Remove(c.path(w.meta.Key))
+		return err
+	}
+	m := w.meta
+	c.items[m.Key] = c.lru.PushFront(&m)
+	c.size += m.Size
+	c.evict()
+	return nil
+}
+
+// Abort - drops the entry
+func (w *Writer) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
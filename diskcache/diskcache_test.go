@@ -0,0 +1,136 @@
+package diskcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func put(t *testing.T, c *Cache, key, body string) {
+	t.Helper()
+	w, err := c.NewWriter(Meta{Key: key, Status: 200, Header: http.Header{"Etag": {`"x"`}}, Size: int64(len(body)), Stored: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(body))
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(c *Cache, key string) (string, bool) {
+	_, f, ok := c.Get(key)
+	if !ok {
+		return "", false
+	}
+	defer f.Close()
+	b, _ := ioutil.ReadAll(f)
+	return string(b), true
+}
+
+func TestCache_LRU(t *testing.T) {
+	c, err := Open(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, c, "a", "aaaa")
+	put(t, c, "b", "bbbb")
+	get(c, "a") // b is now the least recently used
+	put(t, c, "c", "cccc")
+
+	if _, ok := get(c, "b"); ok {
+		t.Fatal("b should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if body, ok := get(c, key); !ok || body != key+key+key+key {
+			t.Fatalf("%s: unexpected %q %v", key, body, ok)
+		}
+	}
+	if entries, size := c.Stats(); entries != 2 || size != 8 {
+		t.Fatalf("unexpected stats %d %d", entries, size)
+	}
+	if _, err := c.NewWriter(Meta{Key: "big", Size: 11}); err == nil {
+		t.Fatal("expected an entry larger than the cache to be refused")
+	}
+}
+
+func TestCache_IncompleteWrites(t *testing.T) {
+	c, err := Open(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ := c.NewWriter(Meta{Key: "short", Size: 10})
+	w.Write([]byte("12345"))
+	if err := w.Commit(); err == nil {
+		t.Fatal("expected a short body to fail the commit")
+	}
+	w, _ = c.NewWriter(Meta{Key: "long", Size: 2})
+	if _, err := w.Write([]byte("12345")); err == nil {
+		t.Fatal("expected a long body to fail")
+	}
+	w.Abort()
+	w, _ = c.NewWriter(Meta{Key: "aborted", Size: 1})
+	w.Write([]byte("1"))
+	w.Abort()
+
+	for _, key := range []string{"short", "long", "aborted"} {
+		if _, ok := get(c, key); ok {
+			t.Errorf("%s should not be cached", key)
+		}
+	}
+	files, _ := ioutil.ReadDir(c.dir)
+	if len(files) != 0 {
+		t.Fatalf("expected no files left, got %d", len(files))
+	}
+}
+
+func TestCache_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, c, "old", "1")
+	put(t, c, "new", "2")
+	stored := time.Now().Add(time.Hour).Round(time.Second)
+	if err := c.Refresh("old", stored); err != nil {
+		t.Fatal(err)
+	}
+	// debris of a crash
+	ioutil.WriteFile(filepath.Join(dir, "body-123.tmp"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, fileName("orphan")), []byte("x"), 0644)
+
+	c, err = Open(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, f, ok := c.Get("old")
+	if !ok || !meta.Stored.Equal(stored) || meta.Header.Get("ETag") != `"x"` {
+		t.Fatalf("old: unexpected %+v %v", meta, ok)
+	}
+	f.Close()
+	if body, ok := get(c, "new"); !ok || body != "2" {
+		t.Fatalf("new: unexpected %q %v", body, ok)
+	}
+	for _, name := range []string{"body-123.tmp", fileName("orphan")} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been cleaned up", name)
+		}
+	}
+
+	// a smaller cache keeps the most recently stored
+	c, err = Open(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := get(c, "old"); !ok {
+		t.Fatal("expected old, refreshed last, to be kept")
+	}
+	if _, ok := get(c, "new"); ok {
+		t.Fatal("expected new to be evicted")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Addressing styles selectable with addressing_style
+const (
+	addressingPath    = "path"    // https://s3.<region>.amazonaws.com/<bucket>/<key>
+	addressingVirtual = "virtual" // https://<bucket>.s3.<region>.amazonaws.com/<key>
+)
+
+// s3Endpoint - builds upstream object URLs according to an endpointConfig
+type s3Endpoint struct {
+	scheme    string
+	virtual   bool
+	dualStack bool
+	fips      bool
+	custom    *url.URL // custom endpoint, e.g. MinIO or localstack
+}
+
+// newS3Endpoint - validates an endpointConfig and turns it into an s3Endpoint
+func newS3Endpoint(c *endpointConfig) (*s3Endpoint, error) {
+	e := &s3Endpoint{
+		scheme:    strings.ToLower(c.Scheme),
+		dualStack: c.DualStack,
+		fips:      c.FIPS,
+	}
+
+	switch strings.ToLower(c.AddressingStyle) {
+	case "", addressingPath:
+	case addressingVirtual:
+		e.virtual = true
+	default:
+		return nil, fmt.Errorf("unknown addressing_style %q, expected %q or %q", c.AddressingStyle, addressingPath, addressingVirtual)
+	}
+
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid endpoint url %q, expected e.g. http://localhost:9000", c.URL)
+		}
+		if c.DualStack || c.FIPS {
+			return nil, fmt.Errorf("dual_stack and fips cannot be combined with a custom endpoint url %q", c.URL)
+		}
+		e.custom = u
+		e.scheme = u.Scheme
+	}
+
+	switch e.scheme {
+	case "":
+		e.scheme = "https"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unknown scheme %q, expected http or https", c.Scheme)
+	}
+	return e, nil
+}
+
+// host - the S3 service host for a region, without any bucket
+func (e *s3Endpoint) host(region string) string {
+	if e.custom != nil {
+		return e.custom.Host
+	}
+
+	service := "s3"
+	if e.fips {
+		service = "s3-fips"
+	}
+	if e.dualStack {
+		service += ".dualstack"
+	}
+	domain := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		domain = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("%s.%s.%s", service, region, domain)
+}
+
+// useVirtual - whether bucket can be addressed virtual-hosted-style.  Buckets with
+// dots in their name don't match S3's wildcard certificate, so they stay path-style
+// over https.
+func (e *s3Endpoint) useVirtual(bucket string) bool {
+	return e.virtual && !(e.scheme == "https" && strings.Contains(bucket, "."))
+}
+
+// baseURL - the URL objects of bucket are relative to, without a trailing slash
+func (e *s3Endpoint) baseURL(region, bucket string) string {
+	if e.useVirtual(bucket) {
+		return fmt.Sprintf("%s://%s.%s", e.scheme, bucket, e.host(region))
+	}
+	return fmt.Sprintf("%s://%s/%s", e.scheme, e.host(region), bucket)
+}
+
+// serviceURL - the endpoint without any bucket, as the AWS SDK expects it
+func (e *s3Endpoint) serviceURL(region string) string {
+	return fmt.Sprintf("%s://%s", e.scheme, e.host(region))
+}
+
+// objectURL - the URL of key (which starts with a /) in bucket
+func (e *s3Endpoint) objectURL(region, bucket, key string) string {
+	return e.baseURL(region, bucket) + key
+}
+
+// endpointResolver - picks the endpoint settings for a bucket, falling back to s3_endpoint
+type endpointResolver struct {
+	fallback *s3Endpoint
+	byBucket map[string]*s3Endpoint
+}
+
+// newEndpointResolver - builds the endpoints from s3_endpoint and the per bucket s3_buckets overrides
+func newEndpointResolver(c *Config) (*endpointResolver, error) {
+	fallback, err := newS3Endpoint(&c.S3Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3_endpoint: %v", err)
+	}
+
+	res := &endpointResolver{
+		fallback: fallback,
+		byBucket: make(map[string]*s3Endpoint, len(c.S3Buckets)),
+	}
+	for bucket, bc := range c.S3Buckets {
+		bc := bc
+		if res.byBucket[bucket], err = newS3Endpoint(&bc); err != nil {
+			return nil, fmt.Errorf("s3_buckets.%s: %v", bucket, err)
+		}
+	}
+	return res, nil
+}
+
+// forBucket - the endpoint used to reach bucket
+func (r *endpointResolver) forBucket(bucket string) *s3Endpoint {
+	if e, ok := r.byBucket[bucket]; ok {
+		return e
+	}
+	return r.fallback
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestS3Endpoint_ObjectURL(t *testing.T) {
+	cases := []struct {
+		name   string
+		conf   endpointConfig
+		region string
+		bucket string
+		want   string
+	}{
+		{"default", endpointConfig{}, "us-west-2", "media", "https://s3.us-west-2.amazonaws.com/media/show/seg-1.ts"},
+		{"plain http", endpointConfig{Scheme: "http"}, "us-west-2", "media", "http://s3.us-west-2.amazonaws.com/media/show/seg-1.ts"},
+		{"virtual", endpointConfig{AddressingStyle: "virtual"}, "us-west-2", "media", "https://media.s3.us-west-2.amazonaws.com/show/seg-1.ts"},
+		{"virtual dotted bucket over https", endpointConfig{AddressingStyle: "virtual"}, "us-west-2", "media.example", "https://s3.us-west-2.amazonaws.com/media.example/show/seg-1.ts"},
+		{"virtual dotted bucket over http", endpointConfig{Scheme: "http", AddressingStyle: "virtual"}, "us-west-2", "media.example", "http://media.example.s3.us-west-2.amazonaws.com/show/seg-1.ts"},
+		{"dual stack", endpointConfig{DualStack: true}, "eu-west-1", "media", "https://s3.dualstack.eu-west-1.amazonaws.com/media/show/seg-1.ts"},
+		{"fips", endpointConfig{FIPS: true}, "us-gov-west-1", "media", "https://s3-fips.us-gov-west-1.amazonaws.com/media/show/seg-1.ts"},
+		{"fips dual stack virtual", endpointConfig{FIPS: true, DualStack: true, AddressingStyle: "virtual"}, "us-east-1", "media", "https://media.s3-fips.dualstack.us-east-1.amazonaws.com/show/seg-1.ts"},
+		{"china", endpointConfig{}, "cn-north-1", "media", "https://s3.cn-north-1.amazonaws.com.cn/media/show/seg-1.ts"},
+		{"minio", endpointConfig{URL: "http://localhost:9000"}, "us-east-1", "media", "http://localhost:9000/media/show/seg-1.ts"},
+		{"custom virtual", endpointConfig{URL: "https://objects.example.com", AddressingStyle: "virtual"}, "us-east-1", "media", "https://media.objects.example.com/show/seg-1.ts"},
+	}
+
+	for _, c := range cases {
+		e, err := newS3Endpoint(&c.conf)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		if got := e.objectURL(c.region, c.bucket, "/show/seg-1.ts"); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestS3Endpoint_Invalid(t *testing.T) {
+	for _, c := range []endpointConfig{
+		{Scheme: "ftp"},
+		{AddressingStyle: "sideways"},
+		{URL: "localhost:9000"},
+		{URL: "http://localhost:9000", FIPS: true},
+	} {
+		if _, err := newS3Endpoint(&c); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
+
+func TestEndpointResolver_PerBucket(t *testing.T) {
+	res, err := newEndpointResolver(&Config{
+		S3Buckets: map[string]endpointConfig{"local": {URL: "http://localhost:4566"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := res.forBucket("local").objectURL("us-east-1", "local", "/a"); got != "http://localhost:4566/local/a" {
+		t.Errorf("override: got %s", got)
+	}
+	if got := res.forBucket("media").objectURL("us-east-1", "media", "/a"); got != "https://s3.us-east-1.amazonaws.com/media/a" {
+		t.Errorf("fallback: got %s", got)
+	}
+}
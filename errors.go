@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rs/zerolog"
+)
+
+// S3 error codes that get special treatment, on top of the ones exported by the SDK.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+const (
+	errCodeAccessDenied  = "AccessDenied"
+	errCodeInvalidRange  = "InvalidRange"
+	errCodeNotFound      = "NotFound" // HEAD responses have no body, so no specific code
+	errCodeNoSuchVersion = "NoSuchVersion"
+	errCodeSlowDown      = "SlowDown"
+	errCodeTimeout       = "RequestTimeout"
+	errCodeNetwork       = "NetworkError"
+	errCodeInternal      = "InternalError"
+)
+
+// Seconds a client is asked to wait after S3 throttled us
+const slowDownRetryAfter = "1"
+
+// Cap on how much of an S3 error document is read
+const maxErrorBodySize = 16 * 1024
+
+// s3ErrorDocument - the XML body S3 sends along with a non-2xx response
+type s3ErrorDocument struct {
+	XMLName          xml.Name `xml:"Error"`
+	Code             string   `xml:"Code"`
+	Message          string   `xml:"Message"`
+	RequestID        string   `xml:"RequestId"`
+	HostID           string   `xml:"HostId"`
+	ActualObjectSize string   `xml:"ActualObjectSize"` // only for InvalidRange
+}
+
+// upstreamError - a failed S3 fetch, translated into what the client should get back
+type upstreamError struct {
+	Status     int    // status code returned to the client
+	S3Status   int    // status code S3 returned, 0 if S3 never answered
+	Code       string // S3 error code, e.g. NoSuchKey
+	Message    string // details of the failure, only logged
+	RequestID  string // x-amz-request-id, needed for AWS support cases
+	HostID     string // x-amz-id-2, needed for AWS support cases
+	ObjectSize string // object size reported along with InvalidRange
+}
+
+// invalidRangeError - an InvalidRange error from the SDK, along with the size of the
+// object.  S3 sends the size in the error document, but the SDK drops it.
+type invalidRangeError struct {
+	awserr.RequestFailure
+	objectSize int64
+}
+
+// HostID - the x-amz-id-2 of the wrapped error, if the SDK gave one
+func (e *invalidRangeError) HostID() string {
+	if hostErr, ok := e.RequestFailure.(interface{ HostID() string }); ok {
+		return hostErr.HostID()
+	}
+	return ""
+}
+
+// clientStatus - maps an S3 error code and status onto the status returned to the client.
+// Upstream failures that are not the client's fault become 502s.
+func clientStatus(code string, s3Status int) int {
+	switch code {
+	case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, errCodeNotFound, errCodeNoSuchVersion:
+		return http.StatusNotFound
+	case errCodeAccessDenied:
+		return http.StatusForbidden
+	case errCodeSlowDown:
+		return http.StatusServiceUnavailable
+	case errCodeInvalidRange:
+		return http.StatusRequestedRangeNotSatisfiable
+	case errCodeTimeout:
+		return http.StatusGatewayTimeout
+	}
+	switch {
+	case s3Status == http.StatusServiceUnavailable:
+		return http.StatusServiceUnavailable
+	case s3Status >= 400 && s3Status < 500:
+		return s3Status
+	}
+	return http.StatusBadGateway
+}
+
+// parseS3ErrorResponse - reads the error document off a non-2xx S3 response.  The
+// request IDs fall back to the response headers, which S3 sends even for HEAD.
+func parseS3ErrorResponse(resp *http.Response) *upstreamError {
+	var doc s3ErrorDocument
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if len(body) > 0 {
+		xml.Unmarshal(body, &doc)
+	}
+
+	uerr := &upstreamError{
+		S3Status:   resp.StatusCode,
+		Code:       doc.Code,
+		Message:    doc.Message,
+		RequestID:  doc.RequestID,
+		HostID:     doc.HostID,
+		ObjectSize: doc.ActualObjectSize,
+	}
+	if uerr.RequestID == "" {
+		uerr.RequestID = resp.Header.Get("x-amz-request-id")
+	}
+	if uerr.HostID == "" {
+		uerr.HostID = resp.Header.Get("x-amz-id-2")
+	}
+	if uerr.Code == "" {
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			uerr.Code = errCodeNotFound
+		case http.StatusForbidden:
+			uerr.Code = errCodeAccessDenied
+		case http.StatusServiceUnavailable:
+			uerr.Code = errCodeSlowDown
+		case http.StatusRequestedRangeNotSatisfiable:
+			uerr.Code = errCodeInvalidRange
+		}
+	}
+	if uerr.Message == "" {
+		uerr.Message = http.StatusText(resp.StatusCode)
+	}
+	uerr.Status = clientStatus(uerr.Code, uerr.S3Status)
+	return uerr
+}
+
+// transportCause - the error an SDK RequestError wraps.  awserr errors only expose
+// what they wrap through OrigErr, which errors.As doesn't know about, so a timeout
+// reported by the SDK would otherwise go unnoticed.
+func transportCause(err error) error {
+	var aerr awserr.Error
+	for errors.As(err, &aerr) && aerr.OrigErr() != nil {
+		err = aerr.OrigErr()
+	}
+	return err
+}
+
+// classifyFetchError - translates an error returned by a backend, recording the
+// matching New Relic metric and logging the details.
+func (a *App) classifyFetchError(getErr error, s3Bucket, s3Path string, logger *zerolog.Logger) *upstreamError {
+	uerr := &upstreamError{
+		Status:  http.StatusBadGateway,
+		Code:    errCodeNetwork,
+		Message: getErr.Error(),
+	}
+
+	// timeout error or network errors
+	netCause := transportCause(getErr)
+	var netErr net.Error
+	if errors.As(netCause, &netErr) && netErr.Timeout() {
+		// Timed out connecting to S3
+		a.countMetric("s3-helper:timeout", s3Bucket)
+		uerr.Code = errCodeTimeout
+		uerr.Message = fmt.Sprintf("AWS S3 Timeout for %s/%s", s3Bucket, s3Path)
+	} else if errors.As(netCause, &netErr) {
+		// Network Error connecting to S3
+		a.countMetric("s3-helper:neterror", s3Bucket)
+		uerr.Message = fmt.Sprintf("AWS S3 Network Error for %s/%s", s3Bucket, s3Path)
+	}
+
+	// More network errors
+	var opErr *net.OpError
+	if errors.As(netCause, &opErr) {
+		if opErr.Op == "dial" {
+			// "Unknown host"
+			a.countMetric("s3-helper:netunknownhost", s3Bucket)
+			uerr.Message = fmt.Sprintf("AWS S3 Unknown Host Error for %s/%s", s3Bucket, s3Path)
+		} else if opErr.Op == "read" {
+			// "Connection refused"
+			a.countMetric("s3-helper:connectionrefused", s3Bucket)
+			uerr.Message = fmt.Sprintf("AWS S3 Connection Refused Error for %s/%s", s3Bucket, s3Path)
+		}
+	} else if errors.Is(netCause, syscall.ECONNREFUSED) {
+		// "Connection refused"
+		a.countMetric("s3-helper:connectionrefused", s3Bucket)
+		uerr.Message = fmt.Sprintf("AWS S3 Connection Refused Error for %s/%s", s3Bucket, s3Path)
+	}
+
+	// Casting to the awserr.Error type will allow you to inspect the error
+	// code returned by the service in code. The error code can be used
+	// to switch on context specific functionality. In this case a context
+	// specific error message is printed to the user based on the bucket
+	// and key existing.
+	//
+	// For information on other S3 API error codes see:
+	// http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+	//
+	// A RequestError means S3 never answered: the network errors above describe it.
+	if aerr, ok := getErr.(awserr.Error); ok && aerr.Code() != request.ErrCodeRequestError {
+		uerr.Code = aerr.Code()
+		uerr.Message = aerr.Message()
+		if reqErr, ok := getErr.(awserr.RequestFailure); ok {
+			uerr.S3Status = reqErr.StatusCode()
+			uerr.RequestID = reqErr.RequestID()
+			if hostErr, ok := getErr.(interface{ HostID() string }); ok {
+				uerr.HostID = hostErr.HostID()
+			}
+			if reqErr.StatusCode() == 503 {
+				// AWS SlowDown Throttling S3 Bucket
+				// Trick taken from: https://github.com/go-spatial/tegola/issues/458
+				a.countMetric("s3-helper:s3slowdown503", s3Bucket)
+				uerr.Code = errCodeSlowDown
+				uerr.Message = fmt.Sprintf("SlowDown Throttling on %s/%s", s3Bucket, s3Path)
+			} else if reqErr.StatusCode() == 404 {
+				a.countMetric("s3-helper:s3status404", s3Bucket)
+			} else {
+				a.countMetric(fmt.Sprintf("s3-helper:s3status%d", reqErr.StatusCode()), s3Bucket)
+			}
+		}
+
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchBucket:
+			uerr.Message = fmt.Sprintf("bucket %s does not exist", s3Bucket)
+			a.countMetric("s3-helper:s3nosuchbucket", s3Bucket)
+		case s3.ErrCodeNoSuchKey:
+			uerr.Message = fmt.Sprintf("object with key %s does not exist in bucket %s", s3Path, s3Bucket)
+			a.countMetric("s3-helper:s3nosuchkey", s3Bucket)
+		case errCodeNoSuchVersion:
+			uerr.Message = fmt.Sprintf("object with key %s has no such version in bucket %s", s3Path, s3Bucket)
+			a.countMetric("s3-helper:s3nosuchversion", s3Bucket)
+		case errCodeNotFound, errCodeAccessDenied, errCodeInvalidRange, errCodeSlowDown:
+		default:
+			a.countMetric("s3-helper:s3unknownerror", s3Bucket)
+		}
+		if rangeErr, ok := getErr.(*invalidRangeError); ok {
+			uerr.ObjectSize = strconv.FormatInt(rangeErr.objectSize, 10)
+		}
+		uerr.Status = clientStatus(uerr.Code, uerr.S3Status)
+	} else if uerr.Code == errCodeTimeout {
+		uerr.Status = http.StatusGatewayTimeout
+	}
+
+	if errors.Is(getErr, context.Canceled) {
+		// the client went away, nobody is left to read the response
+		uerr.Code = "ClientClosedRequest"
+	}
+
+	logger.Error().
+		Str("error", getErr.Error()).
+		Str("details", uerr.Message).
+		Str("s3_code", uerr.Code).
+		Int("s3_statuscode", uerr.S3Status).
+		Int("http_statuscode", uerr.Status).
+		Str("s3_request_id", uerr.RequestID).
+		Str("s3_host_id", uerr.HostID).
+		Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
+	return uerr
+}
+
+// clientMessages - what clients are told along with each status.  The details of a
+// failure name buckets and keys, so they only go to the log.
+var clientMessages = map[int]string{
+	http.StatusForbidden:                    "access denied",
+	http.StatusNotFound:                     "object not found",
+	http.StatusRequestedRangeNotSatisfiable: "requested range not satisfiable",
+	http.StatusBadGateway:                   "upstream request failed",
+	http.StatusServiceUnavailable:           "temporarily unavailable, retry later",
+	http.StatusGatewayTimeout:               "upstream request timed out",
+}
+
+// clientMessage - the message sent to clients along with status
+func clientMessage(status int) string {
+	if msg, ok := clientMessages[status]; ok {
+		return msg
+	}
+	return http.StatusText(status)
+}
+
+// errorBody - the JSON document returned to the client along with an error status
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeUpstreamError - sends the translated error back to the client, with the extra
+// headers some statuses call for.  HEAD requests only get the headers.
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, uerr *upstreamError) {
+	switch uerr.Status {
+	case http.StatusServiceUnavailable:
+		w.Header().Set("Retry-After", slowDownRetryAfter)
+	case http.StatusRequestedRangeNotSatisfiable:
+		if _, err := strconv.ParseInt(uerr.ObjectSize, 10, 64); err == nil {
+			w.Header().Set("Content-Range", "bytes */"+uerr.ObjectSize)
+		}
+	}
+
+	if r.Method == "HEAD" {
+		w.WriteHeader(uerr.Status)
+		return
+	}
+
+	body, _ := json.Marshal(&errorBody{
+		Code:      uerr.Code,
+		Message:   clientMessage(uerr.Status),
+		RequestID: uerr.RequestID,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)+1))
+	w.WriteHeader(uerr.Status)
+	w.Write(append(body, '\n'))
+}
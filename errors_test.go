@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/rs/zerolog/log"
+)
+
+func s3ErrorResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"X-Amz-Request-Id": {"header-request-id"}, "X-Amz-Id-2": {"header-host-id"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestParseS3ErrorResponse(t *testing.T) {
+	cases := []struct {
+		s3Status   int
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{404, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><RequestId>4442587FB7D0A2F9</RequestId><HostId>abc</HostId></Error>`, 404, "NoSuchKey"},
+		{403, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`, 403, "AccessDenied"},
+		{503, `<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`, 503, "SlowDown"},
+		{416, `<Error><Code>InvalidRange</Code><Message>The requested range is not satisfiable</Message><ActualObjectSize>1234</ActualObjectSize></Error>`, 416, "InvalidRange"},
+		{500, `<Error><Code>InternalError</Code><Message>We encountered an internal error.</Message></Error>`, 502, "InternalError"},
+		{404, ``, 404, "NotFound"},
+		{400, `not xml`, 400, ""},
+	}
+
+	for _, c := range cases {
+		uerr := parseS3ErrorResponse(s3ErrorResponse(c.s3Status, c.body))
+		if uerr.Status != c.wantStatus || uerr.Code != c.wantCode {
+			t.Errorf("%d %q: got %d/%q, want %d/%q", c.s3Status, c.body, uerr.Status, uerr.Code, c.wantStatus, c.wantCode)
+		}
+	}
+
+	uerr := parseS3ErrorResponse(s3ErrorResponse(404, cases[0].body))
+	if uerr.RequestID != "4442587FB7D0A2F9" || uerr.HostID != "abc" {
+		t.Fatalf("request ids not taken from the body: %+v", uerr)
+	}
+	uerr = parseS3ErrorResponse(s3ErrorResponse(404, ""))
+	if uerr.RequestID != "header-request-id" || uerr.HostID != "header-host-id" {
+		t.Fatalf("request ids not taken from the headers: %+v", uerr)
+	}
+}
+
+func TestWriteUpstreamError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeUpstreamError(w, httptest.NewRequest("GET", "/x", nil),
+		parseS3ErrorResponse(s3ErrorResponse(416, `<Error><Code>InvalidRange</Code><ActualObjectSize>1234</ActualObjectSize></Error>`)))
+	if w.Code != 416 || w.Header().Get("Content-Range") != "bytes */1234" {
+		t.Fatalf("InvalidRange: unexpected response %d %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	writeUpstreamError(w, httptest.NewRequest("GET", "/x", nil),
+		parseS3ErrorResponse(s3ErrorResponse(503, `<Error><Code>SlowDown</Code><RequestId>REQ</RequestId></Error>`)))
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("SlowDown: unexpected response %d %v", w.Code, w.Header())
+	}
+	var body errorBody
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != "SlowDown" || body.RequestID != "REQ" {
+		t.Fatalf("SlowDown: unexpected body %q (%v)", w.Body.String(), err)
+	}
+
+	// the details of a failure stay in the log
+	w = httptest.NewRecorder()
+	writeUpstreamError(w, httptest.NewRequest("GET", "/x", nil),
+		&upstreamError{Status: 404, Code: "NoSuchKey", Message: "object with key /show/x.ts does not exist in bucket svod"})
+	if strings.Contains(w.Body.String(), "svod") || strings.Contains(w.Body.String(), "/show/x.ts") {
+		t.Fatalf("NoSuchKey: the body gives details away: %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	writeUpstreamError(w, httptest.NewRequest("HEAD", "/x", nil), &upstreamError{Status: 404, Code: "NotFound"})
+	if w.Code != 404 || w.Body.Len() != 0 {
+		t.Fatalf("HEAD: unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyS3Media_SDKInvalidRange(t *testing.T) {
+	a := newMockApp(map[string]interface{}{"svod/show/seg1.ts": []byte("segment")})
+	w := serveMock(a, "GET", "/show/seg1.ts", http.Header{"Range": {"bytes=100-"}})
+	if w.Code != 416 || w.Header().Get("Content-Range") != "bytes */7" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+}
+
+func TestClassifyFetchError_Timeout(t *testing.T) {
+	a := &App{}
+	uerr := a.classifyFetchError(&attemptTimeoutError{attempt: 1}, "bucket", "/key", &log.Logger)
+	if uerr.Status != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", uerr.Status)
+	}
+}
+
+func TestProxyS3Media_SDKTimeout(t *testing.T) {
+	// how the SDK reports an HTTP client timeout
+	timeout := awserr.New(request.ErrCodeRequestError, "send request failed", &url.Error{
+		Op:  "Get",
+		URL: "https://svod.s3.amazonaws.com/show/seg1.ts",
+		Err: &net.DNSError{Err: "i/o timeout", Name: "svod.s3.amazonaws.com", IsTimeout: true},
+	})
+	a := newMockApp(map[string]interface{}{"svod/show/seg1.ts": timeout})
+	if w := serveMock(a, "GET", "/show/seg1.ts", nil); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d %q", w.Code, w.Body.String())
+	}
+}
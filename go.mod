@@ -5,7 +5,6 @@ go 1.16
 require (
 	github.com/aws/aws-sdk-go v1.40.6
 	github.com/crunchyroll/evs-common v0.0.0-20170228001437-6a7a36a07b65
-	github.com/crunchyroll/go-aws-auth v0.0.0-20180622175118-17a4470a3046
 	github.com/newrelic/go-agent/v3 v3.15.2
 	github.com/onsi/ginkgo/v2 v2.1.3
 	github.com/onsi/gomega v1.19.0
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// headerPolicy - a compiled headers config section: which S3 response headers
+// reach the client, under what name, and what is added to them
+type headerPolicy struct {
+	forward      map[string]bool   // canonical names
+	prefixes     []string          // canonical name prefixes, from entries ending in *
+	rename       map[string]string // canonical S3 name -> name sent to the client
+	set          http.Header       // added to every response, routes can override them
+	cacheControl []cacheControlRule
+}
+
+// cacheControlRule - the Cache-Control sent for paths matching pattern
+type cacheControlRule struct {
+	pattern string
+	value   string
+}
+
+// matches - whether the request path p matches the rule.  Patterns with a / are
+// matched against the whole path, others against its last element, so *.m3u8
+// covers playlists anywhere.
+func (r *cacheControlRule) matches(p string) bool {
+	if !strings.Contains(r.pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(r.pattern, p)
+	return ok
+}
+
+// newHeaderPolicy - validates and compiles the headers section
+func newHeaderPolicy(c *headersConfig) (*headerPolicy, error) {
+	p := &headerPolicy{
+		forward: make(map[string]bool, len(c.Forward)),
+		rename:  make(map[string]string, len(c.Rename)),
+		set:     make(http.Header, len(c.Set)),
+	}
+	for _, name := range c.Forward {
+		switch {
+		case name == "" || name == "*":
+			return nil, fmt.Errorf("headers.forward: %q is not a header name or prefix", name)
+		case strings.HasSuffix(name, "*"):
+			p.prefixes = append(p.prefixes, http.CanonicalHeaderKey(strings.TrimSuffix(name, "*")))
+		default:
+			p.forward[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	for from, to := range c.Rename {
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("headers.rename: %q -> %q needs both names", from, to)
+		}
+		p.rename[http.CanonicalHeaderKey(from)] = to
+	}
+	for name, v := range c.Set {
+		p.set.Set(name, v)
+	}
+	for i, cc := range c.CacheControl {
+		if _, err := path.Match(cc.Path, ""); err != nil || cc.Path == "" {
+			return nil, fmt.Errorf("headers.cache_control[%d]: bad path pattern %q", i, cc.Path)
+		}
+		p.cacheControl = append(p.cacheControl, cacheControlRule{pattern: cc.Path, value: cc.Value})
+	}
+	return p, nil
+}
+
+// forwards - whether the S3 header name, in canonical form, is passed on as it is
+func (p *headerPolicy) forwards(name string) bool {
+	if p.forward[name] {
+		return true
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// write - sets the headers of the response to a request for urlPath on rt, given
+// the S3 response headers in src.  Renamed headers are only sent under their new
+// name.  The static headers of the section and then of the route come next, and a
+// matching cache_control rule has the last word on Cache-Control.
+func (p *headerPolicy) write(dst, src http.Header, rt *route, urlPath string) {
+	for name, values := range src {
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+		if to, ok := p.rename[name]; ok {
+			dst.Set(to, values[0])
+		} else if p.forwards(name) {
+			dst.Set(name, values[0])
+		}
+	}
+	for name := range p.set {
+		dst.Set(name, p.set.Get(name))
+	}
+	if rt != nil {
+		for name := range rt.headers {
+			dst.Set(name, rt.headers.Get(name))
+		}
+	}
+	for i := range p.cacheControl {
+		if p.cacheControl[i].matches(urlPath) {
+			dst.Set("Cache-Control", p.cacheControl[i].value)
+			break
+		}
+	}
+}
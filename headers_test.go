@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// metadataBackend - adds the headers S3 sends for user metadata and a few others
+// the mock doesn't know about
+type metadataBackend struct {
+	s3Backend
+}
+
+func (b *metadataBackend) Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	resp, err := b.s3Backend.Fetch(ctx, req, logger)
+	if err == nil && resp.StatusCode < 300 {
+		resp.Header.Set("X-Amz-Meta-Duration", "42.5")
+		resp.Header.Set("X-Amz-Meta-Codec", "h264")
+		resp.Header.Set("X-Amz-Request-Id", "mock-request-id")
+		resp.Header.Set("Content-Disposition", `attachment; filename="seg.ts"`)
+		resp.Header.Set("Cache-Control", "max-age=3600")
+	}
+	return resp, err
+}
+
+// newHeadersMockApp - a mock app sending headers as set up in hc, with a /show/
+// route of its own carrying routeHeaders
+func newHeadersMockApp(t *testing.T, hc headersConfig, routeHeaders map[string]string) *App {
+	t.Helper()
+	a := newMockApp(map[string]interface{}{
+		"svod/show/seg.ts":     []byte("0123456789"),
+		"svod/show/index.m3u8": []byte("#EXTM3U"),
+	})
+	withConfig(t, a, func(c *Config) {
+		c.Headers = hc
+		c.Routes = []routeConfig{{Prefix: "/show/", Bucket: "svod", KeyPrefix: "/show", Headers: routeHeaders}}
+	})
+	rc := *a.snapshot()
+	rc.backend = &metadataBackend{s3Backend: rc.backend}
+	rc.objects = rc.backend
+	a.setSnapshot(&rc)
+	return a
+}
+
+func TestProxyS3Media_Headers(t *testing.T) {
+	a := newHeadersMockApp(t, headersConfig{
+		Forward:      []string{"ETag", "content-disposition", "x-amz-meta-*"},
+		Rename:       map[string]string{"x-amz-meta-duration": "X-Media-Duration"},
+		Set:          map[string]string{"Timing-Allow-Origin": "*", "X-Served-By": "s3-helper"},
+		CacheControl: []cacheControlConfig{{Path: "*.m3u8", Value: "max-age=2"}},
+	}, map[string]string{"X-Served-By": "show-route"})
+
+	for _, method := range []string{"GET", "HEAD"} {
+		w := serveMock(a, method, "/show/seg.ts", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected %d", method, w.Code)
+		}
+		for name, want := range map[string]string{
+			"Etag":                "this-is-a-dummy-etag",
+			"Content-Disposition": `attachment; filename="seg.ts"`,
+			"X-Amz-Meta-Codec":    "h264",
+			"X-Media-Duration":    "42.5",
+			"X-Amz-Meta-Duration": "",
+			"X-Amz-Request-Id":    "",
+			"Cache-Control":       "",
+			"Last-Modified":       "",
+			"Timing-Allow-Origin": "*",
+			"X-Served-By":         "show-route",
+			"Content-Length":      "10",
+		} {
+			if got := w.Header().Get(name); got != want {
+				t.Errorf("%s: expected %s %q, got %q", method, name, want, got)
+			}
+		}
+	}
+
+	w := serveMock(a, "GET", "/show/index.m3u8", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "max-age=2" {
+		t.Fatalf("playlist: unexpected %d with Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+
+	// the headers section applies to 304s as well
+	w = serveMock(a, "GET", "/show/index.m3u8", http.Header{"If-None-Match": {"this-is-a-dummy-etag"}})
+	if w.Code != http.StatusNotModified || w.Header().Get("Cache-Control") != "max-age=2" || w.Header().Get("Timing-Allow-Origin") != "*" {
+		t.Fatalf("304: unexpected %d %v", w.Code, w.Header())
+	}
+}
+
+func TestNewHeaderPolicy(t *testing.T) {
+	for _, hc := range []headersConfig{
+		{Forward: []string{"*"}},
+		{Forward: []string{""}},
+		{Rename: map[string]string{"x-amz-meta-duration": ""}},
+		{CacheControl: []cacheControlConfig{{Path: "[", Value: "no-cache"}}},
+		{CacheControl: []cacheControlConfig{{Value: "no-cache"}}},
+	} {
+		if _, err := newHeaderPolicy(&hc); err == nil {
+			t.Errorf("%+v: expected an error", hc)
+		}
+	}
+
+	p, err := newHeaderPolicy(&headersConfig{CacheControl: []cacheControlConfig{
+		{Path: "/live/*", Value: "no-cache"},
+		{Path: "*.ts", Value: "max-age=86400"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"/live/index.m3u8": "no-cache",
+		"/live/seg1.ts":    "no-cache",
+		"/vod/a/b/seg1.ts": "max-age=86400",
+		"/vod/index.m3u8":  "",
+	} {
+		h := make(http.Header)
+		p.write(h, http.Header{"Cache-Control": {"max-age=60"}}, nil, path)
+		if got := h.Get("Cache-Control"); got != want {
+			t.Errorf("%s: expected %q, got %q", path, want, got)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Prefixes of the listen addresses that aren't host:port
+const (
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd"
+)
+
+// listenAll - opens every address of a comma separated list, see listen
+func listenAll(addrs string, sock *socketConfig) ([]net.Listener, error) {
+	var all []net.Listener
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		lns, err := listen(addr, sock)
+		if err != nil {
+			for _, ln := range all {
+				ln.Close()
+			}
+			return nil, err
+		}
+		all = append(all, lns...)
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("no addresses to listen on in %q", addrs)
+	}
+	return all, nil
+}
+
+// listen - opens addr, which is one of
+//
+//	host:port        a TCP socket
+//	unix:/path       a unix socket, created with the mode and owner of sock
+//	systemd          every socket passed by systemd socket activation
+//	systemd:name     the sockets passed by systemd under FileDescriptorName=name
+func listen(addr string, sock *socketConfig) ([]net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		ln, err := listenUnix(strings.TrimPrefix(addr, unixPrefix), sock)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	case addr == systemdPrefix || strings.HasPrefix(addr, systemdPrefix+":"):
+		return systemdListeners(strings.TrimPrefix(strings.TrimPrefix(addr, systemdPrefix), ":"))
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{ln}, nil
+}
+
+// listenUnix - listens on a unix socket at path.  A socket left behind by a previous
+// run that crashed is removed first; one that still accepts connections is not.
+func listenUnix(path string, sock *socketConfig) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if sock.Mode != "" {
+		mode, err := strconv.ParseUint(sock.Mode, 8, 32)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("unix_socket.mode: bad mode %q", sock.Mode)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if sock.Owner != "" || sock.Group != "" {
+		uid, gid, err := lookupOwner(sock.Owner, sock.Group)
+		if err == nil {
+			err = os.Chown(path, uid, gid)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket - removes the socket at path unless something is listening on it
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("can't tell whether %s is stale: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+// lookupOwner - resolves user and group names (or ids) for chown, -1 leaves one as is
+func lookupOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		id := owner
+		if _, err := strconv.Atoi(owner); err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return 0, 0, fmt.Errorf("unix_socket.owner: %v", err)
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+	if group != "" {
+		id := group
+		if _, err := strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, fmt.Errorf("unix_socket.group: %v", err)
+			}
+			id = g.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+	return uid, gid, nil
+}
+
+// systemd passes sockets starting at this file descriptor, see sd_listen_fds(3)
+const systemdFirstFD = 3
+
+var (
+	systemdOnce sync.Once
+	systemdLns  map[string][]net.Listener // by FileDescriptorName
+	systemdErr  error
+)
+
+// systemdListeners - the sockets systemd passed under name, all of them if name is ""
+func systemdListeners(name string) ([]net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdLns, systemdErr = inheritedListeners(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"),
+			os.Getenv("LISTEN_FDNAMES"), systemdFirstFD)
+		// our children must not think the sockets are meant for them
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+
+	var lns []net.Listener
+	for n, l := range systemdLns {
+		if name == "" || n == name {
+			lns = append(lns, l...)
+		}
+	}
+	if len(lns) == 0 {
+		if name == "" {
+			return nil, errors.New("no sockets passed by systemd")
+		}
+		return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+	}
+	return lns, nil
+}
+
+// inheritedListeners - wraps the file descriptors described by the LISTEN_* variables
+func inheritedListeners(pid, fds, names string, firstFD int) (map[string][]net.Listener, error) {
+	if pid == "" || fds == "" {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return nil, fmt.Errorf("sockets passed by systemd are meant for pid %s", pid)
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad LISTEN_FDS %q", fds)
+	}
+	fdNames := strings.Split(names, ":")
+
+	lns := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := firstFD + i
+		name := "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener works on a dup
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s) passed by systemd: %v", fd, name, err)
+		}
+		lns[name] = append(lns[name], ln)
+	}
+	return lns, nil
+}
+
+// listenerAddrs - the addresses of lns, for logging
+func listenerAddrs(lns []net.Listener) string {
+	addrs := make([]string, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.Addr().String()
+		if ln.Addr().Network() == "unix" {
+			addrs[i] = unixPrefix + addrs[i]
+		}
+	}
+	return strings.Join(addrs, ",")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3-helper.sock")
+	ln, err := listenUnix(path, &socketConfig{Mode: "0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", fi.Mode().Perm())
+	}
+
+	// a live socket is left alone
+	if _, err := listenUnix(path, &socketConfig{}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expected the socket to be in use, got %v", err)
+	}
+
+	// a socket nobody listens on any more is replaced
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stale socket should still exist: %v", err)
+	}
+	ln, err = listenUnix(path, &socketConfig{})
+	if err != nil {
+		t.Fatalf("stale socket was not cleaned up: %v", err)
+	}
+	ln.Close()
+
+	// anything else is not ours to remove
+	file := filepath.Join(t.TempDir(), "file")
+	ioutil.WriteFile(file, nil, 0644)
+	if _, err := listenUnix(file, &socketConfig{}); err == nil {
+		t.Fatal("expected an error for a regular file")
+	}
+	if _, err := listenUnix(filepath.Join(t.TempDir(), "s"), &socketConfig{Mode: "rw"}); err == nil {
+		t.Fatal("expected an error for a bad mode")
+	}
+}
+
+func TestServe_MultipleListeners(t *testing.T) {
+	a := newMockApp(map[string]interface{}{"svod/show/manifest.json": "{}"})
+	path := filepath.Join(t.TempDir(), "s3-helper.sock")
+	server := serve("127.0.0.1:0, unix:"+path, &socketConfig{}, http.HandlerFunc(a.proxyS3Media))
+	defer server.Close()
+
+	addrs := strings.Split(server.Addr, ",")
+	if len(addrs) != 2 || addrs[1] != "unix:"+path {
+		t.Fatalf("unexpected addresses %q", server.Addr)
+	}
+
+	resp, err := http.Get("http://" + addrs[0] + "/show/manifest.json")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("tcp: unexpected response %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err = client.Get("http://s3-helper/show/manifest.json")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("unix: unexpected response %v %v", resp, err)
+	}
+	resp.Body.Close()
+}
+
+func TestInheritedListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a descriptor of its own, like one passed by systemd: inheritedListeners closes
+	// it, which must not leave f to close whatever reuses the number later
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	if _, err := inheritedListeners("1", "1", "", fd); err == nil {
+		t.Fatal("expected sockets for another pid to be refused")
+	}
+	lns, err := inheritedListeners(pid, "1", "http", fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns["http"]) != 1 || lns["http"][0].Addr().String() != tcp.Addr().String() {
+		t.Fatalf("unexpected listeners %v", lns)
+	}
+	lns["http"][0].Close()
+}
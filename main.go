@@ -22,6 +22,16 @@ const configFileDefault = "/etc/s3-helper.yml"
 var conf Config
 var progName string
 
+// Accepted values for logging.level
+var logLevels = map[string]zerolog.Level{
+	"debug": zerolog.DebugLevel,
+	"info":  zerolog.InfoLevel,
+	"warn":  zerolog.WarnLevel,
+	"error": zerolog.ErrorLevel,
+	"fatal": zerolog.FatalLevel,
+	"panic": zerolog.PanicLevel,
+}
+
 func main() {
 	zerolog.TimeFieldFormat = ""
 	rand.Seed(time.Now().UnixNano())
@@ -38,28 +48,30 @@ func main() {
 	}
 	log.Info().Msg(fmt.Sprintf("Loaded config from %s", *configFile))
 
-	if conf.Logging.Level == "error" {
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-	} else if conf.Logging.Level == "warn" {
-		zerolog.SetGlobalLevel(zerolog.WarnLevel)
-	} else if conf.Logging.Level == "info" {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	} else if conf.Logging.Level == "debug" {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else if conf.Logging.Level == "panic" {
-		zerolog.SetGlobalLevel(zerolog.PanicLevel)
-	} else if conf.Logging.Level == "fatal" {
-		zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	if level, ok := logLevels[conf.Logging.Level]; ok {
+		zerolog.SetGlobalLevel(level)
 	} else {
 		zerolog.SetGlobalLevel(zerolog.WarnLevel)
 		log.Error().Msg(fmt.Sprintf("Bad loglevel given %s - defaulting to Warn level", conf.Logging.Level))
+		conf.Logging.Level = "warn"
 	}
 
+	// registered before serving, so that a SIGTERM sent as soon as the app is up
+	// drains it rather than killing it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
+
 	api := App{}
 	api.Initialize(pprofFlag, conf.S3Region)
 	api.Run(conf.Listen)
 
-	stopSignals := make(chan os.Signal, 1)
-	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
-	<-stopSignals
+	for sig := range signals {
+		log.Info().Msg(fmt.Sprintf("Received %v", sig))
+		if sig == syscall.SIGHUP {
+			api.Reload(*configFile)
+			continue
+		}
+		api.Shutdown(conf.Shutdown.Delay, conf.Shutdown.Timeout)
+		return
+	}
 }
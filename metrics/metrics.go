@@ -0,0 +1,383 @@
+// Package metrics is a minimal Prometheus instrumentation library: counters, gauges
+// and histograms with labels, exposed in the Prometheus text format.  It has no
+// dependencies outside the standard library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets - default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector - a metric family that can write itself out
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry - a set of metric families served together
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+// NewRegistry - creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[c.name()] {
+		panic(fmt.Sprintf("metrics: %s registered twice", c.name()))
+	}
+	r.names[c.name()] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// Expose - writes every registered metric in the Prometheus text format
+func (r *Registry) Expose(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// ServeHTTP - serves the registry, e.g. on /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Expose(w)
+}
+
+// value - a float64 updated atomically
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// family - the series of one metric, keyed by their label values
+type family struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	metric      interface{} // *Counter, *Gauge or *Histogram
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		series:     make(map[string]*series),
+	}
+}
+
+func (f *family) name() string { return f.metricName }
+
+// get - returns the series for values, creating it with create if needed
+func (f *family) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.metricName, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return s.metric
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.series[key]; ok {
+		return s.metric
+	}
+	s = &series{labelValues: append([]string(nil), values...), metric: create()}
+	f.series[key] = s
+	return s.metric
+}
+
+// sorted - the series in a stable order
+func (f *family) sorted() []*series {
+	f.mu.RLock()
+	out := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		out = append(out, s)
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].labelValues, "\xff") < strings.Join(out[j].labelValues, "\xff")
+	})
+	return out
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.metricName, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.metricName, f.kind)
+}
+
+// Counter - a value that only goes up
+type Counter struct {
+	v value
+}
+
+// Inc - adds one
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add - adds delta, which must not be negative
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.v.add(delta)
+}
+
+// Value - the current count
+func (c *Counter) Value() float64 { return c.v.get() }
+
+// CounterVec - counters partitioned by label values
+type CounterVec struct {
+	*family
+}
+
+// NewCounterVec - registers a counter family
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newFamily(name, help, "counter", labels)}
+	r.register(v)
+	return v
+}
+
+// WithLabelValues - the counter for the given label values, in the order the labels were declared
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		writeSample(w, v.metricName, v.labels, s.labelValues, "", "", s.metric.(*Counter).Value())
+	}
+}
+
+// Gauge - a value that can go up and down
+type Gauge struct {
+	v value
+}
+
+// Set - sets the gauge to f
+func (g *Gauge) Set(f float64) { g.v.set(f) }
+
+// Add - adds delta, which may be negative
+func (g *Gauge) Add(delta float64) { g.v.add(delta) }
+
+// Inc - adds one
+func (g *Gauge) Inc() { g.v.add(1) }
+
+// Dec - subtracts one
+func (g *Gauge) Dec() { g.v.add(-1) }
+
+// Value - the current value
+func (g *Gauge) Value() float64 { return g.v.get() }
+
+// GaugeVec - gauges partitioned by label values
+type GaugeVec struct {
+	*family
+}
+
+// NewGaugeVec - registers a gauge family
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newFamily(name, help, "gauge", labels)}
+	r.register(v)
+	return v
+}
+
+// NewGauge - registers a gauge without labels
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).WithLabelValues()
+}
+
+// WithLabelValues - the gauge for the given label values, in the order the labels were declared
+func (v *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return v.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (v *GaugeVec) write(w io.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		writeSample(w, v.metricName, v.labels, s.labelValues, "", "", s.metric.(*Gauge).Value())
+	}
+}
+
+// gaugeFunc - a gauge whose value is computed when it is collected
+type gaugeFunc struct {
+	metricName string
+	help       string
+	kind       string
+	fn         func() float64
+}
+
+// NewGaugeFunc - registers a gauge whose value is fn() at collection time
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{metricName: name, help: help, kind: "gauge", fn: fn})
+}
+
+// NewCounterFunc - registers a counter whose value is fn() at collection time
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{metricName: name, help: help, kind: "counter", fn: fn})
+}
+
+func (g *gaugeFunc) name() string { return g.metricName }
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.metricName, escapeHelp(g.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", g.metricName, g.kind)
+	writeSample(w, g.metricName, nil, nil, "", "", g.fn())
+}
+
+// Histogram - counts observations into buckets
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64 // one per bucket, plus +Inf
+	sum         value
+	count       uint64
+}
+
+// Observe - records one observation
+func (h *Histogram) Observe(f float64) {
+	i := sort.SearchFloat64s(h.upperBounds, f)
+	atomic.AddUint64(&h.counts[i], 1)
+	h.sum.add(f)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Count - the number of observations so far
+func (h *Histogram) Count() uint64 { return atomic.LoadUint64(&h.count) }
+
+// HistogramVec - histograms partitioned by label values
+type HistogramVec struct {
+	*family
+	buckets []float64
+}
+
+// NewHistogramVec - registers a histogram family; buckets are the upper bounds,
+// DefBuckets if nil
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	v := &HistogramVec{family: newFamily(name, help, "histogram", labels), buckets: buckets}
+	r.register(v)
+	return v
+}
+
+// WithLabelValues - the histogram for the given label values, in the order the labels were declared
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.get(values, func() interface{} {
+		return &Histogram{upperBounds: v.buckets, counts: make([]uint64, len(v.buckets)+1)}
+	}).(*Histogram)
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		h := s.metric.(*Histogram)
+		var cumulative uint64
+		for i, bound := range h.upperBounds {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			writeSample(w, v.metricName+"_bucket", v.labels, s.labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(h.upperBounds)])
+		writeSample(w, v.metricName+"_bucket", v.labels, s.labelValues, "le", "+Inf", float64(cumulative))
+		writeSample(w, v.metricName+"_sum", v.labels, s.labelValues, "", "", h.sum.get())
+		writeSample(w, v.metricName+"_count", v.labels, s.labelValues, "", "", float64(cumulative))
+	}
+}
+
+// writeSample - writes one line, with an optional extra label (le for histogram buckets)
+func writeSample(w io.Writer, name string, labels, values []string, extraLabel, extraValue string, f float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", l, escapeLabel(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(f))
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry_Exposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Requests.", "method", "path")
+	c.WithLabelValues("GET", `/a"b\c`).Inc()
+	c.WithLabelValues("GET", `/a"b\c`).Add(2)
+	c.WithLabelValues("HEAD", "/").Inc()
+	g := r.NewGauge("test_in_flight", "In flight.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{1, 0.1}, "method")
+	h.WithLabelValues("GET").Observe(0.05)
+	h.WithLabelValues("GET").Observe(0.5)
+	h.WithLabelValues("GET").Observe(5)
+	r.NewGaugeFunc("test_func", "Computed.", func() float64 { return 42 })
+
+	var buf bytes.Buffer
+	r.Expose(&buf)
+	want := `# HELP test_func Computed.
+# TYPE test_func gauge
+test_func 42
+# HELP test_in_flight In flight.
+# TYPE test_in_flight gauge
+test_in_flight 1
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{method="GET",le="0.1"} 1
+test_latency_seconds_bucket{method="GET",le="1"} 2
+test_latency_seconds_bucket{method="GET",le="+Inf"} 3
+test_latency_seconds_sum{method="GET"} 5.55
+test_latency_seconds_count{method="GET"} 3
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",path="/a\"b\\c"} 3
+test_requests_total{method="HEAD",path="/"} 1
+`
+	if buf.String() != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.").WithLabelValues().Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "\ntest_total 1\n") {
+		t.Fatalf("counter missing from %q", w.Body.String())
+	}
+}
+
+func TestCounter_Concurrent(t *testing.T) {
+	c := NewRegistry().NewCounterVec("test_total", "Test.", "worker")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.WithLabelValues("w").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	if v := c.WithLabelValues("w").Value(); v != 8000 {
+		t.Fatalf("expected 8000, got %v", v)
+	}
+}
+
+func TestRegistry_Misuse(t *testing.T) {
+	for name, f := range map[string]func(){
+		"duplicate name":   func() { r := NewRegistry(); r.NewGauge("x", ""); r.NewGauge("x", "") },
+		"label count":      func() { NewRegistry().NewCounterVec("x", "", "a").WithLabelValues("1", "2") },
+		"negative counter": func() { NewRegistry().NewCounterVec("x", "").WithLabelValues().Add(-1) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
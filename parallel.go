@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// covers - whether length bytes are worth a parallel download
+func (c *parallelDownloadConfig) covers(length int64) bool {
+	return c.MinSizeMB > 0 && length >= c.MinSizeMB<<20
+}
+
+// memoryBudget - the bytes all parallel downloads may buffer together.  A download
+// reserves what it buffers at most before it starts, and falls back to a single
+// streamed GET if that's more than is left.
+type memoryBudget struct {
+	mu   sync.Mutex
+	left int64
+}
+
+// newMemoryBudget - a budget of mb megabytes, nil for no limit if mb is 0
+func newMemoryBudget(mb int64) *memoryBudget {
+	if mb <= 0 {
+		return nil
+	}
+	return &memoryBudget{left: mb << 20}
+}
+
+// reserve - takes n bytes off the budget if that many are left.  A nil budget
+// always has them.
+func (b *memoryBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.left {
+		return false
+	}
+	b.left -= n
+	return true
+}
+
+// release - gives back n bytes taken by reserve
+func (b *memoryBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.left += n
+	b.mu.Unlock()
+}
+
+// buffered - the most a parallel download of rng buffers: concurrency parts, or
+// fewer if rng doesn't have that many
+func (c *parallelDownloadConfig) buffered(rng byteRange) int64 {
+	partSize := c.PartSizeMB << 20
+	parts := (rng.length() + partSize - 1) / partSize
+	if parts > int64(c.Concurrency) {
+		parts = int64(c.Concurrency)
+	}
+	return parts * partSize
+}
+
+// probe - the Range a GET for method with the Range header header is sent to S3
+// with: the first part of what the client asked for, so that the response gives
+// the size of the object without fetching more than a part.  want is the range
+// asked for, the whole object if there is no header.  Suffix and multiple ranges
+// aren't probed.
+func (c *parallelDownloadConfig) probe(method, header string) (probe string, want rangeSpec, ok bool) {
+	if method != "GET" || c.MinSizeMB <= 0 {
+		return "", rangeSpec{}, false
+	}
+	want = rangeSpec{first: 0, last: -1}
+	if header != "" {
+		specs, err := parseRanges(header)
+		if err != nil || len(specs) != 1 || specs[0].first < 0 {
+			return "", rangeSpec{}, false
+		}
+		want = specs[0]
+	}
+	last := want.first + c.PartSizeMB<<20 - 1
+	if want.last >= 0 && want.last < last {
+		last = want.last
+	}
+	return fmt.Sprintf("bytes=%d-%d", want.first, last), want, true
+}
+
+// resolve - spec, a range that isn't a suffix, for an object of size bytes
+func (spec rangeSpec) resolve(size int64) byteRange {
+	if spec.last < 0 || spec.last >= size {
+		return byteRange{start: spec.first, end: size - 1}
+	}
+	return byteRange{start: spec.first, end: spec.last}
+}
+
+// unsatisfiable - whether S3 answered with a 416, as it does for a range of an
+// empty object
+func unsatisfiable(resp *http.Response, err error) bool {
+	if err != nil {
+		return errorStatus(err) == http.StatusRequestedRangeNotSatisfiable
+	}
+	return resp.StatusCode == http.StatusRequestedRangeNotSatisfiable
+}
+
+// responseRange - the range of the object a 200 or 206 from S3 holds, and the size
+// of the object
+func responseRange(resp *http.Response) (rng byteRange, size int64, ok bool) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return byteRange{start: 0, end: resp.ContentLength - 1}, resp.ContentLength, resp.ContentLength > 0
+	case http.StatusPartialContent:
+		n, _ := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &rng.start, &rng.end, &size)
+		return rng, size, n == 3 && rng.length() == resp.ContentLength
+	}
+	return rng, 0, false
+}
+
+// downloadPart - one part of a parallel download, buffered in memory
+type downloadPart struct {
+	rng  byteRange
+	data []byte
+	err  error
+	done chan struct{} // closed once data or err is set
+}
+
+// serveParallel - answers a request for rng of an object of size bytes, described
+// by head, by fetching it from S3 as parts of part_size_mb over up to concurrency
+// connections at once.  The parts are sent in order as they complete.  At most
+// concurrency parts are fetched or waiting to be sent at a time, which bounds the
+// memory used.  A part that fails is retried on its own, up to part_retries times.
+// If first is set, the first part, e.g. the body of the probe, is read from it
+// rather than fetched.
+func (a *App) serveParallel(w http.ResponseWriter, ctx context.Context, rc *runtimeConfig, req objectRequest,
+	head *http.Response, header http.Header, rng byteRange, size int64, first io.ReadCloser,
+	logger *zerolog.Logger) (written int64, started bool, err error) {
+	c := &rc.conf.ParallelDownload
+	partSize := c.PartSizeMB << 20
+
+	var parts []*downloadPart
+	for start := rng.start; start <= rng.end; start += partSize {
+		end := start + partSize - 1
+		if end > rng.end {
+			end = rng.end
+		}
+		parts = append(parts, &downloadPart{rng: byteRange{start: start, end: end}, done: make(chan struct{})})
+	}
+
+	if first != nil {
+		// readFirstPart closes first, and has to be done with it before the caller
+		// closes it again
+		defer func() { <-parts[0].done }()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	slots := make(chan struct{}, c.Concurrency)
+	next := parts
+	if first != nil {
+		slots <- struct{}{}
+		go a.readFirstPart(ctx, rc.backend, req, parts[0], size, c.PartRetries, first, logger)
+		next = parts[1:]
+	}
+	go func() {
+		for _, part := range next {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go a.fetchPart(ctx, rc.backend, req, part, size, c.PartRetries, logger)
+		}
+	}()
+
+	a.countMetric("s3-helper:paralleldownload", req.Bucket)
+	for i, part := range parts {
+		select {
+		case <-part.done:
+		case <-ctx.Done():
+			return written, started, ctx.Err()
+		}
+		if part.err != nil {
+			return written, started, part.err
+		}
+		if i == 0 {
+			// the first part came through, so S3 is up to it
+			writeRangeHeader(w, head, header, rng, size)
+			started = true
+		}
+		n, err := w.Write(part.data)
+		written += int64(n)
+		part.data = nil
+		<-slots
+		if err != nil {
+			return written, started, err
+		}
+	}
+	return written, started, nil
+}
+
+// fetchPart - gets part from backend into memory, retrying up to retries times
+func (a *App) fetchPart(ctx context.Context, backend s3Backend, req objectRequest, part *downloadPart,
+	size int64, retries int, logger *zerolog.Logger) {
+	defer close(part.done)
+	req.Range = part.rng.header(size)
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		part.data, retryable, part.err = readPart(ctx, backend, &req, part.rng, size, logger)
+		if part.err == nil || !retryable || attempt >= retries || ctx.Err() != nil {
+			return
+		}
+		a.countMetric("s3-helper:partretry", req.Bucket)
+		logger.Warn().
+			Str("error", part.err.Error()).
+			Str("part", req.Range).
+			Int("attempt", attempt+1).
+			Msg("s3:parallel - retrying part")
+	}
+}
+
+// readFirstPart - reads part off body, the response to the probe that found the
+// object worth a parallel download, then closes it.  Should body fail, part is fetched
+// like the others.
+func (a *App) readFirstPart(ctx context.Context, backend s3Backend, req objectRequest, part *downloadPart,
+	size int64, retries int, body io.ReadCloser, logger *zerolog.Logger) {
+	data := make([]byte, part.rng.length())
+	_, err := io.ReadFull(body, data)
+	body.Close()
+	if err != nil {
+		logger.Warn().
+			Str("error", err.Error()).
+			Msg("s3:parallel - refetching the first part")
+		a.fetchPart(ctx, backend, req, part, size, retries, logger)
+		return
+	}
+	part.data = data
+	close(part.done)
+}
+
+// readPart - one attempt at getting rng.  Failures that another attempt can't fix,
+// e.g. the object having changed, aren't retryable.
+func readPart(ctx context.Context, backend s3Backend, req *objectRequest, rng byteRange, size int64,
+	logger *zerolog.Logger) (data []byte, retryable bool, err error) {
+	resp, err := backend.Fetch(ctx, req, logger)
+	if err != nil {
+		status := errorStatus(err)
+		return nil, status == 0 || status >= 500, err
+	}
+	if err := checkPart(partResult{resp: resp}, rng, size); err != nil {
+		return nil, resp.StatusCode >= 500, err
+	}
+	defer resp.Body.Close()
+	data = make([]byte, rng.length())
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, true, err
+	}
+	return data, false, nil
+}
+
+// serveProbed - answers a request for rng of an object of size bytes that isn't
+// worth a parallel download, from probe, the response to the GET for its first
+// part.  The probe body is sent on, followed by the rest of rng if the probe didn't
+// hold all of it.
+func (a *App) serveProbed(w http.ResponseWriter, ctx context.Context, rc *runtimeConfig, req objectRequest,
+	probe *http.Response, header http.Header, probed, rng byteRange, size int64,
+	logger *zerolog.Logger) (written int64, started bool, err error) {
+	writeRangeHeader(w, probe, header, rng, size)
+	written, err = io.Copy(w, probe.Body)
+	if err != nil || probed.end >= rng.end {
+		return written, true, err
+	}
+
+	rest := byteRange{start: probed.end + 1, end: rng.end}
+	req.Range = rest.header(size)
+	resp, err := rc.objectBackend().Fetch(ctx, &req, logger)
+	if err := checkPart(partResult{resp: resp, err: err}, rest, size); err != nil {
+		return written, true, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(w, resp.Body)
+	return written + n, true, err
+}
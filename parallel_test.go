@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// partsBackend - tracks the GETs in flight, from Fetch until the body is closed,
+// and fails the first attempt at the ranges in failOnce
+type partsBackend struct {
+	s3Backend
+	fetches  int32
+	inFlight int32
+	maxSeen  int32
+
+	mu       sync.Mutex
+	failOnce map[string]bool
+	ranges   []string // of the GETs, in order
+}
+
+type closeFunc struct {
+	io.Reader
+	close func()
+}
+
+func (c *closeFunc) Close() error {
+	c.close()
+	return nil
+}
+
+func (b *partsBackend) Fetch(ctx context.Context, req *objectRequest, logger *zerolog.Logger) (*http.Response, error) {
+	atomic.AddInt32(&b.fetches, 1)
+	b.mu.Lock()
+	fail := b.failOnce[req.Range]
+	delete(b.failOnce, req.Range)
+	if req.Method == "GET" {
+		b.ranges = append(b.ranges, req.Range)
+	}
+	b.mu.Unlock()
+	if fail {
+		return nil, errors.New("connection reset by peer")
+	}
+	if req.Method != "GET" {
+		return b.s3Backend.Fetch(ctx, req, logger)
+	}
+
+	n := atomic.AddInt32(&b.inFlight, 1)
+	for {
+		max := atomic.LoadInt32(&b.maxSeen)
+		if n <= max || atomic.CompareAndSwapInt32(&b.maxSeen, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond) // let the others pile up
+	resp, err := b.s3Backend.Fetch(ctx, req, logger)
+	if err != nil {
+		atomic.AddInt32(&b.inFlight, -1)
+		return nil, err
+	}
+	var once sync.Once
+	body := resp.Body
+	resp.Body = &closeFunc{Reader: body, close: func() {
+		once.Do(func() { atomic.AddInt32(&b.inFlight, -1) })
+		body.Close()
+	}}
+	return resp, nil
+}
+
+// newParallelMockApp - a mock app downloading objects of 1MB or more in 1MB parts,
+// 2 at a time, retrying failed parts up to retries times
+func newParallelMockApp(t *testing.T, files map[string]interface{}, retries int) (*App, *partsBackend) {
+	return newPartsMockApp(t, files, parallelDownloadConfig{MinSizeMB: 1, PartSizeMB: 1, Concurrency: 2, PartRetries: retries})
+}
+
+// newPartsMockApp - a mock app with the parallel_download section pd
+func newPartsMockApp(t *testing.T, files map[string]interface{}, pd parallelDownloadConfig) (*App, *partsBackend) {
+	a := newMockApp(files)
+	withConfig(t, a, func(c *Config) { c.ParallelDownload = pd })
+	rc := *a.snapshot()
+	upstream := &partsBackend{s3Backend: rc.backend, failOnce: map[string]bool{}}
+	rc.backend, rc.objects = upstream, upstream
+	a.setSnapshot(&rc)
+	return a, upstream
+}
+
+func TestProxyS3Media_ParallelDownload(t *testing.T) {
+	movie := bytes.Repeat([]byte("0123456789abcdef"), 7<<16/2) // 3.5MB
+	a, upstream := newParallelMockApp(t, map[string]interface{}{
+		"svod/show/movie.mp4": movie,
+		"svod/show/small.mp4": []byte("tiny"),
+	}, 1)
+
+	w := serveMock(a, "GET", "/show/movie.mp4", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), movie) {
+		t.Fatalf("GET: unexpected %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 4 {
+		t.Fatalf("expected a GET giving the first part and 3 more parts, got %d requests", n)
+	}
+	if upstream.ranges[0] != "bytes=0-1048575" {
+		t.Fatalf("expected a probe for the first part, got %q", upstream.ranges[0])
+	}
+	if max := atomic.LoadInt32(&upstream.maxSeen); max > 2 {
+		t.Fatalf("expected at most 2 parts at a time, saw %d", max)
+	}
+
+	atomic.StoreInt32(&upstream.fetches, 0)
+	w = serveMock(a, "GET", "/show/movie.mp4", http.Header{"Range": {"bytes=100-2100099"}})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), movie[100:2100100]) {
+		t.Fatalf("range: unexpected %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 100-2100099/3670016" {
+		t.Fatalf("range: unexpected Content-Range %q", cr)
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 3 {
+		t.Fatalf("expected a GET giving the first part and 2 more parts, got %d requests", n)
+	}
+
+	// small objects are served from the probe
+	atomic.StoreInt32(&upstream.fetches, 0)
+	w = serveMock(a, "GET", "/show/small.mp4", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "tiny" || w.Header().Get("Content-Range") != "" {
+		t.Fatalf("small: unexpected %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 1 {
+		t.Fatalf("expected a single GET, got %d requests", n)
+	}
+}
+
+func TestProxyS3Media_ParallelDownloadProbe(t *testing.T) {
+	movie := bytes.Repeat([]byte("0123456789abcdef"), 3<<16/2) // 1.5MB
+	a, upstream := newPartsMockApp(t, map[string]interface{}{
+		"svod/show/movie.mp4": movie,
+		"svod/show/empty.mp4": []byte{},
+	}, parallelDownloadConfig{MinSizeMB: 4, PartSizeMB: 1, Concurrency: 2})
+
+	// bodies too small for parts get the rest of what was asked for in one GET
+	w := serveMock(a, "GET", "/show/movie.mp4", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), movie) {
+		t.Fatalf("GET: unexpected %d with %d bytes", w.Code, w.Body.Len())
+	}
+	w = serveMock(a, "GET", "/show/movie.mp4", http.Header{"Range": {"bytes=10-"}})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), movie[10:]) ||
+		w.Header().Get("Content-Range") != "bytes 10-1572863/1572864" {
+		t.Fatalf("range: unexpected %d with %d bytes %v", w.Code, w.Body.Len(), w.Header())
+	}
+	want := []string{"bytes=0-1048575", "bytes=1048576-1572863", "bytes=10-1048585", "bytes=1048586-1572863"}
+	if fmt.Sprint(upstream.ranges) != fmt.Sprint(want) {
+		t.Fatalf("expected GETs for %v, got %v", want, upstream.ranges)
+	}
+
+	// no range fits an empty object, which is fetched as a whole instead
+	if w := serveMock(a, "GET", "/show/empty.mp4", nil); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("empty: unexpected %d %q", w.Code, w.Body.String())
+	}
+
+	// suffix ranges go to S3 as they are
+	upstream.ranges = nil
+	serveMock(a, "GET", "/show/movie.mp4", http.Header{"Range": {"bytes=-10"}})
+	if fmt.Sprint(upstream.ranges) != "[bytes=-10]" {
+		t.Fatalf("suffix: expected a GET for bytes=-10, got %v", upstream.ranges)
+	}
+}
+
+func TestProxyS3Media_ParallelDownloadRetriesParts(t *testing.T) {
+	movie := bytes.Repeat([]byte("x"), 3<<20)
+	files := map[string]interface{}{"svod/show/movie.mp4": movie}
+	a, upstream := newParallelMockApp(t, files, 1)
+
+	upstream.failOnce["bytes=1048576-2097151"] = true
+	w := serveMock(a, "GET", "/show/movie.mp4", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != len(movie) {
+		t.Fatalf("expected the failed part to be retried, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if n := atomic.LoadInt32(&upstream.fetches); n != 4 {
+		t.Fatalf("expected a GET, 2 more parts and a retry, got %d requests", n)
+	}
+
+	// a part failing for good cuts the response short
+	a, upstream = newParallelMockApp(t, files, 0)
+	upstream.failOnce["bytes=1048576-2097151"] = true
+	if w := serveMock(a, "GET", "/show/movie.mp4", nil); w.Code != http.StatusOK || w.Body.Len() != 1<<20 {
+		t.Fatalf("expected the first part only, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestProxyS3Media_ParallelDownloadMemoryBudget(t *testing.T) {
+	movie := bytes.Repeat([]byte("x"), 3<<20)
+	a, upstream := newParallelMockApp(t, map[string]interface{}{"svod/show/movie.mp4": movie}, 0)
+
+	// 2 parts of 1MB at a time don't fit in 1MB: the rest comes in a single GET
+	a.parallelMemory = newMemoryBudget(1)
+	w := serveMock(a, "GET", "/show/movie.mp4", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), movie) {
+		t.Fatalf("over budget: unexpected %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if fmt.Sprint(upstream.ranges) != "[bytes=0-1048575 bytes=1048576-3145727]" {
+		t.Fatalf("over budget: expected the probe and a GET for the rest, got %v", upstream.ranges)
+	}
+
+	a.parallelMemory = newMemoryBudget(2)
+	upstream.ranges = nil
+	if w := serveMock(a, "GET", "/show/movie.mp4", nil); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), movie) {
+		t.Fatalf("within budget: unexpected %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if len(upstream.ranges) != 3 {
+		t.Fatalf("within budget: expected the probe and 2 parts, got %v", upstream.ranges)
+	}
+	if a.parallelMemory.left != 2<<20 {
+		t.Fatalf("expected the budget back once done, %d bytes are left", a.parallelMemory.left)
+	}
+}
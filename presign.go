@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crunchyroll/evs-s3helper/sigv4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// presignPrefix - where presign.endpoint serves presigned URLs, followed by the
+// bucket and the key
+const presignPrefix = "/presign/"
+
+// presignResponse - the JSON body of presign.endpoint
+type presignResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// errCredentialsExpiring - the credentials a URL would be presigned with expire
+// within a second, too soon for the URL to be of use.  New ones are on their way,
+// so the client is asked to retry.
+var errCredentialsExpiring = errors.New("credentials expire too soon to presign with")
+
+// presignFailure - a URL the signer refused to presign, a bug rather than an S3 failure
+type presignFailure struct{ err error }
+
+func (e *presignFailure) Error() string { return "presigning failed: " + e.err.Error() }
+func (e *presignFailure) Unwrap() error { return e.err }
+
+// validatePresign - checks the presign section, if anything presigns, against
+// the backend it needs
+func validatePresign(c *Config, routes *routeTable) error {
+	p := &c.Presign
+	used := p.Endpoint || p.QueryFlag != ""
+	for _, rt := range routes.routes {
+		used = used || rt.redirect
+	}
+	if !used {
+		return nil
+	}
+	if p.Expires < time.Second || p.Expires > sigv4.MaxPresignExpiry {
+		return fmt.Errorf("presign.expires must be between 1s and %v", sigv4.MaxPresignExpiry)
+	}
+	if c.S3Backend == backendSDK {
+		return fmt.Errorf("presign.endpoint and presign.query_flag require s3_backend: %s", backendSigned)
+	}
+	return nil
+}
+
+// wantsRedirect - whether r, routed to rt, is answered with a redirect to a
+// presigned URL rather than with the object
+func wantsRedirect(c *presignConfig, rt *route, r *http.Request) bool {
+	if rt.redirect {
+		return true
+	}
+	// clients would need the SSE-C key to follow the redirect
+	if c.QueryFlag == "" || rt.sseCustomer != nil {
+		return false
+	}
+	v, ok := r.URL.Query()[c.QueryFlag]
+	return ok && v[0] != "0" && v[0] != "false"
+}
+
+// presign - a URL the client can get the object of req from itself, and when it
+// expires: after expires, or when the credentials it is signed with do if that's
+// sooner
+func (b *signedBackend) presign(ctx context.Context, req *objectRequest, expires time.Duration) (*url.URL, time.Time, error) {
+	r2, err := b.newRequest(ctx, req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	signer, credsExpire, err := b.signer(ctx, req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !credsExpire.IsZero() && time.Until(credsExpire) < time.Second {
+		return nil, time.Time{}, errCredentialsExpiring
+	}
+	// X-Amz-Date and X-Amz-Expires are in whole seconds
+	now := time.Now().Truncate(time.Second)
+	if !credsExpire.IsZero() && credsExpire.Sub(now) < expires {
+		expires = credsExpire.Sub(now).Truncate(time.Second)
+	}
+	u, err := signer.Presign(r2, expires, now)
+	if err != nil {
+		return nil, time.Time{}, &presignFailure{err}
+	}
+	return u, now.Add(expires), nil
+}
+
+// servePresigned - answers r with a presigned URL for req, as a redirect to it or,
+// from presign.endpoint, as JSON.  Each one is logged for audit.
+func (a *App) servePresigned(w http.ResponseWriter, r *http.Request, rc *runtimeConfig, req *objectRequest,
+	client string, redirect bool, logger *zerolog.Logger) {
+	b, ok := rc.backend.(*signedBackend)
+	if !ok {
+		// ruled out by validatePresign
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	u, expires, err := b.presign(r.Context(), req, rc.conf.Presign.Expires)
+	var failure *presignFailure
+	switch {
+	case errors.Is(err, errCredentialsExpiring):
+		logger.Warn().Str("client", client).Msg("Credentials expire too soon to presign with")
+		writeUpstreamError(w, r, &upstreamError{Status: http.StatusServiceUnavailable, Code: "CredentialsExpiring"})
+		return
+	case errors.As(err, &failure):
+		logger.Error().Str("error", err.Error()).Str("client", client).Msg("Presigning failed")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case err != nil:
+		uerr := a.classifyFetchError(err, req.Bucket, req.Key, logger)
+		a.metrics.upstreamError(req.Bucket, errorClass(uerr))
+		writeUpstreamError(w, r, uerr)
+		return
+	}
+	a.countMetric("s3-helper:presign", req.Bucket)
+	logger.Info().
+		Str("client", client).
+		Str("remote_addr", r.RemoteAddr).
+		Bool("redirect", redirect).
+		Time("expires", expires).
+		Msg("Presigned URL issued")
+
+	// the URL stops working before long, so it mustn't be cached
+	w.Header().Set("Cache-Control", "no-store")
+	if redirect {
+		w.Header().Set("Location", u.String())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	body, _ := json.Marshal(&presignResponse{URL: u.String(), Expires: expires})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)+1))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(append(body, '\n'))
+	}
+}
+
+// servePresignEndpoint - presign.endpoint: a presigned URL for the key in the
+// bucket of /presign/{bucket}/{key} as JSON.  The key is the full object key, and
+// has to be one a route serves, i.e. under the key_prefix of a route to the
+// bucket.  Versions are picked as for objects.
+func (a *App) servePresignEndpoint(w http.ResponseWriter, r *http.Request, rc *runtimeConfig, client string) {
+	rest := strings.TrimPrefix(r.URL.Path, presignPrefix)
+	i := strings.Index(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bucket, key := rest[:i], rest[i:]
+	rt := rc.routes.forKey(bucket, key)
+	if rt == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	logger := log.With().Str("bucket", bucket).Str("object", key).Str("method", r.Method).Logger()
+	if rt.sseCustomer != nil {
+		logger.Warn().Str("client", client).Msg("Objects encrypted with SSE-C can't be presigned")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	req := &objectRequest{
+		Method:  "GET",
+		Bucket:  bucket,
+		Region:  rt.region,
+		Profile: rt.profile,
+		Role:    rt.role,
+		Key:     key,
+		Version: rc.version(r, bucket, key),
+	}
+	a.servePresigned(w, r, rc, req, client, false, &logger)
+}
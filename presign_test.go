@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSignedMockApp - a mock app on the signed backend, whose requests to S3 are
+// served by s3, with credentials from a fake instance metadata service that hands
+// out ones expiring after credsTTL (a day if 0).  edit changes the config further.
+func newSignedMockApp(t *testing.T, s3 http.HandlerFunc, credsTTL time.Duration, edit func(c *Config)) *App {
+	if credsTTL == 0 {
+		credsTTL = 24 * time.Hour
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("imds-token"))
+	})
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			w.Write([]byte("s3helper"))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Code":            "Success",
+			"AccessKeyId":     "ASIAPRESIGN",
+			"SecretAccessKey": "secret",
+			"Token":           "token",
+			"Expiration":      time.Now().Add(credsTTL),
+		})
+	})
+	mux.HandleFunc("/", s3)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	a := newMockApp(nil)
+	a.s3HTTPClient = server.Client()
+	withConfig(t, a, func(c *Config) {
+		c.S3Backend = backendSigned
+		c.S3Endpoint = endpointConfig{URL: server.URL}
+		c.Credentials = credentialsConfig{Source: credentialsInstance, MetadataEndpoint: server.URL}
+		edit(c)
+	})
+	return a
+}
+
+// newPresignMockApp - a signed mock app serving /svod/show/seg1.ts and presigning
+// as set up in presign and routes
+func newPresignMockApp(t *testing.T, presign presignConfig, routes []routeConfig, credsTTL time.Duration) *App {
+	s3 := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/svod/show/seg1.ts" || r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("segment"))
+	}
+	return newSignedMockApp(t, s3, credsTTL, func(c *Config) { c.Presign, c.Routes = presign, routes })
+}
+
+func TestProxyS3Media_RedirectRoute(t *testing.T) {
+	a := newPresignMockApp(t, presignConfig{Expires: 15 * time.Minute}, []routeConfig{
+		{Prefix: "/", Bucket: "svod"},
+		{Prefix: "/downloads/", Bucket: "svod", Redirect: true},
+	}, 0)
+
+	w := serveMock(a, "GET", "/downloads/show/seg%201+2.ts", nil)
+	if w.Code != http.StatusFound || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected an uncacheable 302, got %d %v", w.Code, w.Header())
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.EscapedPath() != "/svod/show/seg%201%2B2.ts" {
+		t.Fatalf("unexpected location %s", u)
+	}
+	q := u.Query()
+	if q.Get("X-Amz-Expires") != "900" || q.Get("X-Amz-Security-Token") != "token" || q.Get("X-Amz-Signature") == "" ||
+		!strings.HasPrefix(q.Get("X-Amz-Credential"), "ASIAPRESIGN/") {
+		t.Fatalf("unexpected query %v", q)
+	}
+
+	// other routes are proxied
+	if w := serveMock(a, "GET", "/show/seg1.ts", nil); w.Code != http.StatusOK || w.Body.String() != "segment" {
+		t.Fatalf("expected the object, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyS3Media_RedirectQueryFlag(t *testing.T) {
+	a := newPresignMockApp(t, presignConfig{Expires: time.Hour, QueryFlag: "redirect"}, nil, 0)
+
+	for target, want := range map[string]int{
+		"/show/seg1.ts?redirect":         http.StatusFound,
+		"/show/seg1.ts?redirect=1":       http.StatusFound,
+		"/show/seg1.ts?redirect=0":       http.StatusOK,
+		"/show/seg1.ts?redirect=false":   http.StatusOK,
+		"/show/seg1.ts?download=1&other": http.StatusOK,
+	} {
+		if w := serveMock(a, "GET", target, nil); w.Code != want {
+			t.Errorf("%s: expected %d, got %d", target, want, w.Code)
+		}
+	}
+
+	// the allow-list still applies
+	r := httptest.NewRequest("GET", "/show/seg1.ts?redirect=1", nil)
+	r.RemoteAddr = "10.1.2.3:54321"
+	w := httptest.NewRecorder()
+	a.proxyS3Media(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("remote client: expected 403, got %d", w.Code)
+	}
+}
+
+func TestProxyS3Media_PresignEndpoint(t *testing.T) {
+	// credentials expiring before presign.expires cut the URL short
+	a := newPresignMockApp(t, presignConfig{Expires: time.Hour, Endpoint: true}, nil, 5*time.Minute)
+
+	w := serveMock(a, "GET", "/presign/svod/show/seg1.ts", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	var body presignResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(body.URL)
+	if err != nil || u.Path != "/svod/show/seg1.ts" {
+		t.Fatalf("unexpected URL %s, %v", body.URL, err)
+	}
+	if left := time.Until(body.Expires); left > 5*time.Minute || left < 4*time.Minute {
+		t.Fatalf("expected the URL to expire along with the credentials, got %v", body.Expires)
+	}
+	if q := u.Query().Get("X-Amz-Expires"); q == "3600" {
+		t.Fatalf("X-Amz-Expires not cut short")
+	}
+
+	for _, target := range []string{"/presign/other/show/seg1.ts", "/presign/svod/", "/presign/svod"} {
+		if w := serveMock(a, "GET", target, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", target, w.Code)
+		}
+	}
+}
+
+func TestProxyS3Media_PresignExpiringCredentials(t *testing.T) {
+	a := newPresignMockApp(t, presignConfig{Expires: time.Hour, Endpoint: true}, nil, 500*time.Millisecond)
+
+	w := serveMock(a, "GET", "/presign/svod/show/seg1.ts", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected a 503 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestProxyS3Media_PresignEndpointKeyPrefix(t *testing.T) {
+	a := newPresignMockApp(t, presignConfig{Expires: time.Hour, Endpoint: true}, []routeConfig{
+		{Prefix: "/show/", Bucket: "svod", KeyPrefix: "/show"},
+		{Prefix: "/ads/", Bucket: "svod", KeyPrefix: "/ads/"},
+	}, 0)
+
+	for target, want := range map[string]int{
+		"/presign/svod/show/seg1.ts":   http.StatusOK,
+		"/presign/svod/ads/spot.ts":    http.StatusOK,
+		"/presign/svod/secret/key.pem": http.StatusNotFound,
+		"/presign/svod/showtime.ts":    http.StatusNotFound,
+		"/presign/svod/show":           http.StatusNotFound,
+	} {
+		if w := serveMock(a, "GET", target, nil); w.Code != want {
+			t.Errorf("%s: expected %d, got %d", target, want, w.Code)
+		}
+	}
+}
+
+func TestValidatePresign(t *testing.T) {
+	routes, err := newRouteTable(&Config{S3Region: "us-east-1", S3Bucket: "svod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Config{
+		{Presign: presignConfig{Endpoint: true}},
+		{Presign: presignConfig{Expires: 8 * 24 * time.Hour, QueryFlag: "redirect"}},
+		{S3Backend: backendSDK, Presign: presignConfig{Expires: time.Minute, Endpoint: true}},
+	} {
+		c := c
+		if err := validatePresign(&c, routes); err == nil {
+			t.Errorf("%+v: expected an error", c.Presign)
+		}
+	}
+	if err := validatePresign(&Config{S3Backend: backendSDK}, routes); err != nil {
+		t.Errorf("unused presign section: %v", err)
+	}
+}
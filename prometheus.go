@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/crunchyroll/evs-s3helper/diskcache"
+	"github.com/crunchyroll/evs-s3helper/metrics"
+)
+
+// Latency buckets, in seconds: segments are mostly served within tens of milliseconds,
+// the tail is whatever S3 throws at us
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// appMetrics - the Prometheus metrics served on /metrics of the admin listener.  They
+// sit next to the New Relic ones and need no account to be scraped.  All methods are
+// safe to call on a nil *appMetrics, so apps built without metrics (e.g. in tests)
+// don't need to care.
+type appMetrics struct {
+	cacheHits, cacheLookups uint64 // for the hit ratio, first for 64-bit alignment
+
+	registry       *metrics.Registry
+	requests       *metrics.CounterVec   // bucket, method, status
+	ttfb           *metrics.HistogramVec // bucket, method
+	duration       *metrics.HistogramVec // bucket, method
+	bytes          *metrics.CounterVec   // bucket, method
+	inFlight       *metrics.Gauge
+	upstreamErrors *metrics.CounterVec // bucket, class
+	retries        *metrics.CounterVec // reason
+	cacheRequests  *metrics.CounterVec // bucket, result
+	coalesced      *metrics.CounterVec // bucket
+}
+
+// newAppMetrics - registers the app's metrics, including the connection pool
+// stats of t and the disk cache stats of cache if they aren't nil
+func newAppMetrics(t *s3Transport, cache *diskcache.Cache) *appMetrics {
+	r := metrics.NewRegistry()
+	m := &appMetrics{
+		registry: r,
+		requests: r.NewCounterVec("s3helper_requests_total",
+			"Requests served, by bucket, method and response status.", "bucket", "method", "status"),
+		ttfb: r.NewHistogramVec("s3helper_time_to_first_byte_seconds",
+			"Time until the response header was written.", latencyBuckets, "bucket", "method"),
+		duration: r.NewHistogramVec("s3helper_request_duration_seconds",
+			"Time until the response was fully written.", latencyBuckets, "bucket", "method"),
+		bytes: r.NewCounterVec("s3helper_response_bytes_total",
+			"Body bytes written to clients.", "bucket", "method"),
+		inFlight: r.NewGauge("s3helper_requests_in_flight",
+			"Requests being served right now."),
+		upstreamErrors: r.NewCounterVec("s3helper_upstream_errors_total",
+			"Failed S3 requests, by bucket and class of error.", "bucket", "class"),
+		retries: r.NewCounterVec("s3helper_upstream_retries_total",
+			"S3 requests retried, by reason.", "reason"),
+		cacheRequests: r.NewCounterVec("s3helper_cache_requests_total",
+			"Disk cache lookups, by bucket and result (HIT or MISS).", "bucket", "result"),
+		coalesced: r.NewCounterVec("s3helper_coalesced_requests_total",
+			"Requests that shared the S3 request of an identical one in flight.", "bucket"),
+	}
+	if cache != nil {
+		r.NewGaugeFunc("s3helper_cache_hit_ratio", "Share of the disk cache lookups that were hits since start up.",
+			func() float64 {
+				lookups := atomic.LoadUint64(&m.cacheLookups)
+				if lookups == 0 {
+					return 0
+				}
+				return float64(atomic.LoadUint64(&m.cacheHits)) / float64(lookups)
+			})
+		r.NewGaugeFunc("s3helper_cache_entries", "Objects in the disk cache.", func() float64 {
+			entries, _ := cache.Stats()
+			return float64(entries)
+		})
+		r.NewGaugeFunc("s3helper_cache_size_bytes", "Bytes of objects in the disk cache.", func() float64 {
+			_, size := cache.Stats()
+			return float64(size)
+		})
+	}
+
+	if t != nil {
+		stat := func(f func(poolStats) int64) func() float64 {
+			return func() float64 { return float64(f(t.Stats())) }
+		}
+		r.NewGaugeFunc("s3helper_pool_connections_open", "Connections to S3 that are open.",
+			stat(func(s poolStats) int64 { return s.Open }))
+		r.NewGaugeFunc("s3helper_pool_connections_in_use", "Connections to S3 carrying a request.",
+			stat(func(s poolStats) int64 { return s.InUse }))
+		r.NewGaugeFunc("s3helper_pool_connections_idle", "Connections to S3 waiting in the pool.",
+			stat(func(s poolStats) int64 { return s.Idle }))
+		r.NewCounterFunc("s3helper_pool_dials_total", "Connections to S3 dialed.",
+			stat(func(s poolStats) int64 { return s.Dials }))
+		r.NewCounterFunc("s3helper_pool_reused_total", "Requests to S3 that reused a pooled connection.",
+			stat(func(s poolStats) int64 { return s.Reused }))
+	}
+	return m
+}
+
+// Classes of upstream errors
+const (
+	errClassTimeout      = "timeout"
+	errClassNetwork      = "network"
+	errClassCanceled     = "canceled"
+	errClassThrottled    = "throttled"
+	errClassNotFound     = "not_found"
+	errClassAccessDenied = "access_denied"
+	errClassClient       = "s3_4xx"
+	errClassServer       = "s3_5xx"
+	errClassBody         = "body_read"
+)
+
+// errorClass - buckets an upstream error into a handful of classes fit for a label
+func errorClass(uerr *upstreamError) string {
+	switch {
+	case uerr.Code == "ClientClosedRequest":
+		return errClassCanceled
+	case uerr.Code == errCodeTimeout:
+		return errClassTimeout
+	case uerr.Code == errCodeSlowDown:
+		return errClassThrottled
+	case uerr.S3Status == 0:
+		return errClassNetwork
+	case uerr.Status == http.StatusNotFound:
+		return errClassNotFound
+	case uerr.Code == errCodeAccessDenied:
+		return errClassAccessDenied
+	case uerr.S3Status >= 500:
+		return errClassServer
+	}
+	return errClassClient
+}
+
+// methodLabel - keeps the method label bounded whatever clients send
+func methodLabel(method string) string {
+	if method == "GET" || method == "HEAD" {
+		return method
+	}
+	return "other"
+}
+
+// instrumentedWriter - records what was written to the client
+type instrumentedWriter struct {
+	http.ResponseWriter
+	start     time.Time
+	status    int
+	firstByte time.Duration
+	bytes     int64
+}
+
+func (w *instrumentedWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.firstByte = time.Since(w.start)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *instrumentedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// requestStarted - wraps w to record the request; requestDone must follow
+func (m *appMetrics) requestStarted(w http.ResponseWriter) *instrumentedWriter {
+	if m != nil {
+		m.inFlight.Inc()
+	}
+	return &instrumentedWriter{ResponseWriter: w, start: time.Now()}
+}
+
+// requestDone - records a request served to bucket, "" if it didn't reach one
+func (m *appMetrics) requestDone(bucket, method string, w *instrumentedWriter) {
+	if m == nil {
+		return
+	}
+	m.inFlight.Dec()
+	if bucket == "" {
+		bucket = "none"
+	}
+	method = methodLabel(method)
+	if w.status == 0 {
+		// nothing written, net/http answers 200 with an empty body
+		w.status = http.StatusOK
+		w.firstByte = time.Since(w.start)
+	}
+
+	m.requests.WithLabelValues(bucket, method, strconv.Itoa(w.status)).Inc()
+	m.ttfb.WithLabelValues(bucket, method).Observe(w.firstByte.Seconds())
+	m.duration.WithLabelValues(bucket, method).Observe(time.Since(w.start).Seconds())
+	m.bytes.WithLabelValues(bucket, method).Add(float64(w.bytes))
+}
+
+// upstreamError - records a failed S3 request
+func (m *appMetrics) upstreamError(bucket, class string) {
+	if m == nil {
+		return
+	}
+	m.upstreamErrors.WithLabelValues(bucket, class).Inc()
+}
+
+// retry - records a retried S3 request
+func (m *appMetrics) retry(reason string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(reason).Inc()
+}
+
+// cacheResult - records a disk cache lookup
+func (m *appMetrics) cacheResult(bucket, result string) {
+	if m == nil {
+		return
+	}
+	m.cacheRequests.WithLabelValues(bucket, result).Inc()
+	if result == cacheHit {
+		atomic.AddUint64(&m.cacheHits, 1)
+	}
+	atomic.AddUint64(&m.cacheLookups, 1)
+}
+
+// requestCoalesced - records a request served by a flight already under way
+func (m *appMetrics) requestCoalesced(bucket string) {
+	if m == nil {
+		return
+	}
+	m.coalesced.WithLabelValues(bucket).Inc()
+}
+
+// ServeHTTP - the /metrics endpoint
+func (m *appMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	m.registry.ServeHTTP(w, r)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_ProxyRequests(t *testing.T) {
+	a := newMockApp(map[string]interface{}{
+		"svod/show/manifest.json": []byte(`{"segments":10}`),
+	})
+	a.metrics = newAppMetrics(nil, nil)
+
+	serveMock(a, "GET", "/show/manifest.json", nil)
+	serveMock(a, "GET", "/show/manifest.json", nil)
+	serveMock(a, "HEAD", "/show/manifest.json", nil)
+	serveMock(a, "HEAD", "/show/missing.json", nil)
+	serveMock(a, "POST", "/show/manifest.json", nil)
+
+	w := serveAdmin(a, "/metrics")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		`s3helper_requests_total{bucket="svod",method="GET",status="200"} 2`,
+		`s3helper_requests_total{bucket="svod",method="HEAD",status="200"} 1`,
+		`s3helper_requests_total{bucket="svod",method="HEAD",status="404"} 1`,
+		`s3helper_requests_total{bucket="none",method="other",status="405"} 1`,
+		`s3helper_response_bytes_total{bucket="svod",method="GET"} 30`,
+		`s3helper_upstream_errors_total{bucket="svod",class="not_found"} 1`,
+		`s3helper_time_to_first_byte_seconds_count{bucket="svod",method="GET"} 2`,
+		`s3helper_request_duration_seconds_count{bucket="svod",method="HEAD"} 2`,
+		`s3helper_requests_in_flight 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for want, uerr := range map[string]*upstreamError{
+		errClassTimeout:      {Code: errCodeTimeout, Status: 504},
+		errClassNetwork:      {Code: errCodeNetwork, Status: 502},
+		errClassCanceled:     {Code: "ClientClosedRequest", Status: 502},
+		errClassThrottled:    {Code: errCodeSlowDown, S3Status: 503, Status: 503},
+		errClassNotFound:     {Code: "NoSuchKey", S3Status: 404, Status: 404},
+		errClassAccessDenied: {Code: errCodeAccessDenied, S3Status: 403, Status: 403},
+		errClassClient:       {Code: errCodeInvalidRange, S3Status: 416, Status: 416},
+		errClassServer:       {Code: errCodeInternal, S3Status: 500, Status: 502},
+	} {
+		if got := errorClass(uerr); got != want {
+			t.Errorf("%+v: expected %s, got %s", uerr, want, got)
+		}
+	}
+}
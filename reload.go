@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/crunchyroll/evs-common/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// runtimeConfig - an immutable snapshot of everything derived from the config that
+// can change on SIGHUP.  Requests grab the current snapshot when they start and keep
+// using it until they finish, whatever reloads happen meanwhile.
+type runtimeConfig struct {
+	conf      *Config
+	logLevel  zerolog.Level
+	routes    *routeTable
+	endpoints *endpointResolver
+	backend   s3Backend
+	objects   s3Backend // backend behind the disk cache and coalescing, if enabled
+	access    *accessPolicy
+	headers   *headerPolicy
+	cors      *corsPolicy // nil if CORS is disabled
+	versions  versionPins
+}
+
+// newRuntimeConfig - validates c and builds a snapshot from it
+func (a *App) newRuntimeConfig(c *Config) (*runtimeConfig, error) {
+	level, ok := logLevels[c.Logging.Level]
+	if !ok {
+		return nil, fmt.Errorf("bad loglevel %q", c.Logging.Level)
+	}
+
+	if c.MultiRange.MaxRanges > 0 && c.MultiRange.Parallel <= 0 {
+		return nil, fmt.Errorf("multi_range.parallel must be positive")
+	}
+	if pd := &c.ParallelDownload; pd.MinSizeMB > 0 && (pd.PartSizeMB <= 0 || pd.Concurrency <= 0 || pd.PartRetries < 0) {
+		return nil, fmt.Errorf("parallel_download needs a positive part_size_mb and concurrency, and part_retries of 0 or more")
+	}
+	access, err := newAccessPolicy(&c.Access)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := newHeaderPolicy(&c.Headers)
+	if err != nil {
+		return nil, err
+	}
+	cors, err := newCORSPolicy(&c.CORS)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := newEndpointResolver(c)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := newRouteTable(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePresign(c, routes); err != nil {
+		return nil, err
+	}
+	versions, err := newVersionPins(&c.Versioning)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := a.newBackend(c, routes, endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &runtimeConfig{
+		conf:      c,
+		logLevel:  level,
+		routes:    routes,
+		endpoints: endpoints,
+		backend:   backend,
+		access:    access,
+		headers:   headers,
+		cors:      cors,
+		versions:  versions,
+		objects:   backend,
+	}
+	if a.cache != nil {
+		rc.objects = &cachingBackend{
+			next:          rc.objects,
+			cache:         a.cache,
+			ttl:           c.Cache.TTL,
+			maxObjectSize: c.Cache.MaxObjectSizeMB << 20,
+			app:           a,
+		}
+	}
+	if c.Coalesce.Enabled {
+		if c.Coalesce.BufferKB <= 0 {
+			return nil, fmt.Errorf("coalesce.buffer_kb must be positive")
+		}
+		rc.objects = newCoalescingBackend(rc.objects, c.Coalesce.BufferKB<<10, a)
+	}
+	return rc, nil
+}
+
+// objectBackend - where objects are fetched from: through coalescing and the disk
+// cache if they are enabled, straight from S3 otherwise
+func (rc *runtimeConfig) objectBackend() s3Backend {
+	if rc.objects != nil {
+		return rc.objects
+	}
+	return rc.backend
+}
+
+// snapshot - the config in effect right now
+func (a *App) snapshot() *runtimeConfig {
+	return a.current.Load().(*runtimeConfig)
+}
+
+// setSnapshot - atomically swaps in a new config for the requests that start from now on
+func (a *App) setSnapshot(rc *runtimeConfig) {
+	a.current.Store(rc)
+}
+
+// staticSettings - top level keys that are only read at start up
+var staticSettings = []string{"listen", "admin_listen", "unix_socket", "concurrency", "newrelic", "s3_transport", "shutdown",
+	"statsd_addr", "statsd_env", "statsd_sample_rate", "cache.dir", "cache.max_size_mb", "parallel_download.max_memory_mb"}
+
+// reloadMu - serializes reloads, so a burst of SIGHUPs can't interleave
+var reloadMu sync.Mutex
+
+// Reload - re-reads the config file and, if it is valid, swaps it in.  An invalid
+// config is rejected and the current one stays active.  Either way the differences
+// between the two are logged.
+func (a *App) Reload(configFile string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	old := a.snapshot()
+	var newConf Config
+	if !config.Load(configFile, defaultConfValues, &newConf) {
+		log.Error().Msg(fmt.Sprintf("Unable to reload config from %s - keeping the current config", configFile))
+		return errors.New("unable to load config")
+	}
+
+	diff := configDiff(old.conf, &newConf)
+	rc, err := a.newRuntimeConfig(&newConf)
+	if err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Strs("diff", diff).
+			Msg(fmt.Sprintf("Rejected config from %s - keeping the current config", configFile))
+		return err
+	}
+
+	for _, line := range diff {
+		for _, key := range staticSettings {
+			if strings.HasPrefix(line, key+":") || strings.HasPrefix(line, key+".") {
+				log.Warn().Str("change", line).Msg("Setting only takes effect after a restart")
+			}
+		}
+	}
+
+	a.setSnapshot(rc)
+	zerolog.SetGlobalLevel(rc.logLevel)
+	log.Info().
+		Strs("diff", diff).
+		Msg(fmt.Sprintf("Reloaded config from %s", configFile))
+	return nil
+}
+
+// configDiff - lists the settings that differ between two configs as
+// "yaml.path: old -> new", with secrets redacted
+func configDiff(old, new *Config) []string {
+	var diff []string
+	diffValues("", reflect.ValueOf(*old), reflect.ValueOf(*new), false, &diff)
+	sort.Strings(diff)
+	return diff
+}
+
+func diffValues(path string, old, new reflect.Value, secret bool, diff *[]string) {
+	switch old.Kind() {
+	case reflect.Struct:
+		t := old.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValues(name, old.Field(i), new.Field(i), f.Tag.Get("secret") == "true", diff)
+		}
+		return
+	case reflect.Map:
+		keys := map[string]reflect.Value{}
+		for _, k := range old.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, k := range new.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for name, k := range keys {
+			ov, nv := old.MapIndex(k), new.MapIndex(k)
+			switch {
+			case !ov.IsValid():
+				*diff = append(*diff, fmt.Sprintf("%s.%s: added", path, name))
+			case !nv.IsValid():
+				*diff = append(*diff, fmt.Sprintf("%s.%s: removed", path, name))
+			default:
+				diffValues(path+"."+name, ov, nv, secret, diff)
+			}
+		}
+		return
+	}
+
+	if reflect.DeepEqual(old.Interface(), new.Interface()) {
+		return
+	}
+	if secret {
+		*diff = append(*diff, fmt.Sprintf("%s: changed", path))
+		return
+	}
+	*diff = append(*diff, fmt.Sprintf("%s: %v -> %v", path, old.Interface(), new.Interface()))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigDiff(t *testing.T) {
+	old := Config{
+		S3Region:  "us-west-2",
+		S3Timeout: 3 * time.Second,
+		Logging:   logConfig{Level: "info"},
+		NewRelic:  nrConfig{License: "old-license"},
+		S3Buckets: map[string]endpointConfig{"a": {}, "b": {}},
+	}
+	new := old
+	new.S3Timeout = 5 * time.Second
+	new.Logging.Level = "debug"
+	new.NewRelic.License = "new-license"
+	new.S3Buckets = map[string]endpointConfig{"a": {Scheme: "http"}, "c": {}}
+
+	want := []string{
+		"logging.level: info -> debug",
+		"newrelic.license: changed",
+		"s3_buckets.a.scheme:  -> http",
+		"s3_buckets.b: removed",
+		"s3_buckets.c: added",
+		"s3_timeout: 3s -> 5s",
+	}
+	if got := configDiff(&old, &new); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got := configDiff(&old, &old); len(got) != 0 {
+		t.Fatalf("expected no differences, got %q", got)
+	}
+}
+
+func TestNewRuntimeConfig(t *testing.T) {
+	a := &App{}
+	valid := Config{S3Region: "us-west-2", S3Bucket: "content", Logging: logConfig{Level: "info"}}
+	rc, err := a.newRuntimeConfig(&valid)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a.setSnapshot(rc)
+
+	for _, c := range []Config{
+		{S3Region: "us-west-2", S3Bucket: "content", Logging: logConfig{Level: "loud"}},
+		{S3Region: "us-west-2", Logging: logConfig{Level: "info"}},
+		{S3Region: "us-west-2", S3Bucket: "content", Logging: logConfig{Level: "info"}, S3Backend: "carrier-pigeon"},
+		{S3Region: "us-west-2", S3Bucket: "content", Logging: logConfig{Level: "info"}, S3Endpoint: endpointConfig{Scheme: "ftp"}},
+	} {
+		c := c
+		if _, err := a.newRuntimeConfig(&c); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+	if a.snapshot() != rc {
+		t.Fatalf("snapshot changed by a rejected config")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Fallbacks used when the retry settings are missing from the config
+const (
+	defaultRetryBaseDelay = 50 * time.Millisecond
+	defaultRetryMaxDelay  = 2 * time.Second
+)
+
+// retryPolicy - controls how upstream S3 requests are timed out and retried
+type retryPolicy struct {
+	maxAttempts int
+	timeout     time.Duration
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+// newRetryPolicy - builds a retry policy from the s3_retries/s3_timeout settings.
+// s3_retries is the number of retries, so the total number of attempts is one more.
+func newRetryPolicy(c *Config) retryPolicy {
+	p := retryPolicy{
+		maxAttempts: c.S3Retries + 1,
+		timeout:     c.S3Timeout,
+		baseDelay:   c.S3RetryBackoff,
+		maxDelay:    c.S3RetryMaxBackoff,
+	}
+	if p.maxAttempts < 1 {
+		p.maxAttempts = 1
+	}
+	if p.baseDelay <= 0 {
+		p.baseDelay = defaultRetryBaseDelay
+	}
+	if p.maxDelay < p.baseDelay {
+		p.maxDelay = defaultRetryMaxDelay
+		if p.maxDelay < p.baseDelay {
+			p.maxDelay = p.baseDelay
+		}
+	}
+	return p
+}
+
+// backoff - exponential backoff with full jitter for the given (1-based) attempt
+// that just failed.  See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.maxDelay
+	if shift := uint(attempt - 1); shift < 32 {
+		if d := p.baseDelay << shift; d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// attemptTimeoutError - returned when a single attempt exceeds s3_timeout.  It
+// satisfies net.Error so that callers can treat it like any other timeout.
+type attemptTimeoutError struct {
+	attempt int
+	timeout time.Duration
+}
+
+func (e *attemptTimeoutError) Error() string {
+	return fmt.Sprintf("s3 request attempt %d timed out after %v", e.attempt, e.timeout)
+}
+
+func (e *attemptTimeoutError) Timeout() bool   { return true }
+func (e *attemptTimeoutError) Temporary() bool { return true }
+
+// retryReason - classifies a failed attempt, returning "" if it must not be retried
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		var netErr net.Error
+		switch {
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return "timeout"
+		case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+			return "connreset"
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return "connrefused"
+		}
+		return ""
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return "slowdown"
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Sprintf("s3status%d", resp.StatusCode)
+	}
+	return ""
+}
+
+// cancelOnClose - releases the per-attempt context once the caller is done with the body
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// doWithRetry - issues the request built by newRequest until it succeeds, fails with
+// a non-retryable error or runs out of attempts.  Each attempt gets a fresh request
+// (so it is re-signed) and its own s3_timeout deadline for receiving the response
+// headers.  The last response or error is returned as is.
+func (a *App) doWithRetry(ctx context.Context, client *http.Client, policy retryPolicy,
+	newRequest func(context.Context) (*http.Request, error), logger *zerolog.Logger) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		req, err := newRequest(attemptCtx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		var timer *time.Timer
+		if policy.timeout > 0 {
+			timer = time.AfterFunc(policy.timeout, cancel)
+		}
+		resp, err := client.Do(req)
+		if timer != nil && !timer.Stop() && ctx.Err() == nil {
+			// the deadline fired, possibly just as the response arrived
+			if resp != nil {
+				resp.Body.Close()
+				resp = nil
+			}
+			err = &attemptTimeoutError{attempt: attempt, timeout: policy.timeout}
+		}
+
+		reason := retryReason(resp, err)
+		if reason == "" || attempt >= policy.maxAttempts || ctx.Err() != nil {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		cancel()
+
+		delay := policy.backoff(attempt)
+		a.recordMetric("s3-helper:retry", "", float64(attempt))
+		a.recordMetric(fmt.Sprintf("s3-helper:retry%s", reason), "", float64(attempt))
+		a.metrics.retry(reason)
+		event := logger.Warn().
+			Int("attempt", attempt).
+			Int("max_attempts", policy.maxAttempts).
+			Str("reason", reason).
+			Dur("backoff", delay)
+		if err != nil {
+			event = event.Str("error", err.Error())
+		} else {
+			event = event.Int("http_statuscode", resp.StatusCode)
+		}
+		event.Msg(fmt.Sprintf("s3:Get:Retry - attempt %d of %d failed (%s)", attempt, policy.maxAttempts, reason))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := newRetryPolicy(&Config{S3Retries: 3, S3RetryBackoff: 10 * time.Millisecond, S3RetryMaxBackoff: 40 * time.Millisecond})
+	if p.maxAttempts != 4 {
+		t.Fatalf("expected 4 attempts, got %d", p.maxAttempts)
+	}
+
+	for attempt := 1; attempt < 40; attempt++ {
+		ceiling := p.baseDelay << uint(attempt-1)
+		if attempt > 3 || ceiling > p.maxDelay {
+			ceiling = p.maxDelay
+		}
+		if d := p.backoff(attempt); d < 0 || d > ceiling {
+			t.Fatalf("attempt %d: backoff %v outside [0, %v]", attempt, d, ceiling)
+		}
+	}
+}
+
+func TestDoWithRetry_RetriesServerErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	a := &App{}
+	policy := retryPolicy{maxAttempts: 3, timeout: time.Second, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	}
+
+	resp, err := a.doWithRetry(context.Background(), server.Client(), policy, newRequest, &log.Logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "ok" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestDoWithRetry_AttemptTimeout(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	a := &App{}
+	policy := retryPolicy{maxAttempts: 2, timeout: 20 * time.Millisecond, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	}
+
+	_, err := a.doWithRetry(context.Background(), server.Client(), policy, newRequest, &log.Logger)
+	if _, ok := err.(*attemptTimeoutError); !ok {
+		t.Fatalf("expected attempt timeout, got %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestDoWithRetry_NoRetryOnClientError(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	a := &App{}
+	policy := retryPolicy{maxAttempts: 3, timeout: time.Second, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	}
+
+	resp, err := a.doWithRetry(context.Background(), server.Client(), policy, newRequest, &log.Logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expected a single 404, got %d after %d calls", resp.StatusCode, calls)
+	}
+}
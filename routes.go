@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// route - a compiled entry of the routes config section
+type route struct {
+	prefix    string // URL path prefix, always starts and ends with /
+	host      string // Host header to match, "" for any host
+	bucket    string
+	region    string
+	keyPrefix string // prepended to the object path, e.g. /SomePath
+	profile   string // shared credentials profile, "" for the default credentials
+	headers   http.Header
+
+	role       string // assumed on top of the credentials of profile, "" for none
+	externalID string
+
+	redirect bool // clients are sent to a presigned URL instead
+
+	sseCustomer *sseCustomerKey // nil if objects aren't encrypted with SSE-C
+}
+
+// objectPath - the part of path the route forwards to S3, starting with a /.
+// The prefix is stripped, e.g. /avod/ad/manifest.json becomes /ad/manifest.json.
+func (rt *route) objectPath(path string) string {
+	return path[len(rt.prefix)-1:]
+}
+
+// routeTable - maps incoming requests onto buckets by longest prefix match
+type routeTable struct {
+	routes []*route // longest prefix first, host specific routes before generic ones
+}
+
+// legacyRoutes - the routes implied by s3_bucket/s3_ad_bucket when no routes are configured:
+// /avod/ goes to the ad media bucket and everything else to the default media bucket.
+func legacyRoutes(c *Config) []routeConfig {
+	var routes []routeConfig
+	if c.S3AdBucket != "" {
+		routes = append(routes, routeConfig{Prefix: "/avod/", Bucket: c.S3AdBucket})
+	}
+	if c.S3Bucket != "" {
+		routes = append(routes, routeConfig{Prefix: "/", Bucket: c.S3Bucket})
+	}
+	return routes
+}
+
+// newRouteTable - validates and compiles the routes section.  Routes without a
+// region or key prefix inherit s3_region and s3_prefix.
+func newRouteTable(c *Config) (*routeTable, error) {
+	configs := c.Routes
+	if len(configs) == 0 {
+		configs = legacyRoutes(c)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no routes configured, set routes or s3_bucket")
+	}
+
+	t := &routeTable{}
+	seen := make(map[string]bool, len(configs))
+	externalIDs := map[string]string{} // by role, which has a single one
+	for i, rc := range configs {
+		rt := &route{
+			prefix:    rc.Prefix,
+			host:      strings.ToLower(rc.Host),
+			bucket:    rc.Bucket,
+			region:    rc.Region,
+			keyPrefix: rc.KeyPrefix,
+			profile:   rc.Profile,
+			headers:   make(http.Header, len(rc.Headers)),
+
+			role:       rc.RoleARN,
+			externalID: rc.ExternalID,
+
+			redirect: rc.Redirect,
+		}
+		for name, v := range rc.Headers {
+			rt.headers.Set(name, v)
+		}
+		if rt.prefix == "" {
+			rt.prefix = "/"
+		}
+		if !strings.HasPrefix(rt.prefix, "/") {
+			return nil, fmt.Errorf("routes[%d]: prefix %q must start with /", i, rc.Prefix)
+		}
+		if !strings.HasSuffix(rt.prefix, "/") {
+			rt.prefix += "/"
+		}
+		if rt.bucket == "" {
+			return nil, fmt.Errorf("routes[%d]: prefix %q has no bucket", i, rt.prefix)
+		}
+		if rt.region == "" {
+			rt.region = c.S3Region
+		}
+		if rt.region == "" {
+			return nil, fmt.Errorf("routes[%d]: prefix %q has no region and s3_region is not set", i, rt.prefix)
+		}
+		if rt.keyPrefix == "" {
+			rt.keyPrefix = c.S3Path
+		}
+		// "/" is no prefix at all, which also lets a route opt out of s3_prefix
+		if rt.keyPrefix = strings.Trim(rt.keyPrefix, "/"); rt.keyPrefix != "" {
+			rt.keyPrefix = "/" + rt.keyPrefix
+		}
+		if rt.role != "" && c.S3Backend == backendSDK {
+			return nil, fmt.Errorf("routes[%d]: role_arn %q requires s3_backend: %s", i, rt.role, backendSigned)
+		}
+		if rt.redirect && c.S3Backend == backendSDK {
+			return nil, fmt.Errorf("routes[%d]: redirect requires s3_backend: %s", i, backendSigned)
+		}
+		var err error
+		if rt.sseCustomer, err = loadSSECustomerKey(&rc.SSECustomerKey); err != nil {
+			return nil, fmt.Errorf("routes[%d]: sse_customer_key: %v", i, err)
+		}
+		if rt.sseCustomer != nil && rt.redirect {
+			// clients would need the key to follow the redirect
+			return nil, fmt.Errorf("routes[%d]: redirect can't be used with sse_customer_key", i)
+		}
+		if id, ok := externalIDs[rt.role]; ok && id != rt.externalID {
+			return nil, fmt.Errorf("routes[%d]: role_arn %q has another external_id in an earlier route", i, rt.role)
+		}
+		externalIDs[rt.role] = rt.externalID
+
+		id := rt.host + rt.prefix
+		if seen[id] {
+			return nil, fmt.Errorf("routes[%d]: duplicate route for host %q and prefix %q", i, rt.host, rt.prefix)
+		}
+		seen[id] = true
+		t.routes = append(t.routes, rt)
+	}
+
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		if len(t.routes[i].prefix) != len(t.routes[j].prefix) {
+			return len(t.routes[i].prefix) > len(t.routes[j].prefix)
+		}
+		return t.routes[i].host != "" && t.routes[j].host == ""
+	})
+	return t, nil
+}
+
+// forKey - the route to bucket whose key_prefix key is under, the longest one if
+// several are, nil if no route serves key
+func (t *routeTable) forKey(bucket, key string) *route {
+	var best *route
+	for _, rt := range t.routes {
+		if rt.bucket != bucket || (rt.keyPrefix != "" && !strings.HasPrefix(key, rt.keyPrefix+"/")) {
+			continue
+		}
+		if best == nil || len(rt.keyPrefix) > len(best.keyPrefix) {
+			best = rt
+		}
+	}
+	return best
+}
+
+// match - finds the route for a request, returning nil if none applies
+func (t *routeTable) match(host, path string) *route {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, rt := range t.routes {
+		if rt.host != "" && rt.host != host {
+			continue
+		}
+		if strings.HasPrefix(path, rt.prefix) {
+			return rt
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestRouteTable_Match(t *testing.T) {
+	table, err := newRouteTable(&Config{
+		S3Region: "us-west-2",
+		S3Path:   "/media",
+		Routes: []routeConfig{
+			{Prefix: "/", Bucket: "content"},
+			{Prefix: "/avod/", Bucket: "ads"},
+			{Prefix: "/music", Bucket: "music", Region: "eu-west-1", KeyPrefix: "tracks/"},
+			{Prefix: "/music/thumbnails/", Bucket: "thumbs"},
+			{Prefix: "/raw/", Bucket: "raw", KeyPrefix: "/"},
+			{Prefix: "/", Host: "subtitles.example.com", Bucket: "subtitles"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		host, path          string
+		bucket, region, key string
+	}{
+		{"127.0.0.1", "/show/seg-1.ts", "content", "us-west-2", "/media/show/seg-1.ts"},
+		{"127.0.0.1", "/avod/ad/manifest.json", "ads", "us-west-2", "/media/ad/manifest.json"},
+		{"127.0.0.1", "/avodx/manifest.json", "content", "us-west-2", "/media/avodx/manifest.json"},
+		{"127.0.0.1", "/music/album/1.mp3", "music", "eu-west-1", "/tracks/album/1.mp3"},
+		{"127.0.0.1", "/music/thumbnails/1.jpg", "thumbs", "us-west-2", "/media/1.jpg"},
+		{"Subtitles.example.com:8080", "/show/en.vtt", "subtitles", "us-west-2", "/media/show/en.vtt"},
+		{"127.0.0.1", "/a", "content", "us-west-2", "/media/a"},
+		{"127.0.0.1", "/raw/show/seg-1.ts", "raw", "us-west-2", "/show/seg-1.ts"},
+	}
+	for _, c := range cases {
+		rt := table.match(c.host, c.path)
+		if rt == nil {
+			t.Fatalf("%s%s: no route", c.host, c.path)
+		}
+		if key := rt.keyPrefix + rt.objectPath(c.path); rt.bucket != c.bucket || rt.region != c.region || key != c.key {
+			t.Errorf("%s%s: got %s/%s%s, want %s/%s%s", c.host, c.path, rt.region, rt.bucket, key, c.region, c.bucket, c.key)
+		}
+	}
+}
+
+func TestRouteTable_Legacy(t *testing.T) {
+	table, err := newRouteTable(&Config{S3Region: "us-west-2", S3Bucket: "content", S3AdBucket: "ads"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rt := table.match("", "/avod/x.ts"); rt == nil || rt.bucket != "ads" || rt.objectPath("/avod/x.ts") != "/x.ts" {
+		t.Fatalf("/avod/ not routed to the ad bucket: %+v", rt)
+	}
+	if rt := table.match("", "/x"); rt == nil || rt.bucket != "content" {
+		t.Fatalf("/x not routed to the content bucket: %+v", rt)
+	}
+}
+
+func TestRouteTable_RootKeyPrefix(t *testing.T) {
+	table, err := newRouteTable(&Config{S3Region: "us-west-2", S3Bucket: "content", S3Path: "/"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rt := table.match("", "/show/x.ts"); rt == nil || rt.keyPrefix+rt.objectPath("/show/x.ts") != "/show/x.ts" {
+		t.Fatalf("s3_prefix / not dropped: %+v", rt)
+	}
+}
+
+func TestRouteTable_Invalid(t *testing.T) {
+	for _, c := range []Config{
+		{S3Region: "us-west-2"},
+		{S3Region: "us-west-2", Routes: []routeConfig{{Prefix: "avod/", Bucket: "ads"}}},
+		{S3Region: "us-west-2", Routes: []routeConfig{{Prefix: "/avod/"}}},
+		{Routes: []routeConfig{{Prefix: "/avod/", Bucket: "ads"}}},
+		{S3Region: "us-west-2", Routes: []routeConfig{{Prefix: "/a/", Bucket: "x"}, {Prefix: "/a", Bucket: "y"}}},
+		{S3Region: "us-west-2", S3Backend: backendSDK, Routes: []routeConfig{{Prefix: "/a/", Bucket: "x", RoleARN: "arn:aws:iam::1:role/r"}}},
+		{S3Region: "us-west-2", S3Backend: backendSDK, Routes: []routeConfig{{Prefix: "/a/", Bucket: "x", Redirect: true}}},
+		{S3Region: "us-west-2", Routes: []routeConfig{
+			{Prefix: "/a/", Bucket: "x", RoleARN: "arn:aws:iam::1:role/r", ExternalID: "1"},
+			{Prefix: "/b/", Bucket: "y", RoleARN: "arn:aws:iam::1:role/r", ExternalID: "2"},
+		}},
+	} {
+		c := c
+		if _, err := newRouteTable(&c); err == nil {
+			t.Errorf("%+v: expected an error", c.Routes)
+		}
+	}
+}
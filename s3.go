@@ -4,30 +4,29 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"runtime"
 	"strings"
 	"syscall"
 	"time"
 
-	awsauth "github.com/crunchyroll/go-aws-auth"
-
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/rs/zerolog/log"
 )
 
+// statRate - share of the statsd counters and timers sent, see statsd_sample_rate
 var statRate float32 = 1
 
-// List of headers to forward in response
-var headerForward = map[string]bool{
-	"Content-Length": true,
-	"Content-Range":  true,
-	"Content-Type":   true,
-	"Date":           true,
-	"ETag":           true,
-	"Last-Modified":  true,
+// Headers that may be forwarded along with a 304 or 412, the rest describe a body there isn't
+var conditionHeaders = []string{"Cache-Control", "Date", "ETag", "Last-Modified", "X-Cache"}
+
+// headerTime - the date in header name, zero if it is missing or invalid, which
+// makes the condition it carries be ignored as HTTP wants
+func headerTime(h http.Header, name string) time.Time {
+	t, err := http.ParseTime(h.Get(name))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
 }
 
 const serverName = "VOD S3 Helper"
@@ -48,211 +47,237 @@ func initRuntime() {
 func (a *App) proxyS3Media(w http.ResponseWriter, r *http.Request) {
 	nrtxn := a.nrapp.StartTransaction("S3Helper:proxyS3Media")
 	defer nrtxn.End()
+	iw := a.metrics.requestStarted(w)
+	w = iw
+	var s3Bucket string // the bucket label, set once the request is routed
+	defer func() {
+		a.metrics.requestDone(s3Bucket, r.Method, iw)
+		if s3Bucket != "" {
+			a.timeMetric("s3-helper:request", s3Bucket, time.Since(iw.start))
+		}
+	}()
 	w.Header().Set("Server", serverName)
+	if !a.isReady() {
+		// draining, make nginx open its next connection elsewhere
+		w.Header().Set("Connection", "close")
+	}
 
-	if r.Method != "GET" && r.Method != "HEAD" {
+	// the config this request sticks to, even if it is reloaded meanwhile
+	rc := a.snapshot()
+
+	if r.Method != "GET" && r.Method != "HEAD" && (r.Method != "OPTIONS" || rc.cors == nil) {
 		w.WriteHeader(405)
 		return
 	}
-	s3Path := r.URL.Path
-	s3Bucket := conf.S3Bucket
 
-	// Make sure that Remote Address is 127.0.0.1 so it comes off a local proxy
-	addr := strings.SplitN(r.RemoteAddr, ":", 2)
-	if len(addr) != 2 || addr[0] != "127.0.0.1" {
+	// Make sure the request comes off a local proxy, or whatever the access section allows
+	client, reason := rc.access.check(r)
+	if reason != "" {
+		log.Warn().
+			Str("remote_addr", r.RemoteAddr).
+			Str("client", client).
+			Str("reason", reason).
+			Str("path", r.URL.Path).
+			Msg("Access denied")
 		w.WriteHeader(403)
 		return
 	}
 
-	if r.URL.Path[:6] == "/avod/" {
-		p := []rune(r.URL.Path)
-		s3Path = string(p[5:])
-		s3Bucket = conf.S3AdBucket
+	if rc.cors != nil {
+		if r.Method == "OPTIONS" {
+			rc.cors.preflight(w, r)
+			return
+		}
+		if rc.cors.servePolicyFile(w, r) {
+			return
+		}
+		rc.cors.setHeaders(w.Header(), r)
 	}
-	byterange := r.Header.Get("Range")
-	logger := log.With().
-		Str("object", s3Path).Str("range", byterange).Str("method", r.Method).Logger()
 
-	// Bypass AWS SDK for S3 GetObject() call, sign and get the object manually via HTTP
-	s3url := fmt.Sprintf("http://s3-%s.amazonaws.com/%s%s%s", conf.S3Region, s3Bucket, conf.S3Path, s3Path)
-	log.Debug().Msg(fmt.Sprintf("Signed S3 URL: %s\n", s3url))
-	r2, err := http.NewRequest(r.Method, s3url, nil)
-	if err != nil {
-		w.WriteHeader(403)
-		logger.Error().
-			Str("error", err.Error()).
-			Str("url", s3url).
-			Msg("Failed to create GET request to S3")
+	if rc.conf.Presign.Endpoint && strings.HasPrefix(r.URL.Path, presignPrefix) {
+		a.servePresignEndpoint(w, r, rc, client)
 		return
 	}
 
-	r2 = awsauth.SignForRegion(r2, conf.S3Region, "s3")
-
-	r2.Header.Set("Host", r2.URL.Host)
-	// parse the byterange request header to derive the content-length requested
-	// so we know how much data we need to xfer from s3 to the client.
-	if byterange != "" {
-		r2.Header.Set("Range", byterange)
+	// e.g. /avod/ for the ad media bucket vs. / for the content bucket
+	rt := rc.routes.match(r.Host, r.URL.Path)
+	if rt == nil || rt.objectPath(r.URL.Path) == "/" {
+		w.WriteHeader(404)
+		return
 	}
+	s3Path := rt.objectPath(r.URL.Path)
+	s3Bucket = rt.bucket
 
-	var resp *http.Response
-
-	// setup client outside of for loop since we don't
-	// need to define it multiple times and failures
-	// shouldn't need a new client
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 1 * time.Second,
-			}).DialContext,
-			IdleConnTimeout:   30 * time.Second,
-			DisableKeepAlives: true, // terminates open connections
-		}}
-
-	resp, getErr := client.Do(r2)
+	byterange := r.Header.Get("Range")
+	key := rt.keyPrefix + s3Path
+	version := rc.version(r, s3Bucket, key)
+	logger := log.With().
+		Str("bucket", s3Bucket).Str("object", s3Path).Str("range", byterange).Str("method", r.Method).Logger()
+	if version != "" {
+		logger = logger.With().Str("version", version).Logger()
+	}
 
-	// resp is nil most likely if an error occurred
-	if getErr != nil {
-		// timeout error or network errors
-		if netErr, ok := getErr.(net.Error); ok && netErr.Timeout() {
-			// Timed out connecting to S3
-			a.nrapp.RecordCustomMetric("s3-helper:timeout", float64(0))
-			msg := fmt.Sprintf("AWS S3 Timeout for %s/%s", s3Bucket, s3Path)
-			logger.Error().
-				Str("error", netErr.Error()).
-				Str("details", msg).
-				Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
-		} else if netErr, ok := getErr.(net.Error); ok {
-			// Network Error connecting to S3
-			a.nrapp.RecordCustomMetric("s3-helper:neterror", float64(0))
-			msg := fmt.Sprintf("AWS S3 Network Error for %s/%s", s3Bucket, s3Path)
-			logger.Error().
-				Str("error", netErr.Error()).
-				Str("details", msg).
-				Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
+	objReq := &objectRequest{
+		Method:            r.Method,
+		Bucket:            s3Bucket,
+		Region:            rt.region,
+		Profile:           rt.profile,
+		Role:              rt.role,
+		Key:               key,
+		Version:           version,
+		Range:             byterange,
+		IfMatch:           r.Header.Get("If-Match"),
+		IfNoneMatch:       r.Header.Get("If-None-Match"),
+		IfModifiedSince:   headerTime(r.Header, "If-Modified-Since"),
+		IfUnmodifiedSince: headerTime(r.Header, "If-Unmodified-Since"),
+		IfRange:           r.Header.Get("If-Range"),
+		SSECustomer:       rt.sseCustomer,
+	}
+	if wantsRedirect(&rc.conf.Presign, rt, r) {
+		a.servePresigned(w, r, rc, objReq, client, true, &logger)
+		return
+	}
+	// S3 serves a single range per request: look the object up first, then fetch
+	// the ranges it takes
+	lookup := rc.conf.MultiRange.handles(r.Method, byterange)
+	if lookup {
+		objReq.Method = "HEAD"
+		objReq.Range, objReq.IfRange = "", ""
+	}
+	// a single S3 connection caps the throughput of large bodies: GETs ask for their
+	// first part only, and what the response tells of the object size decides
+	// whether the rest is fetched over several connections
+	probe, want, probing := rc.conf.ParallelDownload.probe(r.Method, byterange)
+	probing = probing && !lookup
+	if probing {
+		objReq.Range = probe
+		if byterange == "" {
+			objReq.IfRange = ""
 		}
-		// More network errors
-		switch t := getErr.(type) {
-		case *net.OpError:
-			if t.Op == "dial" {
-				// "Unknown host"
-				a.nrapp.RecordCustomMetric("s3-helper:netunknownhost", float64(0))
-				msg := fmt.Sprintf("AWS S3 Unknown Host Error for %s/%s", s3Bucket, s3Path)
-				logger.Error().
-					Str("error", getErr.Error()).
-					Str("details", msg).
-					Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
-			} else if t.Op == "read" {
-				// "Connection refused"
-				a.nrapp.RecordCustomMetric("s3-helper:connectionrefused", float64(0))
-				msg := fmt.Sprintf("AWS S3 Connection Refused Error for %s/%s", s3Bucket, s3Path)
-				logger.Error().
-					Str("error", getErr.Error()).
-					Str("details", msg).
-					Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
-			}
-		case syscall.Errno:
-			if t == syscall.ECONNREFUSED {
-				// "Connection refused"
-				a.nrapp.RecordCustomMetric("s3-helper:connectionrefused", float64(0))
-				msg := fmt.Sprintf("AWS S3 Connection Refused Error for %s/%s", s3Bucket, s3Path)
-				logger.Error().
-					Str("error", getErr.Error()).
-					Str("details", msg).
-					Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
-			}
+	}
+	fetchStart := time.Now()
+	resp, getErr := rc.objectBackend().Fetch(r.Context(), objReq, &logger)
+	if probing && byterange == "" && unsatisfiable(resp, getErr) {
+		// the object is empty, so no range of it can be had
+		if getErr == nil {
+			resp.Body.Close()
 		}
+		probing = false
+		objReq.Range = ""
+		resp, getErr = rc.objectBackend().Fetch(r.Context(), objReq, &logger)
+	}
+	a.timeMetric("s3-helper:s3fetch", s3Bucket, time.Since(fetchStart))
 
-		// Casting to the awserr.Error type will allow you to inspect the error
-		// code returned by the service in code. The error code can be used
-		// to switch on context specific functionality. In this case a context
-		// specific error message is printed to the user based on the bucket
-		// and key existing.
-		//
-		// For information on other S3 API error codes see:
-		// http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
-		//
-		// fmt.Println(awsErr.Code(), awsErr.Message(), awsErr.OrigErr())
-		returnCode := 500 // return the actual error rather than generic 500
-		msg := ""
-		if aerr, ok := getErr.(awserr.Error); ok {
-			if reqErr, ok := getErr.(awserr.RequestFailure); ok {
-				returnCode = reqErr.StatusCode()
-				if reqErr.StatusCode() == 503 {
-					// AWS SlowDown Throttling S3 Bucket
-					// Trick taken from: https://github.com/go-spatial/tegola/issues/458
-					a.nrapp.RecordCustomMetric("s3-helper:s3slowdown503", float64(0))
-					msg = fmt.Sprintf("SlowDown Throttling on %s/%s", s3Bucket, s3Path)
-					logger.Error().
-						Str("error", getErr.Error()).
-						Str("details", msg).
-						Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
-				} else if reqErr.StatusCode() == 404 {
-					a.nrapp.RecordCustomMetric("s3-helper:s3status404", float64(0))
-				} else {
-					a.nrapp.RecordCustomMetric(fmt.Sprintf("s3-helper:s3status%d", reqErr.StatusCode()), float64(0))
-				}
-			}
+	// resp is nil most likely if an error occurred
+	if getErr != nil {
+		uerr := a.classifyFetchError(getErr, s3Bucket, s3Path, &logger)
+		a.metrics.upstreamError(s3Bucket, errorClass(uerr))
+		nrtxn.NoticeError(fmt.Errorf("[ERROR] s3:Get:Err - path:%s %v", s3Path, getErr))
+		writeUpstreamError(w, r, uerr)
+		return
+	}
+	defer resp.Body.Close()
 
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchBucket:
-				msg = fmt.Sprintf("bucket %s does not exist", s3Bucket)
-				a.nrapp.RecordCustomMetric("s3-helper:s3nosuchbucket", float64(0))
-			case s3.ErrCodeNoSuchKey:
-				msg = fmt.Sprintf("object with key %s does not exist in bucket %s", s3Path, s3Bucket)
-				a.nrapp.RecordCustomMetric("s3-helper:s3nosuchkey", float64(0))
-			default:
-				msg = fmt.Sprintf("s3 unknown error: %v %v %v", aerr.Code(), aerr.Message(), aerr.OrigErr())
-				a.nrapp.RecordCustomMetric("s3-helper:s3unknownerror", float64(0))
+	if resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPreconditionFailed {
+		// a condition of the client's failed, which is an answer rather than an error
+		a.countMetric(fmt.Sprintf("s3-helper:s3status%d", resp.StatusCode), s3Bucket)
+		validators := make(http.Header, len(conditionHeaders))
+		for _, name := range conditionHeaders {
+			if v := resp.Header.Get(name); v != "" {
+				validators.Set(name, v)
 			}
-			logger.Error().
-				Str("error", getErr.Error()).
-				Str("details", msg).
-				Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
 		}
-		msg = fmt.Sprintf("[ERROR] s3:Get:Err - path:%s %v\n", s3Path, getErr)
-		nrtxn.NoticeError(errors.New(msg))
+		rc.headers.write(w.Header(), validators, rt, r.URL.Path)
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		a.countMetric(fmt.Sprintf("s3-helper:s3badrespons%d", resp.StatusCode), s3Bucket)
+		uerr := parseS3ErrorResponse(resp)
+		a.metrics.upstreamError(s3Bucket, errorClass(uerr))
+		nrtxn.NoticeError(fmt.Errorf("[ERROR] s3:Get:Err - path:%s %s bad response code %d", s3Path, uerr.Code, resp.StatusCode))
 		logger.Error().
-			Str("error", getErr.Error()).
-			Str("details", msg).
-			Str("s3_statuscode: ", fmt.Sprintf("%d", returnCode)).
-			Msg(fmt.Sprintf("s3:Get:Err - path:%s", s3Path))
-		w.WriteHeader(500) // Return same error code back from S3 to Nginx
+			Str("error", "Status code was outside 2xx range.").
+			Str("details", uerr.Message).
+			Str("s3_code", uerr.Code).
+			Int("s3_statuscode", uerr.S3Status).
+			Int("http_statuscode", uerr.Status).
+			Str("s3_request_id", uerr.RequestID).
+			Str("s3_host_id", uerr.HostID).
+			Msg(fmt.Sprintf("s3:Get:Err - path:%s bad response code %d", s3Path, resp.StatusCode))
+		writeUpstreamError(w, r, uerr)
 		return
-	} else {
-		defer resp.Body.Close()
-		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-			a.nrapp.RecordCustomMetric("s3-helper:s3success", float64(0))
+	}
+	a.countMetric("s3-helper:s3success", s3Bucket)
+
+	header := make(http.Header)
+	rc.headers.write(header, resp.Header, rt, r.URL.Path)
+	var serveParts func() (int64, bool, error)
+	switch {
+	case lookup:
+		serveParts = func() (int64, bool, error) {
+			return a.serveRanges(w, r, rc, *objReq, resp, header, &logger)
+		}
+	case probing && resp.StatusCode == http.StatusPartialContent:
+		// the rest of what was asked for comes after the probe.  A probe whose
+		// If-Range failed gets the whole object as a 200, which is passed on as is.
+		probed, size, ok := responseRange(resp)
+		if !ok {
+			break
+		}
+		rng := want.resolve(size)
+		parts := partsRequest(*objReq, resp)
+		pd := &rc.conf.ParallelDownload
+		buffered := pd.buffered(rng)
+		parallel := pd.covers(rng.length())
+		if parallel && !a.parallelMemory.reserve(buffered) {
+			// other downloads hold the memory parts are buffered in
+			a.countMetric("s3-helper:parallelfallback", s3Bucket)
+			parallel = false
+		}
+		if parallel {
+			serveParts = func() (int64, bool, error) {
+				defer a.parallelMemory.release(buffered)
+				return a.serveParallel(w, r.Context(), rc, parts, resp, header, rng, size, resp.Body, &logger)
+			}
 		} else {
-			a.nrapp.RecordCustomMetric(fmt.Sprintf("s3-helper:s3badrespons%d", resp.StatusCode), float64(0))
-			msg := fmt.Sprintf("[ERROR] s3:Get:Err - path:%s %v bad response code %d\n", s3Path, getErr, resp.StatusCode)
-			w.WriteHeader(resp.StatusCode) // Return same error code back from S3 to Nginx
-			nrtxn.NoticeError(errors.New(msg))
+			serveParts = func() (int64, bool, error) {
+				return a.serveProbed(w, r.Context(), rc, parts, resp, header, probed, rng, size, &logger)
+			}
+		}
+	}
+	if serveParts != nil {
+		bytes, started, err := serveParts()
+		switch {
+		case err != nil && !started:
+			uerr := a.classifyFetchError(err, s3Bucket, s3Path, &logger)
+			a.metrics.upstreamError(s3Bucket, errorClass(uerr))
+			nrtxn.NoticeError(fmt.Errorf("[ERROR] s3:Get:Err - path:%s %v", s3Path, err))
+			writeUpstreamError(w, r, uerr)
+		case err != nil:
+			a.countMetric("s3-helper:failure", s3Bucket)
 			logger.Error().
-				Str("error", "Status code was outside 2xx range.").
-				Str("http_statuscode", fmt.Sprintf("%d", resp.StatusCode)).
-				Msg(fmt.Sprintf("s3:Get:Err - path:%s bad response code %d", s3Path, resp.StatusCode))
-			return
+				Str("error", err.Error()).
+				Int64("recv", bytes).
+				Msg("s3:bodyread- failure sending ranges")
+		default:
+			a.countMetric("s3-helper:success", s3Bucket)
 		}
+		return
 	}
 
-	header := resp.Header
-	for name, hflag := range headerForward {
-		if hflag {
-			if v := header.Get(name); v != "" {
-				w.Header().Set(name, v)
-			}
+	copyObjectHeaders(w, header)
+	for _, name := range []string{"Content-Range", "Content-Type"} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
 		}
 	}
-
-	w.WriteHeader(resp.StatusCode)
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
-	w.Header().Set("Content-Type", resp.Header.Get("Content-type"))
+	w.WriteHeader(resp.StatusCode)
 
 	// Only return headers
-	if r2.Method == "HEAD" {
+	if r.Method == "HEAD" {
 		return
 	}
 
@@ -262,7 +287,7 @@ func (a *App) proxyS3Media(w http.ResponseWriter, r *http.Request) {
 		// we failed copying the body yet already sent the http header so can't tell
 		// the client that it failed.
 		if errors.Is(err, syscall.EPIPE) {
-			a.nrapp.RecordCustomMetric("s3-helper:disconnect", float64(0))
+			a.countMetric("s3-helper:disconnect", s3Bucket)
 			logger.Debug().
 				Str("warning", err.Error()).
 				Int64("content-length", resp.ContentLength).
@@ -270,7 +295,8 @@ func (a *App) proxyS3Media(w http.ResponseWriter, r *http.Request) {
 				Msg("s3:bodyread- s3 disconnect on body copy")
 			return // S3 Disconnected during body copy
 		} else {
-			a.nrapp.RecordCustomMetric("s3-helper:failure", float64(0))
+			a.countMetric("s3-helper:failure", s3Bucket)
+			a.metrics.upstreamError(s3Bucket, errClassBody)
 			msg := fmt.Sprintf("[ERROR] S3:Read:Err - path:%s %v\n", s3Path, err)
 			nrtxn.NoticeError(errors.New(msg))
 			logger.Error().
@@ -281,7 +307,7 @@ func (a *App) proxyS3Media(w http.ResponseWriter, r *http.Request) {
 			return // S3 body copy Unknown Failure
 		}
 	} else {
-		a.nrapp.RecordCustomMetric("s3-helper:success", float64(0))
+		a.countMetric("s3-helper:success", s3Bucket)
 		logger.Debug().
 			Str("path", s3Path).
 			Int64("content-length", resp.ContentLength).
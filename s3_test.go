@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crunchyroll/evs-s3helper/awsclient"
+	"github.com/crunchyroll/evs-s3helper/credentials"
+)
+
+// newMockApp - an App whose SDK backend is driven by awsclient's in-memory mock
+func newMockApp(files map[string]interface{}) *App {
+	conf.S3Bucket = "svod"
+	conf.S3AdBucket = "avod"
+	conf.S3Path = ""
+	conf.S3Region = "us-east-1"
+	conf.S3Backend = backendSDK
+	conf.Logging.Level = "info"
+	conf.Access.Allow = []string{"127.0.0.0/8", "::1"}
+	conf.Headers.Forward = []string{"Accept-Ranges", "Cache-Control", "Content-Disposition", "Content-Encoding",
+		"Date", "ETag", "Last-Modified", "X-Amz-Version-Id", "X-Cache"}
+	a := &App{sdkClient: awsclient.NewMockS3Client(files)}
+	rc, err := a.newRuntimeConfig(&conf)
+	if err != nil {
+		panic(err)
+	}
+	a.setSnapshot(rc)
+	return a
+}
+
+// withConfig - swaps in a snapshot built by newRuntimeConfig, as a reload would,
+// from a copy of a's config changed by edit
+func withConfig(t *testing.T, a *App, edit func(c *Config)) {
+	t.Helper()
+	// a deep copy, so that edit can't change the config of the current snapshot
+	b, err := json.Marshal(a.snapshot().conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		t.Fatal(err)
+	}
+	edit(&c)
+	rc, err := a.newRuntimeConfig(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.setSnapshot(rc)
+}
+
+func serveMock(a *App, method, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = "127.0.0.1:54321"
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	a.proxyS3Media(w, r)
+	return w
+}
+
+func TestProxyS3Media_SDKBackend(t *testing.T) {
+	a := newMockApp(map[string]interface{}{
+		"svod/show/manifest.json": []byte(`{"segments":10}`),
+		"avod/ad/manifest.json":   []byte(`{"ads":1}`),
+	})
+
+	w := serveMock(a, "GET", "/show/manifest.json", nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"segments":10}` {
+		t.Fatalf("GET: unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Fatalf("GET: ETag was not forwarded: %v", w.Header())
+	}
+
+	w = serveMock(a, "GET", "/avod/ad/manifest.json", nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"ads":1}` {
+		t.Fatalf("GET avod: unexpected response %d %q", w.Code, w.Body.String())
+	}
+
+	w = serveMock(a, "GET", "/show/manifest.json", http.Header{"Range": {"bytes=1-10"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != `"segments"` {
+		t.Fatalf("GET range: unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 1-10/15" {
+		t.Fatalf("GET range: unexpected Content-Range %q", cr)
+	}
+
+	w = serveMock(a, "HEAD", "/show/manifest.json", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("HEAD: unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyS3Media_Errors(t *testing.T) {
+	a := newMockApp(map[string]interface{}{})
+
+	if w := serveMock(a, "GET", "/show/missing.ts", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("missing key: unexpected status %d", w.Code)
+	}
+	for _, path := range []string{"/", "/a", "/avod"} {
+		if w := serveMock(a, "GET", path, nil); w.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+	if w := serveMock(a, "POST", "/show/manifest.json", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST: expected 405, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/show/manifest.json", nil)
+	r.RemoteAddr = "10.1.2.3:54321"
+	w := httptest.NewRecorder()
+	a.proxyS3Media(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("remote client: expected 403, got %d", w.Code)
+	}
+}
+
+func TestProxyS3Media_Conditional(t *testing.T) {
+	a := newMockApp(map[string]interface{}{
+		"svod/show/manifest.json": []byte(`{"segments":10}`),
+	})
+	const etag = `"this-is-a-dummy-etag"`
+	const before, after = "Thu, 31 Dec 2020 00:00:00 GMT", "Sat, 02 Jan 2021 00:00:00 GMT"
+
+	for _, tc := range []struct {
+		method string
+		header http.Header
+		status int
+		body   string
+	}{
+		{"GET", http.Header{"If-None-Match": {etag}}, http.StatusNotModified, ""},
+		{"GET", http.Header{"If-None-Match": {`"other"`}}, http.StatusOK, `{"segments":10}`},
+		{"HEAD", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified, ""},
+		{"GET", http.Header{"If-Match": {etag}}, http.StatusOK, `{"segments":10}`},
+		{"GET", http.Header{"If-Match": {`"other"`}}, http.StatusPreconditionFailed, ""},
+		{"GET", http.Header{"If-Modified-Since": {after}}, http.StatusNotModified, ""},
+		{"GET", http.Header{"If-Modified-Since": {before}}, http.StatusOK, `{"segments":10}`},
+		{"GET", http.Header{"If-Modified-Since": {"garbage"}}, http.StatusOK, `{"segments":10}`},
+		{"GET", http.Header{"If-Unmodified-Since": {before}}, http.StatusPreconditionFailed, ""},
+		{"GET", http.Header{"Range": {"bytes=1-10"}, "If-Range": {etag}}, http.StatusPartialContent, `"segments"`},
+		{"GET", http.Header{"Range": {"bytes=1-10"}, "If-Range": {`"other"`}}, http.StatusOK, `{"segments":10}`},
+		{"GET", http.Header{"Range": {"bytes=1-10"}, "If-Range": {before}}, http.StatusOK, `{"segments":10}`},
+	} {
+		w := serveMock(a, tc.method, "/show/manifest.json", tc.header)
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Fatalf("%s %v: expected %d %q, got %d %q", tc.method, tc.header, tc.status, tc.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestProxyS3Media_ConditionalSigned(t *testing.T) {
+	conditions := http.Header{
+		"If-Match":            {`"a"`},
+		"If-None-Match":       {`"b"`},
+		"If-Modified-Since":   {"Thu, 31 Dec 2020 00:00:00 GMT"},
+		"If-Unmodified-Since": {"Sat, 02 Jan 2021 00:00:00 GMT"},
+		"If-Range":            {`"c"`},
+		"Range":               {"bytes=0-9"},
+	}
+	status := http.StatusNotModified
+	var requestURI string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+		signed := "SignedHeaders=host;if-match;if-modified-since;if-none-match;if-range;if-unmodified-since;range;"
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, signed) {
+			t.Errorf("conditional headers not signed: %s", auth)
+		}
+		for name := range conditions {
+			if r.Header.Get(name) != conditions.Get(name) {
+				t.Errorf("%s: expected %q, got %q", name, conditions.Get(name), r.Header.Get(name))
+			}
+		}
+		w.Header().Set("ETag", `"b"`)
+		w.WriteHeader(status)
+		if status == http.StatusPreconditionFailed {
+			w.Write([]byte("<Error><Code>PreconditionFailed</Code></Error>"))
+		}
+	}))
+	defer server.Close()
+
+	a := newMockApp(nil)
+	endpoints, err := newEndpointResolver(&Config{S3Endpoint: endpointConfig{URL: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := *a.snapshot()
+	creds := &credentialSet{caches: map[credentialKey]*credentials.Cache{
+		{}: credentials.NewCache(credentials.Static{AccessKeyID: "AKID", SecretAccessKey: "secret"}, 0),
+	}}
+	rc.backend = &signedBackend{
+		client:      server.Client(),
+		endpoints:   endpoints,
+		credentials: creds,
+		retry:       retryPolicy{maxAttempts: 1, timeout: time.Second},
+		app:         a,
+	}
+	rc.objects = rc.backend
+	a.setSnapshot(&rc)
+
+	w := serveMock(a, "GET", "/show/seg1.ts", conditions)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != `"b"` {
+		t.Fatalf("expected a 304, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	status = http.StatusPreconditionFailed
+	if w := serveMock(a, "GET", "/show/seg1.ts", conditions); w.Code != http.StatusPreconditionFailed || w.Body.Len() != 0 {
+		t.Fatalf("expected a 412, got %d %q", w.Code, w.Body.String())
+	}
+
+	// keys are escaped the way they were signed
+	serveMock(a, "GET", "/show/seg%201+%C3%A9.ts", conditions)
+	if !strings.HasSuffix(requestURI, "/show/seg%201%2B%C3%A9.ts") {
+		t.Fatalf("unexpected request URI %s", requestURI)
+	}
+}
@@ -0,0 +1,294 @@
+// Package sigv4 signs HTTP requests with AWS Signature Version 4.  It follows
+// AWS's published SigV4 test suite, plus the S3 flavour of it: object keys are
+// escaped once and never normalized, and the payload hash, which may be
+// UNSIGNED-PAYLOAD, is sent in X-Amz-Content-Sha256.
+package sigv4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm = "AWS4-HMAC-SHA256"
+
+	// TimeFormat - of X-Amz-Date
+	TimeFormat = "20060102T150405Z"
+
+	// UnsignedPayload - the payload hash of requests whose body isn't signed
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// EmptyPayload - the payload hash of requests without a body
+	EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// ignoredHeaders - headers that aren't signed, as proxies and the http package
+// may change them on the way
+var ignoredHeaders = map[string]bool{
+	"Authorization":   true,
+	"User-Agent":      true,
+	"X-Amzn-Trace-Id": true,
+	"Expect":          true,
+}
+
+// Credentials - the keys requests are signed with, and the session token of
+// temporary credentials
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Signer - signs requests to a service in a region
+type Signer struct {
+	Credentials Credentials
+	Region      string
+	Service     string
+}
+
+// Sign - signs req as of t, setting its X-Amz-Date, X-Amz-Security-Token and
+// Authorization headers, and X-Amz-Content-Sha256 for S3.  Every header already
+// set on req, such as Range and the conditional headers, is signed.  payloadHash
+// is the hex SHA-256 of the body, UnsignedPayload, or "" to have the body hashed,
+// which needs req.GetBody.  The URL's path and query are rewritten in their
+// canonical encoding, so that what is sent is what was signed.
+func (s *Signer) Sign(req *http.Request, payloadHash string, t time.Time) error {
+	if payloadHash == "" {
+		var err error
+		if payloadHash, err = hashBody(req); err != nil {
+			return err
+		}
+	}
+
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(TimeFormat))
+	if s.Credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	}
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	creq, signedHeaders, err := s.canonicalRequest(req, req.Header, payloadHash)
+	if err != nil {
+		return err
+	}
+	scope := s.scope(t)
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(t), stringToSign(t, scope, creq)))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, s.Credentials.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// MaxPresignExpiry - the longest a presigned URL may be valid for
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// Presign - the URL of req presigned as of t for expires: the signature goes in
+// the query string rather than in headers, so that the URL can be handed to a
+// client.  Only Host is signed, and the payload isn't, so whoever has the URL can
+// make the request with any headers, e.g. a Range.  req's headers are left alone.
+func (s *Signer) Presign(req *http.Request, expires time.Duration, t time.Time) (*url.URL, error) {
+	if expires < time.Second || expires > MaxPresignExpiry {
+		return nil, fmt.Errorf("sigv4: presigned URLs expire within 1s to %v, not %v", MaxPresignExpiry, expires)
+	}
+
+	t = t.UTC()
+	scope := s.scope(t)
+	query := req.URL.Query()
+	query.Set("X-Amz-Algorithm", algorithm)
+	query.Set("X-Amz-Credential", s.Credentials.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", t.Format(TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if s.Credentials.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	}
+
+	presigned := *req
+	u := *req.URL
+	u.RawQuery = query.Encode()
+	presigned.URL = &u
+	creq, _, err := s.canonicalRequest(&presigned, nil, UnsignedPayload)
+	if err != nil {
+		return nil, err
+	}
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(t), stringToSign(t, scope, creq)))
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return &u, nil
+}
+
+// scope - the credential scope of signatures made at t
+func (s *Signer) scope(t time.Time) string {
+	return strings.Join([]string{t.Format("20060102"), s.Region, s.Service, "aws4_request"}, "/")
+}
+
+// hashBody - the payload hash of req's body, read through GetBody so that the
+// body itself is left to be sent
+func hashBody(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return EmptyPayload, nil
+	}
+	if req.GetBody == nil {
+		return "", errors.New("sigv4: the body can't be hashed without GetBody, pass its hash")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return hashHex(b), nil
+}
+
+// canonicalRequest - the canonical form of req, signing header, and the list of
+// headers signed
+func (s *Signer) canonicalRequest(req *http.Request, header http.Header, payloadHash string) (string, string, error) {
+	p := req.URL.Path
+	if p == "" {
+		p = "/"
+	}
+	req.URL.RawPath = escapePath(p)
+	canonicalPath := req.URL.RawPath
+	if s.Service != "s3" {
+		canonicalPath = escapePath(normalizePath(p))
+	}
+
+	query, err := canonicalQuery(req.URL.RawQuery)
+	if err != nil {
+		return "", "", err
+	}
+	req.URL.RawQuery = query
+
+	headers, signedHeaders := canonicalHeaders(req, header)
+	return strings.Join([]string{req.Method, canonicalPath, query, headers, signedHeaders, payloadHash}, "\n"),
+		signedHeaders, nil
+}
+
+// normalizePath - p without empty, . and .. segments, keeping a trailing slash.
+// S3 keys are taken as they are.
+func normalizePath(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// canonicalQuery - the query parameters of rawQuery, escaped and sorted by name
+// then value
+func canonicalQuery(rawQuery string) (string, error) {
+	if rawQuery == "" {
+		return "", nil
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", fmt.Errorf("sigv4: query: %v", err)
+	}
+	params := make([]string, 0, len(values))
+	for name, vs := range values {
+		for _, v := range vs {
+			params = append(params, escape(name)+"="+escape(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&"), nil
+}
+
+// canonicalHeaders - header and req's host as "name:value\n" lines, and their
+// names separated by semicolons
+func canonicalHeaders(req *http.Request, header http.Header) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	for name, vs := range header {
+		if ignoredHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		trimmed := make([]string, len(vs))
+		for i, v := range vs {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + values[name] + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+func stringToSign(t time.Time, scope, creq string) []byte {
+	return []byte(strings.Join([]string{algorithm, t.Format(TimeFormat), scope, hashHex([]byte(creq))}, "\n"))
+}
+
+// signingKey - the key derived from the secret for the day, region and service
+func (s *Signer) signingKey(t time.Time) []byte {
+	key := hmacSHA256([]byte("AWS4"+s.Credentials.SecretAccessKey), []byte(t.Format("20060102")))
+	key = hmacSHA256(key, []byte(s.Region))
+	key = hmacSHA256(key, []byte(s.Service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// escapePath - p with every byte but the unreserved characters and slashes
+// percent-encoded
+func escapePath(p string) string {
+	return escapeExcept(p, '/')
+}
+
+// escape - s with every byte but the unreserved characters percent-encoded, as
+// SigV4 wants query parameters: spaces are %20 and + is %2B
+func escape(s string) string {
+	return escapeExcept(s, 0)
+}
+
+func escapeExcept(s string, keep byte) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if unreserved(c) || (keep != 0 && c == keep) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func unreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// sseCustomerAlgorithm - the only algorithm SSE-C supports
+const sseCustomerAlgorithm = "AES256"
+
+// Request headers carrying the SSE-C key, see
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/ServerSideEncryptionCustomerKeys.html
+const (
+	sseCustomerAlgorithmHeader = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	sseCustomerKeyHeader       = "X-Amz-Server-Side-Encryption-Customer-Key"
+	sseCustomerKeyMD5Header    = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+)
+
+// sseCustomerKey - the SSE-C key objects of a route are encrypted with.  S3 needs
+// it along with every GET and HEAD of them.  The key itself is never logged,
+// String only gives its MD5.
+type sseCustomerKey struct {
+	key    string // the raw 256 bit key
+	base64 string // the key as sent to S3
+	md5    string // base64 MD5 of the key
+}
+
+// loadSSECustomerKey - the base64 encoded 256 bit key in the file or environment
+// variable c names, nil if it names neither
+func loadSSECustomerKey(c *sseCustomerKeyConfig) (*sseCustomerKey, error) {
+	var encoded string
+	switch {
+	case c.File != "" && c.Env != "":
+		return nil, errors.New("set either file or env, not both")
+	case c.File != "":
+		b, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	case c.Env != "":
+		encoded = os.Getenv(c.Env)
+		if encoded == "" {
+			return nil, fmt.Errorf("$%s is not set", c.Env)
+		}
+	default:
+		return nil, nil
+	}
+
+	// the error and the key are left out of messages, they could give the key away
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("the key is not a base64 encoded 256 bit key")
+	}
+	sum := md5.Sum(raw)
+	return &sseCustomerKey{
+		key:    string(raw),
+		base64: base64.StdEncoding.EncodeToString(raw),
+		md5:    base64.StdEncoding.EncodeToString(sum[:]),
+	}, nil
+}
+
+// setHeaders - adds the SSE-C headers to the headers of a request to S3
+func (k *sseCustomerKey) setHeaders(h http.Header) {
+	h.Set(sseCustomerAlgorithmHeader, sseCustomerAlgorithm)
+	h.Set(sseCustomerKeyHeader, k.base64)
+	h.Set(sseCustomerKeyMD5Header, k.md5)
+}
+
+func (k *sseCustomerKey) String() string {
+	return "SSE-C key with MD5 " + k.md5
+}
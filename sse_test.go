@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSSEKey    = []byte("0123456789abcdef0123456789abcdef")
+	testSSEKeyB64 = base64.StdEncoding.EncodeToString(testSSEKey)
+)
+
+// writeSSEKey - a file holding contents, as sse_customer_key.file
+func writeSSEKey(t *testing.T, contents string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "sse.key")
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadSSECustomerKey(t *testing.T) {
+	sum := md5.Sum(testSSEKey)
+	wantMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	k, err := loadSSECustomerKey(&sseCustomerKeyConfig{File: writeSSEKey(t, testSSEKeyB64+"\n")})
+	if err != nil || k.key != string(testSSEKey) || k.base64 != testSSEKeyB64 || k.md5 != wantMD5 {
+		t.Fatalf("unexpected %+v, %v", k, err)
+	}
+	if strings.Contains(k.String(), testSSEKeyB64) || !strings.Contains(k.String(), wantMD5) {
+		t.Fatalf("String gives the key away: %s", k)
+	}
+
+	os.Setenv("S3HELPER_TEST_SSE_KEY", testSSEKeyB64)
+	defer os.Unsetenv("S3HELPER_TEST_SSE_KEY")
+	if k, err := loadSSECustomerKey(&sseCustomerKeyConfig{Env: "S3HELPER_TEST_SSE_KEY"}); err != nil || k.md5 != wantMD5 {
+		t.Fatalf("env: unexpected %+v, %v", k, err)
+	}
+	if k, err := loadSSECustomerKey(&sseCustomerKeyConfig{}); k != nil || err != nil {
+		t.Fatalf("unset: unexpected %+v, %v", k, err)
+	}
+
+	short := base64.StdEncoding.EncodeToString(testSSEKey[:16])
+	for _, c := range []sseCustomerKeyConfig{
+		{File: writeSSEKey(t, short)},
+		{File: writeSSEKey(t, "not base64!")},
+		{File: filepath.Join(t.TempDir(), "missing")},
+		{Env: "S3HELPER_TEST_SSE_KEY_UNSET"},
+		{File: writeSSEKey(t, testSSEKeyB64), Env: "S3HELPER_TEST_SSE_KEY"},
+	} {
+		_, err := loadSSECustomerKey(&c)
+		if err == nil {
+			t.Errorf("%+v: expected an error", c)
+		} else if strings.Contains(err.Error(), short) {
+			t.Errorf("%+v: the error gives the key away: %v", c, err)
+		}
+	}
+}
+
+func TestRouteTable_SSECustomerKey(t *testing.T) {
+	file := writeSSEKey(t, testSSEKeyB64)
+	table, err := newRouteTable(&Config{S3Region: "us-east-1", Routes: []routeConfig{
+		{Prefix: "/", Bucket: "svod"},
+		{Prefix: "/premium/", Bucket: "premium", SSECustomerKey: sseCustomerKeyConfig{File: file}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt := table.match("", "/premium/a.ts"); rt.sseCustomer == nil {
+		t.Fatalf("no SSE-C key on the premium route")
+	}
+	if rt := table.match("", "/a.ts"); rt.sseCustomer != nil {
+		t.Fatalf("SSE-C key on the plain route")
+	}
+
+	for _, rc := range []routeConfig{
+		{Prefix: "/premium/", Bucket: "premium", SSECustomerKey: sseCustomerKeyConfig{File: writeSSEKey(t, "short")}},
+		{Prefix: "/premium/", Bucket: "premium", SSECustomerKey: sseCustomerKeyConfig{File: file}, Redirect: true},
+	} {
+		if _, err := newRouteTable(&Config{S3Region: "us-east-1", Routes: []routeConfig{rc}}); err == nil {
+			t.Errorf("%+v: expected an error", rc)
+		}
+	}
+}
+
+func TestProxyS3Media_SSECustomerKey(t *testing.T) {
+	sum := md5.Sum(testSSEKey)
+	s3 := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/svod/show/seg1.ts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, want := range map[string]string{
+			sseCustomerAlgorithmHeader: "AES256",
+			sseCustomerKeyHeader:       testSSEKeyB64,
+			sseCustomerKeyMD5Header:    base64.StdEncoding.EncodeToString(sum[:]),
+		} {
+			if got := r.Header.Get(name); got != want {
+				t.Errorf("%s: expected %q, got %q", name, want, got)
+			}
+			if auth := r.Header.Get("Authorization"); !strings.Contains(auth, strings.ToLower(name)) {
+				t.Errorf("%s isn't signed: %s", name, auth)
+			}
+		}
+		w.Write([]byte("decrypted"))
+	}
+	a := newSignedMockApp(t, s3, 0, func(c *Config) {
+		c.Presign = presignConfig{Expires: time.Hour, QueryFlag: "redirect", Endpoint: true}
+		c.Routes = []routeConfig{
+			{Prefix: "/", Bucket: "svod", SSECustomerKey: sseCustomerKeyConfig{File: writeSSEKey(t, testSSEKeyB64)}},
+		}
+	})
+
+	// SSE-C objects are always proxied, as clients don't have the key
+	for _, target := range []string{"/show/seg1.ts", "/show/seg1.ts?redirect=1"} {
+		if w := serveMock(a, "GET", target, nil); w.Code != http.StatusOK || w.Body.String() != "decrypted" {
+			t.Fatalf("%s: unexpected response %d %q", target, w.Code, w.Body.String())
+		}
+	}
+	if w := serveMock(a, "GET", "/presign/svod/show/seg1.ts", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("presign: expected 403, got %d", w.Code)
+	}
+}
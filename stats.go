@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// statsdName - the statsd twin of a New Relic custom metric name, e.g.
+// s3-helper.s3success for s3-helper:s3success; ':' separates the value in statsd
+func statsdName(name string) string {
+	return strings.Replace(name, ":", ".", -1)
+}
+
+func bucketTags(bucket string) []string {
+	if bucket == "" {
+		return nil
+	}
+	return []string{"bucket:" + bucket}
+}
+
+// countMetric - counts an event in New Relic and statsd, tagged with bucket unless
+// it is ""
+func (a *App) countMetric(name, bucket string) {
+	a.recordMetric(name, bucket, 0)
+}
+
+// recordMetric - same as countMetric, with value recorded in New Relic
+func (a *App) recordMetric(name, bucket string, value float64) {
+	a.nrapp.RecordCustomMetric(name, value)
+	a.statsd.Incr(statsdName(name), bucketTags(bucket)...)
+}
+
+// timeMetric - records a duration in statsd; New Relic times its transactions itself
+func (a *App) timeMetric(name, bucket string, d time.Duration) {
+	a.statsd.Timing(statsdName(name), d, bucketTags(bucket)...)
+}
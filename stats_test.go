@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crunchyroll/evs-s3helper/statsd"
+)
+
+func TestStatsd_ProxyRequests(t *testing.T) {
+	agent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	a := newMockApp(map[string]interface{}{"svod/show/manifest.json": []byte(`{"segments":10}`)})
+	a.statsd, err = statsd.New(agent.LocalAddr().String(), statsd.Options{Tags: []string{"env:test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveMock(a, "GET", "/show/manifest.json", nil)
+	serveMock(a, "GET", "/avod/missing.json", nil)
+	a.statsd.Close()
+
+	var lines []string
+	for {
+		agent.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := make([]byte, 65536)
+		n, err := agent.Read(buf)
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	got := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"s3-helper.s3success:1|c|#env:test,bucket:svod",
+		"s3-helper.success:1|c|#env:test,bucket:svod",
+		"s3-helper.s3status404:1|c|#env:test,bucket:avod",
+		"s3-helper.s3nosuchkey:1|c|#env:test,bucket:avod",
+	} {
+		if !strings.Contains(got, want+"\n") && !strings.HasSuffix(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	for _, timer := range []string{"s3-helper.s3fetch:", "s3-helper.request:"} {
+		if !strings.Contains(got, timer) {
+			t.Errorf("missing timer %q in:\n%s", timer, got)
+		}
+	}
+}
+
+func TestStatsdName(t *testing.T) {
+	if got := statsdName("s3-helper:pool:idle"); got != "s3-helper.pool.idle" {
+		t.Fatalf("unexpected name %q", got)
+	}
+}
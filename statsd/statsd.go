@@ -0,0 +1,222 @@
+// Package statsd is a small statsd client speaking the DogStatsD dialect, i.e. with
+// tags.  Metrics are queued without blocking the caller and sent over UDP in batches
+// by a background goroutine; when the queue is full metrics are dropped rather than
+// slowing down requests.
+package statsd
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the zero values of Options
+const (
+	DefaultMaxPacketSize = 1432 // fits the MTU of most networks once IP and UDP headers are added
+	DefaultFlushInterval = 100 * time.Millisecond
+	DefaultQueueSize     = 8192
+)
+
+// Options - tuning of a Client
+type Options struct {
+	Tags          []string // added to every metric, e.g. "env:prod"
+	SampleRate    float32  // share of the counters and timers sent, 0 or 1 sends all
+	MaxPacketSize int
+	FlushInterval time.Duration
+	QueueSize     int
+}
+
+// Client - sends metrics to a statsd agent.  A nil *Client is valid and discards
+// everything, so callers don't need to check whether statsd is configured.
+type Client struct {
+	conn       net.Conn
+	tags       string // pre-formatted global tags, without the leading "|#"
+	sampleRate float32
+	maxPacket  int
+	interval   time.Duration
+
+	mu      sync.RWMutex // guards closed against sends racing Close
+	closed  bool
+	queue   chan string
+	done    chan struct{}
+	dropped uint64
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// New - a client sending to addr, a host:port of a statsd agent
+func New(addr string, opts Options) (*Client, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, opts), nil
+}
+
+func newClient(conn net.Conn, opts Options) *Client {
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = DefaultMaxPacketSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+
+	c := &Client{
+		conn:       conn,
+		tags:       strings.Join(opts.Tags, ","),
+		sampleRate: opts.SampleRate,
+		maxPacket:  opts.MaxPacketSize,
+		interval:   opts.FlushInterval,
+		queue:      make(chan string, opts.QueueSize),
+		done:       make(chan struct{}),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	go c.run()
+	return c
+}
+
+// Incr - counts one occurrence of name
+func (c *Client) Incr(name string, tags ...string) {
+	c.Count(name, 1, tags...)
+}
+
+// Count - adds value to the counter name
+func (c *Client) Count(name string, value int64, tags ...string) {
+	if c == nil || !c.sampled() {
+		return
+	}
+	c.send(name, strconv.FormatInt(value, 10), "c", true, tags)
+}
+
+// Timing - records a duration for the timer name, in milliseconds
+func (c *Client) Timing(name string, d time.Duration, tags ...string) {
+	if c == nil || !c.sampled() {
+		return
+	}
+	ms := strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+	c.send(name, ms, "ms", true, tags)
+}
+
+// Gauge - sets the gauge name to value.  Gauges are never sampled.
+func (c *Client) Gauge(name string, value float64, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", false, tags)
+}
+
+// Dropped - the number of metrics dropped because the queue was full
+func (c *Client) Dropped() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Close - sends whatever is queued and closes the connection
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.queue)
+	c.mu.Unlock()
+
+	<-c.done
+	return c.conn.Close()
+}
+
+func (c *Client) sampled() bool {
+	if c.sampleRate >= 1 {
+		return true
+	}
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return c.rand.Float32() < c.sampleRate
+}
+
+// send - formats a metric as name:value|type[|@rate][|#tags] and queues it
+func (c *Client) send(name, value, kind string, sampled bool, tags []string) {
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if sampled && c.sampleRate < 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(float64(c.sampleRate), 'f', -1, 32))
+	}
+	if c.tags != "" || len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(c.tags)
+		for i, t := range tags {
+			if i > 0 || c.tags != "" {
+				b.WriteByte(',')
+			}
+			b.WriteString(t)
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		atomic.AddUint64(&c.dropped, 1)
+		return
+	}
+	select {
+	case c.queue <- b.String():
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// run - batches queued metrics into packets of up to maxPacket bytes, sent when
+// full or every interval
+func (c *Client) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	buf := make([]byte, 0, c.maxPacket)
+	flush := func() {
+		if len(buf) > 0 {
+			c.conn.Write(buf) // nothing to do about errors, statsd is best effort
+			buf = buf[:0]
+		}
+	}
+	for {
+		select {
+		case line, ok := <-c.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if len(buf) > 0 && len(buf)+1+len(line) > c.maxPacket {
+				flush()
+			}
+			if len(buf) > 0 {
+				buf = append(buf, '\n')
+			}
+			buf = append(buf, line...)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
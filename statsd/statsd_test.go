@@ -0,0 +1,124 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen - a UDP socket standing in for the statsd agent
+func listen(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readPacket(t *testing.T, conn *net.UDPConn) string {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 65536)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no packet: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestClient_FormatAndBatch(t *testing.T) {
+	agent := listen(t)
+	c, err := New(agent.LocalAddr().String(), Options{Tags: []string{"env:test"}, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Incr("s3-helper.s3success", "bucket:svod")
+	c.Timing("s3-helper.fetch", 1500*time.Microsecond)
+	c.Gauge("s3-helper.pool.idle", 3)
+	c.Close()
+
+	want := "s3-helper.s3success:1|c|#env:test,bucket:svod\n" +
+		"s3-helper.fetch:1.5|ms|#env:test\n" +
+		"s3-helper.pool.idle:3|g|#env:test"
+	if got := readPacket(t, agent); got != want {
+		t.Fatalf("unexpected packet:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestClient_PacketSize(t *testing.T) {
+	agent := listen(t)
+	c, err := New(agent.LocalAddr().String(), Options{MaxPacketSize: 64, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Incr("counter.with.a.long.name")
+	}
+	c.Close()
+
+	lines := 0
+	for lines < 10 {
+		p := readPacket(t, agent)
+		if len(p) > 64 {
+			t.Fatalf("packet of %d bytes exceeds the limit: %q", len(p), p)
+		}
+		lines += len(strings.Split(p, "\n"))
+	}
+}
+
+func TestClient_SampleRate(t *testing.T) {
+	agent := listen(t)
+	c, err := New(agent.LocalAddr().String(), Options{SampleRate: 0.5, QueueSize: 10000, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		c.Incr("sampled")
+	}
+	c.Close()
+
+	sent := 0
+	for {
+		agent.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 65536)
+		n, err := agent.Read(buf)
+		if err != nil {
+			break
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line != "sampled:1|c|@0.5" {
+				t.Fatalf("unexpected line %q", line)
+			}
+			sent++
+		}
+	}
+	if sent < 800 || sent > 1200 {
+		t.Fatalf("expected about half of 2000 counters to be sent, got %d", sent)
+	}
+}
+
+func TestClient_NonBlocking(t *testing.T) {
+	agent := listen(t)
+	c, err := New(agent.LocalAddr().String(), Options{QueueSize: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fill the queue faster than it drains without ever blocking
+	for i := 0; i < 10000; i++ {
+		c.Incr("flood")
+	}
+	if c.Dropped() == 0 {
+		t.Fatal("expected metrics to be dropped")
+	}
+	c.Close()
+	c.Incr("after.close")
+	c.Close()
+
+	var nilClient *Client
+	nilClient.Incr("nothing")
+	nilClient.Timing("nothing", time.Second)
+	if err := nilClient.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
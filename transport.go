@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// poolStats - counters describing how well upstream connections are being reused
+type poolStats struct {
+	Dials  int64 // connections dialled since start up
+	Open   int64 // connections currently open
+	InUse  int64 // connections currently carrying a request
+	Idle   int64 // open connections parked in the pool
+	Reused int64 // requests served over an already open connection
+}
+
+// s3Transport - the single long-lived transport shared by every upstream S3 request.
+// It wraps http.Transport to keep track of dials and connection usage.
+type s3Transport struct {
+	base *http.Transport
+
+	dials  int64
+	open   int64
+	inUse  int64
+	reused int64
+}
+
+// newS3Transport - builds the shared transport from the s3_transport config section
+func newS3Transport(c *transportConfig) *s3Transport {
+	t := &s3Transport{}
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.KeepAlive,
+	}
+	t.base = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&t.dials, 1)
+			atomic.AddInt64(&t.open, 1)
+			return &trackedConn{Conn: conn, open: &t.open}, nil
+		},
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		DisableKeepAlives:     c.DisableKeepAlives,
+	}
+	return t
+}
+
+// RoundTrip - implements http.RoundTripper, counting a connection as in use from the
+// moment it is handed to the request until the response body is closed.
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var held int32
+	release := func() {
+		if atomic.CompareAndSwapInt32(&held, 1, 0) {
+			atomic.AddInt64(&t.inUse, -1)
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if atomic.CompareAndSwapInt32(&held, 0, 1) {
+				atomic.AddInt64(&t.inUse, 1)
+			}
+			if info.Reused {
+				atomic.AddInt64(&t.reused, 1)
+			}
+		},
+	}
+
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// Stats - a point in time snapshot of the connection pool
+func (t *s3Transport) Stats() poolStats {
+	s := poolStats{
+		Dials:  atomic.LoadInt64(&t.dials),
+		Open:   atomic.LoadInt64(&t.open),
+		InUse:  atomic.LoadInt64(&t.inUse),
+		Reused: atomic.LoadInt64(&t.reused),
+	}
+	if s.Idle = s.Open - s.InUse; s.Idle < 0 {
+		s.Idle = 0
+	}
+	return s
+}
+
+// CloseIdleConnections - drops every connection currently parked in the pool
+func (t *s3Transport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+// trackedConn - decrements the open connection count when the connection goes away
+type trackedConn struct {
+	net.Conn
+	open *int64
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.open, -1) })
+	return c.Conn.Close()
+}
+
+// releaseOnClose - marks the connection as no longer in use once the body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
+
+// reportPoolStats - periodically publishes the connection pool stats to New Relic and
+// statsd until stop is closed.  Dials and reuses are reported as deltas per interval.
+func (a *App) reportPoolStats(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last poolStats
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s := a.transport.Stats()
+		a.nrapp.RecordCustomMetric("s3-helper:pool:idle", float64(s.Idle))
+		a.nrapp.RecordCustomMetric("s3-helper:pool:inuse", float64(s.InUse))
+		a.nrapp.RecordCustomMetric("s3-helper:pool:open", float64(s.Open))
+		a.nrapp.RecordCustomMetric("s3-helper:pool:dials", float64(s.Dials-last.Dials))
+		a.nrapp.RecordCustomMetric("s3-helper:pool:reused", float64(s.Reused-last.Reused))
+		a.statsd.Gauge("s3-helper.pool.idle", float64(s.Idle))
+		a.statsd.Gauge("s3-helper.pool.inuse", float64(s.InUse))
+		a.statsd.Gauge("s3-helper.pool.open", float64(s.Open))
+		a.statsd.Count("s3-helper.pool.dials", s.Dials-last.Dials)
+		a.statsd.Count("s3-helper.pool.reused", s.Reused-last.Reused)
+		log.Debug().
+			Int64("idle", s.Idle).
+			Int64("inuse", s.InUse).
+			Int64("open", s.Open).
+			Int64("dials", s.Dials).
+			Int64("reused", s.Reused).
+			Msg("s3:pool - connection pool stats")
+		last = s
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestS3Transport_ReusesConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	}))
+	defer server.Close()
+
+	transport := newS3Transport(&transportConfig{
+		KeepAlive:           30 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Minute,
+		DialTimeout:         time.Second,
+	})
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+		if s := transport.Stats(); s.InUse != 1 {
+			t.Fatalf("request %d: expected 1 connection in use, got %+v", i, s)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	s := transport.Stats()
+	if s.Dials != 1 || s.Reused != 2 || s.InUse != 0 || s.Idle != 1 {
+		t.Fatalf("unexpected pool stats %+v", s)
+	}
+
+	transport.CloseIdleConnections()
+	if s := transport.Stats(); s.Open != 0 {
+		t.Fatalf("expected no open connections, got %+v", s)
+	}
+}
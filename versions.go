@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// versionPins - the versions of objects served instead of the latest one, by
+// bucket then key (with a leading /, as in objectRequest)
+type versionPins map[string]map[string]string
+
+// newVersionPins - validates and compiles versioning.pins
+func newVersionPins(c *versioningConfig) (versionPins, error) {
+	pins := make(versionPins, len(c.Pins))
+	for bucket, keys := range c.Pins {
+		pins[bucket] = make(map[string]string, len(keys))
+		for key, version := range keys {
+			if strings.Trim(key, "/") == "" || version == "" {
+				return nil, fmt.Errorf("versioning.pins.%s: %q needs a key and a version", bucket, key)
+			}
+			pins[bucket]["/"+strings.TrimPrefix(key, "/")] = version
+		}
+	}
+	return pins, nil
+}
+
+// version - the version of key in bucket that r gets: the one in its versionId
+// query parameter if versioning.allow_query is set, else the pinned one, else ""
+// for the latest
+func (rc *runtimeConfig) version(r *http.Request, bucket, key string) string {
+	if rc.conf.Versioning.AllowQuery {
+		if v := r.URL.Query().Get("versionId"); v != "" {
+			return v
+		}
+	}
+	return rc.versions[bucket][key]
+}
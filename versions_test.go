@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// versionFiles - two versions of a manifest
+var versionFiles = map[string]interface{}{
+	"svod/show/manifest.json":              []byte("latest"),
+	"svod/show/manifest.json?versionId=v1": []byte("rollback"),
+}
+
+func TestProxyS3Media_VersionQuery(t *testing.T) {
+	a := newMockApp(versionFiles)
+	withConfig(t, a, func(c *Config) { c.Versioning = versioningConfig{AllowQuery: true} })
+
+	w := serveMock(a, "GET", "/show/manifest.json?versionId=v1", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "rollback" || w.Header().Get("X-Amz-Version-Id") != "v1" {
+		t.Fatalf("unexpected response %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w := serveMock(a, "HEAD", "/show/manifest.json?versionId=v1", nil); w.Code != http.StatusOK || w.Header().Get("X-Amz-Version-Id") != "v1" {
+		t.Fatalf("HEAD: unexpected response %d %v", w.Code, w.Header())
+	}
+	if w := serveMock(a, "GET", "/show/manifest.json", nil); w.Body.String() != "latest" {
+		t.Fatalf("expected the latest version, got %q", w.Body.String())
+	}
+	if w := serveMock(a, "GET", "/show/manifest.json?versionId=v0", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("missing version: expected 404, got %d", w.Code)
+	}
+
+	withConfig(t, a, func(c *Config) { c.Versioning.AllowQuery = false })
+	if w := serveMock(a, "GET", "/show/manifest.json?versionId=v1", nil); w.Body.String() != "latest" {
+		t.Fatalf("allow_query off: expected the latest version, got %q", w.Body.String())
+	}
+}
+
+func TestProxyS3Media_VersionPins(t *testing.T) {
+	a := newMockApp(versionFiles)
+	withConfig(t, a, func(c *Config) {
+		c.Versioning = versioningConfig{
+			AllowQuery: true,
+			Pins:       map[string]map[string]string{"svod": {"show/manifest.json": "v1"}},
+		}
+	})
+
+	w := serveMock(a, "GET", "/show/manifest.json", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "rollback" || w.Header().Get("X-Amz-Version-Id") != "v1" {
+		t.Fatalf("expected the pinned version, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	// asking for a version explicitly beats the pin
+	if w := serveMock(a, "GET", "/show/manifest.json?versionId=v0", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the version asked for, got %d %q", w.Code, w.Body.String())
+	}
+
+	for _, pins := range []map[string]map[string]string{
+		{"svod": {"/": "v1"}},
+		{"svod": {"show/manifest.json": ""}},
+	} {
+		if _, err := newVersionPins(&versioningConfig{Pins: pins}); err == nil {
+			t.Errorf("%v: expected an error", pins)
+		}
+	}
+}
+
+func TestProxyS3Media_VersionSigned(t *testing.T) {
+	const version = "3/L4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY+MTRCxf3vjVBH40Nr8X8gdRQBpUMLUo"
+	s3 := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/svod/show/manifest.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if got := r.URL.Query().Get("versionId"); got != version {
+			t.Errorf("expected versionId %q, got %q", version, got)
+		}
+		if r.Header.Get("Authorization") == "" {
+			t.Errorf("request not signed")
+		}
+		w.Header().Set("x-amz-version-id", version)
+		w.Write([]byte("rollback"))
+	}
+	a := newSignedMockApp(t, s3, 0, func(c *Config) {
+		c.Versioning = versioningConfig{Pins: map[string]map[string]string{"svod": {"/show/manifest.json": version}}}
+	})
+
+	w := serveMock(a, "GET", "/show/manifest.json", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "rollback" || w.Header().Get("X-Amz-Version-Id") != version {
+		t.Fatalf("unexpected response %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+}